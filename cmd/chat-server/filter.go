@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
+)
+
+type filterAction string
+
+const (
+	filterReject filterAction = "reject"
+	filterMask   filterAction = "mask"
+	filterFlag   filterAction = "flag"
+)
+
+// filteredTypes are types of messages with content written by users.
+var filteredTypes = []internal.MessageType{internal.TextMessage, internal.PollMessage}
+
+// contentFilter finds parts of messages breaking the filter.
+type contentFilter struct {
+	action filterAction
+	reason string
+	// find returns byte ranges of the content breaking the filter
+	find func(content string) [][]int
+	// mask returns the content with the ranges masked
+	mask func(content string, ranges [][]int) string
+}
+
+// filterVerdict is the outcome of the filter chain for a message.
+type filterVerdict struct {
+	content string
+	// sent, masked, flagged or rejected
+	status internal.MessageStatus
+	// reasons of the rejection or of flagging
+	reasons []string
+}
+
+// filterChain runs messages through filters in order. The first filter
+// rejecting the message stops the chain, masked content is passed on to
+// the following filters.
+type filterChain []*contentFilter
+
+func newFilterChain(cfgs []config.ContentFilter) (filterChain, error) {
+	chain := make(filterChain, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		f, err := newContentFilter(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i, err)
+		}
+		chain = append(chain, f)
+	}
+	return chain, nil
+}
+
+func (fc filterChain) run(content string) filterVerdict {
+	verdict := filterVerdict{content: content, status: internal.Sent}
+	for _, f := range fc {
+		ranges := f.find(verdict.content)
+		if len(ranges) == 0 {
+			continue
+		}
+
+		switch f.action {
+		case filterReject:
+			return filterVerdict{content: content, status: internal.Rejected, reasons: []string{f.reason}}
+		case filterMask:
+			verdict.content = f.mask(verdict.content, ranges)
+			if verdict.status == internal.Sent {
+				verdict.status = internal.Masked
+			}
+		case filterFlag:
+			verdict.status = internal.Flagged
+			verdict.reasons = append(verdict.reasons, f.reason)
+		}
+	}
+	return verdict
+}
+
+// runPoll runs the question and every option of the poll through the chain.
+// The verdict is the strictest of all texts with reasons of all of them, the
+// poll is returned with masked options.
+func (fc filterChain) runPoll(question string, poll *internal.Poll) (filterVerdict, *internal.Poll) {
+	verdict := fc.run(question)
+	if verdict.status == internal.Rejected || poll == nil {
+		return verdict, poll
+	}
+
+	filtered := *poll
+	filtered.Options = slices.Clone(poll.Options)
+	for i, opt := range filtered.Options {
+		v := fc.run(opt.Text)
+		if v.status == internal.Rejected {
+			return v, poll
+		}
+
+		filtered.Options[i].Text = v.content
+		verdict.reasons = append(verdict.reasons, v.reasons...)
+		if v.status == internal.Flagged || verdict.status == internal.Sent {
+			verdict.status = v.status
+		}
+	}
+	return verdict, &filtered
+}
+
+func newContentFilter(cfg config.ContentFilter) (*contentFilter, error) {
+	f := &contentFilter{mask: maskRanges}
+
+	switch cfg.Type {
+	case "maxLength":
+		if cfg.MaxLength <= 0 {
+			return nil, fmt.Errorf("max length %d isn't positive", cfg.MaxLength)
+		}
+		f.action, f.reason = filterReject, "too long"
+		f.find = maxLengthFinder(cfg.MaxLength)
+		// masking cuts off the rest of the message
+		f.mask = func(content string, ranges [][]int) string {
+			return content[:ranges[0][0]]
+		}
+	case "blocklist":
+		f.action, f.reason = filterMask, "blocked word"
+		f.find = blocklistFinder(cfg.Words)
+	case "links":
+		f.action, f.reason = filterReject, "link to a denied domain"
+		f.find = linkFinder(cfg.AllowedDomains, cfg.DeniedDomains)
+	case "regex":
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.action, f.reason = filterFlag, fmt.Sprintf("matches %q", cfg.Pattern)
+		f.find = func(content string) [][]int {
+			return re.FindAllStringIndex(content, -1)
+		}
+	default:
+		return nil, fmt.Errorf("unknown filter type %q", cfg.Type)
+	}
+
+	switch action := filterAction(cfg.Action); action {
+	case "":
+	case filterReject, filterMask, filterFlag:
+		f.action = action
+	default:
+		return nil, fmt.Errorf("unknown filter action %q", cfg.Action)
+	}
+
+	if cfg.Reason != "" {
+		f.reason = cfg.Reason
+	}
+
+	return f, nil
+}
+
+// maskRanges replaces every character in the ranges with an asterisk.
+func maskRanges(content string, ranges [][]int) string {
+	var b strings.Builder
+	last := 0
+	for _, r := range ranges {
+		b.WriteString(content[last:r[0]])
+		b.WriteString(strings.Repeat("*", utf8.RuneCountInString(content[r[0]:r[1]])))
+		last = r[1]
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+// maxLengthFinder finds characters after the first limit characters.
+func maxLengthFinder(limit int) func(content string) [][]int {
+	return func(content string) [][]int {
+		count := 0
+		for i := range content {
+			if count == limit {
+				return [][]int{{i, len(content)}}
+			}
+			count++
+		}
+		return nil
+	}
+}
+
+// blocklistFinder finds whole words of the list regardless of their case.
+func blocklistFinder(words []string) func(content string) [][]int {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return func(string) [][]int { return nil }
+	}
+
+	// \b of regexp knows only ASCII words, so boundaries are checked after
+	re := regexp.MustCompile(`(?i)(?:` + strings.Join(quoted, "|") + `)`)
+	return func(content string) [][]int {
+		return slices.DeleteFunc(re.FindAllStringIndex(content, -1), func(r []int) bool {
+			before, _ := utf8.DecodeLastRuneInString(content[:r[0]])
+			after, _ := utf8.DecodeRuneInString(content[r[1]:])
+			return isWordRune(before) || isWordRune(after)
+		})
+	}
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// linkFinder finds links to denied domains, or to domains which aren't
+// allowed when allowed domains are given.
+func linkFinder(allowed []string, denied []string) func(content string) [][]int {
+	return func(content string) [][]int {
+		return slices.DeleteFunc(urlRegexp.FindAllStringIndex(content, -1), func(r []int) bool {
+			u, err := url.Parse(content[r[0]:r[1]])
+			if err != nil {
+				return false
+			}
+
+			host := strings.ToLower(u.Hostname())
+			if matchesDomain(host, denied) {
+				return false
+			}
+			return len(allowed) == 0 || matchesDomain(host, allowed)
+		})
+	}
+}
+
+// matchesDomain reports whether the host is one of the domains or their
+// subdomain.
+func matchesDomain(host string, domains []string) bool {
+	return slices.ContainsFunc(domains, func(d string) bool {
+		d = strings.ToLower(d)
+		return host == d || strings.HasSuffix(host, "."+d)
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
+)
+
+func TestFilterChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []config.ContentFilter
+		content string
+		status  internal.MessageStatus
+		result  string
+		reasons []string
+	}{
+		{
+			"no filters",
+			nil,
+			"hello",
+			internal.Sent, "hello", nil,
+		},
+		{
+			"blocklist masks whole words",
+			[]config.ContentFilter{{Type: "blocklist", Words: []string{"darn"}}},
+			"Darn it, darnit",
+			internal.Masked, "**** it, darnit", nil,
+		},
+		{
+			"blocklist masks characters",
+			[]config.ContentFilter{{Type: "blocklist", Words: []string{"żółw"}}},
+			"a żółw",
+			internal.Masked, "a ****", nil,
+		},
+		{
+			"max length rejects",
+			[]config.ContentFilter{{Type: "maxLength", MaxLength: 3}},
+			"hello",
+			internal.Rejected, "hello", []string{"too long"},
+		},
+		{
+			"max length counts characters",
+			[]config.ContentFilter{{Type: "maxLength", MaxLength: 3}},
+			"żół",
+			internal.Sent, "żół", nil,
+		},
+		{
+			"max length masks by cutting",
+			[]config.ContentFilter{{Type: "maxLength", MaxLength: 3, Action: "mask"}},
+			"żółw",
+			internal.Masked, "żół", nil,
+		},
+		{
+			"denied domain",
+			[]config.ContentFilter{{Type: "links", DeniedDomains: []string{"spam.com"}}},
+			"see https://www.SPAM.com/offer",
+			internal.Rejected, "see https://www.SPAM.com/offer", []string{"link to a denied domain"},
+		},
+		{
+			"domain similar to denied",
+			[]config.ContentFilter{{Type: "links", DeniedDomains: []string{"spam.com"}}},
+			"see https://nospam.com/",
+			internal.Sent, "see https://nospam.com/", nil,
+		},
+		{
+			"domain not allowed",
+			[]config.ContentFilter{{Type: "links", AllowedDomains: []string{"example.com"}, Action: "mask"}},
+			"https://docs.example.com ok, http://other.org/ not",
+			internal.Masked, "https://docs.example.com ok, ***************** not", nil,
+		},
+		{
+			"regex flags",
+			[]config.ContentFilter{{Type: "regex", Pattern: `\d{4}-\d{4}`, Reason: "card number"}},
+			"my card 1234-5678",
+			internal.Flagged, "my card 1234-5678", []string{"card number"},
+		},
+		{
+			"masked content goes on and flag wins",
+			[]config.ContentFilter{
+				{Type: "blocklist", Words: []string{"darn"}},
+				{Type: "regex", Pattern: `(?i)it`},
+			},
+			"darn it",
+			internal.Flagged, "**** it", []string{`matches "(?i)it"`},
+		},
+		{
+			"reject stops the chain",
+			[]config.ContentFilter{
+				{Type: "blocklist", Words: []string{"darn"}},
+				{Type: "maxLength", MaxLength: 2},
+				{Type: "regex", Pattern: "it"},
+			},
+			"darn it",
+			internal.Rejected, "darn it", []string{"too long"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := newFilterChain(tt.filters)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			verdict := chain.run(tt.content)
+			if verdict.status != tt.status {
+				t.Errorf("got status %q expected %q", verdict.status, tt.status)
+			}
+			if verdict.content != tt.result {
+				t.Errorf("got content %q expected %q", verdict.content, tt.result)
+			}
+			if !slices.Equal(verdict.reasons, tt.reasons) {
+				t.Errorf("got reasons %q expected %q", verdict.reasons, tt.reasons)
+			}
+		})
+	}
+}
+
+func TestFilterChain_Poll(t *testing.T) {
+	chain, err := newFilterChain([]config.ContentFilter{
+		{Type: "blocklist", Words: []string{"darn"}},
+		{Type: "links", DeniedDomains: []string{"spam.example"}},
+		{Type: "regex", Pattern: "pills"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		question string
+		options  []string
+		status   internal.MessageStatus
+		result   []string
+		reasons  []string
+	}{
+		{
+			"clean poll",
+			"Lunch?", []string{"pizza", "salad"},
+			internal.Sent, []string{"pizza", "salad"}, nil,
+		},
+		{
+			"blocked word in an option is masked",
+			"Lunch?", []string{"pizza", "darn salad"},
+			internal.Masked, []string{"pizza", "**** salad"}, nil,
+		},
+		{
+			"denied link in an option rejects the poll",
+			"Lunch?", []string{"pizza", "https://spam.example/menu"},
+			internal.Rejected, nil, []string{"link to a denied domain"},
+		},
+		{
+			"flagged option flags the masked poll",
+			"Darn lunch?", []string{"pizza", "pills"},
+			internal.Flagged, []string{"pizza", "pills"}, []string{`matches "pills"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			poll := internal.NewPoll(tt.options, false, false, time.Time{})
+			verdict, filtered := chain.runPoll(tt.question, poll)
+			if verdict.status != tt.status {
+				t.Errorf("got status %q expected %q", verdict.status, tt.status)
+			}
+			if !slices.Equal(verdict.reasons, tt.reasons) {
+				t.Errorf("got reasons %q expected %q", verdict.reasons, tt.reasons)
+			}
+			if tt.result == nil {
+				return
+			}
+
+			var texts []string
+			for _, opt := range filtered.Options {
+				texts = append(texts, opt.Text)
+			}
+			if !slices.Equal(texts, tt.result) {
+				t.Errorf("got options %q expected %q", texts, tt.result)
+			}
+			if poll.Options[1].Text != tt.options[1] {
+				t.Error("options of the poll were changed in place")
+			}
+		})
+	}
+}
+
+func TestNewFilterChainErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter config.ContentFilter
+	}{
+		{"unknown type", config.ContentFilter{Type: "spell"}},
+		{"unknown action", config.ContentFilter{Type: "blocklist", Action: "drop"}},
+		{"invalid pattern", config.ContentFilter{Type: "regex", Pattern: "("}},
+		{"no max length", config.ContentFilter{Type: "maxLength"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newFilterChain([]config.ContentFilter{tt.filter}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
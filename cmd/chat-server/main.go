@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ellezio/Chat-app-with-Go/internal"
 	"github.com/ellezio/Chat-app-with-Go/internal/config"
@@ -14,6 +17,7 @@ import (
 	"github.com/ellezio/Chat-app-with-Go/internal/rabbitmq"
 	"github.com/ellezio/Chat-app-with-Go/internal/store"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type chat struct {
@@ -26,9 +30,12 @@ type chat struct {
 // chats stored only in handler doesn't scale
 // this will be move to probably Redis
 type handler struct {
-	store internal.Store
-	chats map[string]*chat
-	mu    sync.Mutex
+	store    internal.Store
+	chats    map[string]*chat
+	mu       sync.Mutex
+	unfurler *unfurler
+	scans    *scanWatcher
+	filters  filterChain
 }
 
 func assertAndCall[T any](eventName string, fn func(evt internal.ChatEvent, arg T) (any, error), evt internal.ChatEvent, arg any) (any, error) {
@@ -49,13 +56,16 @@ func (h *handler) handle(d *amqp.Delivery, pub *rabbitmq.Publisher) error {
 		return fmt.Errorf("Cannot process message: %v", err)
 	}
 
+	if err = h.authorize(event); err != nil {
+		d.Ack(false)
+		return err
+	}
+
 	var broadcastDetails any
 
 	switch event.Type {
 	case internal.Event_NewMessage:
 		broadcastDetails, err = assertAndCall("NewMessage", h.newMessage, event, event.Details)
-	case internal.Event_UpdateMessage:
-		broadcastDetails, err = assertAndCall("UpdateMessage", h.updateMessage, event, event.Details)
 	case internal.Event_EditMessage:
 		broadcastDetails, err = assertAndCall("EditMessage", h.editMessage, event, event.Details)
 	case internal.Event_HideMessage:
@@ -66,6 +76,28 @@ func (h *handler) handle(d *amqp.Delivery, pub *rabbitmq.Publisher) error {
 	// broadcastDetails, err = assertAndCall("PinMessage", h.pinMessage, event, event.Details)
 	case internal.Event_NewChat:
 		broadcastDetails, err = assertAndCall("NewChat", h.newChat, event, event.Details)
+	// changes of chats are broadcast with the changed chat
+	case internal.Event_RenameChat:
+		broadcastDetails, err = assertAndCall("RenameChat", h.renameChat, event, event.Details)
+	case internal.Event_DescribeChat:
+		broadcastDetails, err = assertAndCall("DescribeChat", h.describeChat, event, event.Details)
+	case internal.Event_ArchiveChat:
+		broadcastDetails, err = assertAndCall("ArchiveChat", h.archiveChat, event, event.Details)
+	case internal.Event_DeleteChat:
+		broadcastDetails, err = assertAndCall("DeleteChat", h.deleteChat, event, event.Details)
+	case internal.Event_SetRole:
+		broadcastDetails, err = assertAndCall("SetRole", h.setRole, event, event.Details)
+	case internal.Event_MuteUser:
+		broadcastDetails, err = assertAndCall("MuteUser", h.muteUser, event, event.Details)
+	case internal.Event_BanUser:
+		broadcastDetails, err = assertAndCall("BanUser", h.banUser, event, event.Details)
+	// changes of polls are broadcast as updates of the poll message
+	case internal.Event_VotePoll:
+		broadcastDetails, err = assertAndCall("VotePoll", h.votePoll, event, event.Details)
+		event.Type = internal.Event_UpdateMessage
+	case internal.Event_ClosePoll:
+		broadcastDetails, err = assertAndCall("ClosePoll", h.closePoll, event, event.Details)
+		event.Type = internal.Event_UpdateMessage
 	default:
 		err = fmt.Errorf("Unknown event type %v", event.Type)
 	}
@@ -75,9 +107,20 @@ func (h *handler) handle(d *amqp.Delivery, pub *rabbitmq.Publisher) error {
 		return err
 	}
 
+	// members are known only from details of the request
+	member := h.eventMember(event)
+
 	if broadcastDetails != nil {
 		event.Details = broadcastDetails
-		err = h.broadcast(d, pub, event)
+		if err := h.broadcast(d, pub, event); err != nil {
+			return err
+		}
+	}
+
+	// the system message follows the event, so the chat is already known
+	// to webapp instances
+	if chatId, content := systemMessage(event, member); content != "" {
+		err = h.postSystemMessage(pub, chatId, event.UserId, content)
 	}
 
 	d.Ack(false)
@@ -90,24 +133,121 @@ func (h *handler) handle(d *amqp.Delivery, pub *rabbitmq.Publisher) error {
 }
 
 func (h *handler) newMessage(evt internal.ChatEvent, details internal.MessageEventDetails) (any, error) {
-	msg := internal.New(evt.ChatId, evt.UserId, details.Content, details.Type)
-	msg.Status = internal.Sent
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return nil, err
+	}
+	if cht.Archived {
+		return nil, fmt.Errorf("chat %s is archived", evt.ChatId)
+	}
+	if cht.Muted(evt.UserId, time.Now()) {
+		return h.rejectMessage(evt, details, internal.Error)
+	}
+
+	verdict := filterVerdict{content: details.Content, status: internal.Sent}
+	poll := details.Poll
+	if details.Type == internal.PollMessage {
+		verdict, poll = h.filters.runPoll(details.Content, details.Poll)
+	} else if slices.Contains(filteredTypes, details.Type) {
+		verdict = h.filters.run(details.Content)
+	}
+	if verdict.status == internal.Rejected {
+		log.DefaultContextLogger.Info("Message rejected by content filter",
+			slog.String("chat", evt.ChatId), slog.String("user", evt.UserId), slog.Any("reasons", verdict.reasons))
+		return h.rejectMessage(evt, details, internal.Rejected)
+	}
 
-	err := h.store.SaveMessage(msg)
+	msg := internal.New(evt.ChatId, evt.UserId, verdict.content, details.Type)
+	msg.File = details.File
+	msg.Status = verdict.status
+	if details.Status == internal.Scanning && slices.Contains(internal.FileMessageTypes, details.Type) {
+		msg.Status = internal.Scanning
+	}
+	if details.Type == internal.PollMessage {
+		if poll == nil || len(poll.Options) < 2 {
+			return nil, fmt.Errorf("poll %q without options", details.Content)
+		}
+		msg.Poll = poll
+	}
+
+	err = h.store.SaveMessage(msg)
 	if err != nil {
 		return nil, err
 	}
 
+	h.unfurler.enqueue(msg, false)
+	h.scans.watch(msg)
+	h.reportFlagged(msg, verdict)
+
 	return msg, nil
 }
 
-func (h *handler) updateMessage(evt internal.ChatEvent, details internal.Message) (any, error) {
-	h.store.SaveMessage(&details)
-	return details, nil
+// rejectMessage returns the message with the error or rejected status
+// without saving it, so it is pushed back only to its author.
+func (h *handler) rejectMessage(evt internal.ChatEvent, details internal.MessageEventDetails, status internal.MessageStatus) (any, error) {
+	author, err := h.store.GetUserById(evt.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := internal.New(evt.ChatId, evt.UserId, details.Content, details.Type)
+	msg.Id = bson.NewObjectID()
+	msg.Author = *author
+	msg.Status = status
+	return msg, nil
+}
+
+// reportFlagged files a report of the message flagged by the content filter
+// for moderators of the chat.
+func (h *handler) reportFlagged(msg *internal.Message, verdict filterVerdict) {
+	if verdict.status != internal.Flagged {
+		return
+	}
+
+	err := h.store.SaveReport(&internal.Report{
+		ChatId:    msg.ChatId.Hex(),
+		MessageId: msg.Id.Hex(),
+		AuthorId:  msg.AuthorId,
+		Reason:    strings.Join(verdict.reasons, ", "),
+		Status:    internal.ReportOpen,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.DefaultContextLogger.Error("Failed to report flagged message",
+			slog.String("message", msg.Id.Hex()), slog.Any("error", err))
+	}
 }
 
 func (h *handler) editMessage(evt internal.ChatEvent, details internal.MessageEventDetails) (any, error) {
-	return h.store.UpdateMessageContent(details.Id, details.Content)
+	verdict := h.filters.run(details.Content)
+	if verdict.status == internal.Rejected {
+		log.DefaultContextLogger.Info("Edit rejected by content filter",
+			slog.String("message", details.Id), slog.Any("reasons", verdict.reasons))
+
+		// the author gets back the message as it was
+		msg, err := h.store.GetMessage(details.Id)
+		if err != nil {
+			return nil, err
+		}
+		msg.Status = internal.Rejected
+		return msg, nil
+	}
+
+	msg, err := h.store.UpdateMessageContent(details.Id, verdict.content)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Status != verdict.status {
+		if msg, err = h.store.SetMessageStatus(details.Id, verdict.status); err != nil {
+			return nil, err
+		}
+	}
+	h.reportFlagged(msg, verdict)
+
+	h.unfurler.enqueue(msg, len(msg.Previews) > 0)
+
+	return msg, nil
 }
 
 func (h *handler) hideMessage(evt internal.ChatEvent, details internal.MessageEventDetails) (any, error) {
@@ -118,6 +258,35 @@ func (h *handler) deleteMessage(evt internal.ChatEvent, details internal.Message
 	return h.store.DeleteMessage(details.Id)
 }
 
+func (h *handler) votePoll(evt internal.ChatEvent, details internal.MessageEventDetails) (any, error) {
+	user, err := h.store.GetUserById(evt.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	voter := internal.PollVoter{Id: evt.UserId, Name: user.Name}
+	return h.store.VotePoll(details.Id, voter, details.Votes)
+}
+
+// closePoll closes the poll before its close time, only the author can close it.
+func (h *handler) closePoll(evt internal.ChatEvent, details internal.MessageEventDetails) (any, error) {
+	msg, err := h.store.GetMessage(details.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Poll == nil || msg.AuthorId != evt.UserId {
+		return nil, fmt.Errorf("user %s can't close poll %s", evt.UserId, details.Id)
+	}
+
+	now := time.Now()
+	if msg.Poll.Closed(now) {
+		return nil, internal.ErrPollClosed
+	}
+
+	return h.store.ClosePoll(details.Id, now)
+}
+
 // func (h *handler) pinMessage(d *amqp.Delivery, ch *amqp.Channel, event internal.ChatEvent) {}
 
 func (h *handler) newChat(evt internal.ChatEvent, details *internal.Chat) (any, error) {
@@ -128,10 +297,227 @@ func (h *handler) newChat(evt internal.ChatEvent, details *internal.Chat) (any,
 	return details, nil
 }
 
+// authorize checks the role of the user in the chat of the event again,
+// as the role may change after the webapp checked it.
+func (h *handler) authorize(evt internal.ChatEvent) error {
+	switch evt.Type {
+	// new chats have no roles yet
+	case internal.Event_NewChat:
+		return nil
+	// updates are made by the chat server itself and sent straight to webapp
+	// instances, users could replace whole messages with them
+	case internal.Event_UpdateMessage:
+		return fmt.Errorf("%w: user %s, event %v in chat %s", internal.ErrForbidden, evt.UserId, evt.Type, evt.ChatId)
+	}
+
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return err
+	}
+	role := cht.Role(evt.UserId)
+
+	allowed := !cht.Banned(evt.UserId)
+	switch evt.Type {
+	case internal.Event_NewMessage, internal.Event_EditMessage:
+		allowed = allowed && role.CanPost()
+	case internal.Event_DeleteMessage:
+		details, _ := evt.Details.(internal.MessageEventDetails)
+		msg, err := h.store.GetMessage(details.Id)
+		if err != nil {
+			return err
+		}
+		allowed = allowed && cht.CanDeleteMessage(msg, evt.UserId)
+	case internal.Event_PinMessage, internal.Event_RenameChat, internal.Event_DescribeChat, internal.Event_ArchiveChat,
+		internal.Event_MuteUser, internal.Event_BanUser:
+		allowed = role.CanModerate()
+	case internal.Event_DeleteChat, internal.Event_SetRole:
+		allowed = role == internal.RoleOwner
+	}
+
+	if !allowed {
+		return fmt.Errorf("%w: user %s with role %q, event %v in chat %s", internal.ErrForbidden, evt.UserId, role, evt.Type, evt.ChatId)
+	}
+	return nil
+}
+
+func (h *handler) renameChat(evt internal.ChatEvent, details internal.ChatEventDetails) (any, error) {
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return nil, err
+	}
+
+	if details.Name == "" {
+		return nil, fmt.Errorf("empty name of chat %s", evt.ChatId)
+	}
+
+	cht.Name = details.Name
+	if err := h.store.SaveChat(cht); err != nil {
+		return nil, err
+	}
+
+	return cht, nil
+}
+
+func (h *handler) describeChat(evt internal.ChatEvent, details internal.ChatEventDetails) (any, error) {
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return nil, err
+	}
+
+	cht.Description = details.Description
+	if err := h.store.SaveChat(cht); err != nil {
+		return nil, err
+	}
+
+	return cht, nil
+}
+
+func (h *handler) archiveChat(evt internal.ChatEvent, details internal.ChatEventDetails) (any, error) {
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return nil, err
+	}
+
+	if cht.Archived == details.Archived {
+		return nil, nil
+	}
+
+	cht.Archived = details.Archived
+	if err := h.store.SaveChat(cht); err != nil {
+		return nil, err
+	}
+
+	return cht, nil
+}
+
+func (h *handler) setRole(evt internal.ChatEvent, details internal.ChatEventDetails) (any, error) {
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(internal.AssignableRoles, details.Role) || cht.IsOwner(details.MemberId) {
+		return nil, fmt.Errorf("can't set role %q of user %s", details.Role, details.MemberId)
+	}
+	if _, err := h.store.GetUserById(details.MemberId); err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]internal.Role, len(cht.Members)+1)
+	for id, role := range cht.Members {
+		members[id] = role
+	}
+	if details.Role == internal.RoleMember {
+		delete(members, details.MemberId)
+	} else {
+		members[details.MemberId] = details.Role
+	}
+
+	cht.Members = members
+	if err := h.store.SaveChat(cht); err != nil {
+		return nil, err
+	}
+
+	return cht, nil
+}
+
+// restrictedMember checks the user can be muted or banned, moderators
+// can't restrict each other.
+func (h *handler) restrictedMember(cht *internal.Chat, memberId string) error {
+	if cht.Role(memberId).CanModerate() {
+		return fmt.Errorf("user %s moderates chat %s", memberId, cht.Id)
+	}
+	_, err := h.store.GetUserById(memberId)
+	return err
+}
+
+func (h *handler) muteUser(evt internal.ChatEvent, details internal.ChatEventDetails) (any, error) {
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.restrictedMember(cht, details.MemberId); err != nil {
+		return nil, err
+	}
+
+	// ended mutes are dropped on the way
+	now := time.Now()
+	mutes := make(map[string]time.Time, len(cht.Mutes)+1)
+	for id, until := range cht.Mutes {
+		if now.Before(until) {
+			mutes[id] = until
+		}
+	}
+	if now.Before(details.Until) {
+		mutes[details.MemberId] = details.Until
+	} else {
+		delete(mutes, details.MemberId)
+	}
+
+	cht.Mutes = mutes
+	if err := h.store.SaveChat(cht); err != nil {
+		return nil, err
+	}
+
+	return cht, nil
+}
+
+func (h *handler) banUser(evt internal.ChatEvent, details internal.ChatEventDetails) (any, error) {
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.restrictedMember(cht, details.MemberId); err != nil {
+		return nil, err
+	}
+
+	bans := make(map[string]bool, len(cht.Bans)+1)
+	for id := range cht.Bans {
+		bans[id] = true
+	}
+	if details.Banned {
+		bans[details.MemberId] = true
+	} else {
+		delete(bans, details.MemberId)
+	}
+
+	cht.Bans = bans
+	if err := h.store.SaveChat(cht); err != nil {
+		return nil, err
+	}
+
+	return cht, nil
+}
+
+func (h *handler) deleteChat(evt internal.ChatEvent, details internal.ChatEventDetails) (any, error) {
+	cht, err := h.store.GetChat(evt.ChatId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.store.DeleteChat(cht.Id); err != nil {
+		return nil, err
+	}
+
+	return cht, nil
+}
+
+// broadcast notifies webapp instances about the processed event. The delivery
+// is acknowledged when the event can't be published, so it isn't left unacked.
 func (h *handler) broadcast(d *amqp.Delivery, pub *rabbitmq.Publisher, event internal.ChatEvent) error {
+	if err := notify(pub, event); err != nil {
+		d.Ack(false)
+		return err
+	}
+	return nil
+}
+
+// notify publishes the event to all webapp instances.
+func notify(pub *rabbitmq.Publisher, event internal.ChatEvent) error {
 	body, err := json.Marshal(event)
 	if err != nil {
-		d.Ack(false)
 		return fmt.Errorf("Failed to broadcast message: %v", err)
 	}
 
@@ -150,6 +536,22 @@ func (h *handler) broadcast(d *amqp.Delivery, pub *rabbitmq.Publisher, event int
 	return nil
 }
 
+// enqueue publishes the event to chat servers for processing.
+func enqueue(pub *rabbitmq.Publisher, event internal.ChatEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("Failed to enqueue event: %v", err)
+	}
+
+	return pub.Publish(
+		"",              // exchange
+		"chat_messages", // routing key
+		amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        body,
+		})
+}
+
 func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})).
 		With("service", "chat-server")
@@ -196,7 +598,35 @@ func main() {
 		return
 	}
 
-	h := handler{store: sto, chats: make(map[string]*chat), mu: sync.Mutex{}}
+	unf := newUnfurler(cfg.ChatServer.Unfurl, sto, func(event internal.ChatEvent) error {
+		return notify(publisher, event)
+	})
+	unf.start()
+
+	scans := newScanWatcher(cfg.ChatServer.FileServer, sto, func(event internal.ChatEvent) error {
+		return notify(publisher, event)
+	})
+	if err := scans.resume(); err != nil {
+		logger.Error("failed to resume watching file scans", slog.Any("error", err))
+	}
+
+	sched := newScheduler(cfg.ChatServer.SchedulePollMs, sto, func(event internal.ChatEvent) error {
+		return enqueue(publisher, event)
+	})
+	sched.start()
+
+	purge := newPurger(cfg.ChatServer, sto, cache, func(event internal.ChatEvent) error {
+		return notify(publisher, event)
+	})
+	purge.start()
+
+	filters, err := newFilterChain(cfg.ChatServer.Filters)
+	if err != nil {
+		logger.Error("failed to configure content filters", slog.Any("error", err))
+		return
+	}
+
+	h := handler{store: sto, chats: make(map[string]*chat), mu: sync.Mutex{}, unfurler: unf, scans: scans, filters: filters}
 	consume := func(d amqp.Delivery) {
 		msgLogger := logger.With("correlation_id", d.CorrelationId)
 		msgLogger.Debug("Received a message", slog.String("body", string(d.Body)))
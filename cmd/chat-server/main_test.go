@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// fakeStore keeps a chat and its messages, methods which aren't used
+// by the tests panic.
+type fakeStore struct {
+	internal.Store
+
+	chat     *internal.Chat
+	messages map[string]*internal.Message
+}
+
+func (s *fakeStore) GetChat(chatId string) (*internal.Chat, error) {
+	if chatId != s.chat.Id {
+		return nil, errors.New("no chat")
+	}
+	return s.chat, nil
+}
+
+func (s *fakeStore) GetMessage(id string) (*internal.Message, error) {
+	if msg, ok := s.messages[id]; ok {
+		return msg, nil
+	}
+	return nil, errors.New("no message")
+}
+
+func (s *fakeStore) DeleteMessage(id string) (*internal.Message, error) {
+	msg, err := s.GetMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	msg.Deleted = true
+	return msg, nil
+}
+
+func (s *fakeStore) SaveMessage(msg *internal.Message) error {
+	if msg.Id.IsZero() {
+		msg.Id = bson.NewObjectID()
+	}
+	s.messages[msg.Id.Hex()] = msg
+	return nil
+}
+
+// acknowledger counts acknowledged deliveries.
+type acknowledger struct {
+	amqp.Acknowledger
+	acks int
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func TestHandler_BroadcastAcksUnpublishableEvent(t *testing.T) {
+	ack := &acknowledger{}
+	d := &amqp.Delivery{Acknowledger: ack}
+	h := &handler{}
+
+	// the event can't be marshaled, so it never reaches the publisher
+	evt := internal.ChatEvent{Type: internal.Event_NewMessage, Details: make(chan int)}
+	if err := h.broadcast(d, nil, evt); err == nil {
+		t.Fatal("expected error")
+	}
+	if ack.acks != 1 {
+		t.Errorf("delivery acknowledged %d times expected once", ack.acks)
+	}
+}
+
+func TestHandler_NewPollMasksBlockedOptions(t *testing.T) {
+	filters, err := newFilterChain([]config.ContentFilter{{Type: "blocklist", Words: []string{"darn"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cht := &internal.Chat{Id: bson.NewObjectID().Hex(), OwnerId: "carol"}
+	st := &fakeStore{chat: cht, messages: make(map[string]*internal.Message)}
+	h := &handler{store: st, filters: filters}
+
+	details := internal.MessageEventDetails{
+		Type:    internal.PollMessage,
+		Content: "Lunch?",
+		Poll:    internal.NewPoll([]string{"pizza", "darn salad"}, false, false, time.Time{}),
+	}
+	res, err := h.newMessage(internal.ChatEvent{Type: internal.Event_NewMessage, ChatId: cht.Id, UserId: "bob", Details: details}, details)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := res.(*internal.Message)
+	if msg.Status != internal.Masked || msg.Poll.Options[1].Text != "**** salad" {
+		t.Errorf("expected masked option, got status %q and option %q", msg.Status, msg.Poll.Options[1].Text)
+	}
+	if st.messages[msg.Id.Hex()] != msg {
+		t.Error("poll is not saved")
+	}
+}
+
+func TestHandler_DeleteMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		userId  string
+		allowed bool
+	}{
+		{"author", "bob", true},
+		{"owner", "carol", true},
+		{"moderator", "mia", true},
+		{"other member", "alice", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cht := &internal.Chat{
+				Id:      bson.NewObjectID().Hex(),
+				OwnerId: "carol",
+				Members: map[string]internal.Role{"mia": internal.RoleModerator},
+			}
+			msg := internal.New(cht.Id, "bob", "buy cheap pills", internal.TextMessage)
+			msg.Id = bson.NewObjectID()
+			h := &handler{store: &fakeStore{chat: cht, messages: map[string]*internal.Message{msg.Id.Hex(): msg}}}
+
+			evt := internal.ChatEvent{
+				Type:    internal.Event_DeleteMessage,
+				ChatId:  cht.Id,
+				UserId:  tt.userId,
+				Details: internal.MessageEventDetails{Id: msg.Id.Hex(), Deleted: true},
+			}
+
+			err := h.authorize(evt)
+			if !tt.allowed {
+				if !errors.Is(err, internal.ErrForbidden) {
+					t.Errorf("expected forbidden, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := h.deleteMessage(evt, evt.Details.(internal.MessageEventDetails)); err != nil {
+				t.Fatal(err)
+			}
+			if !msg.Deleted {
+				t.Error("message is not deleted")
+			}
+		})
+	}
+}
+
+func TestHandler_AuthorizeRejectsUpdates(t *testing.T) {
+	cht := &internal.Chat{Id: bson.NewObjectID().Hex(), OwnerId: "carol"}
+	h := &handler{store: &fakeStore{chat: cht}}
+
+	msg := internal.New(cht.Id, "bob", "hello", internal.TextMessage)
+	msg.Id = bson.NewObjectID()
+	msg.Content = "replaced"
+
+	// not even the owner can replace messages
+	for _, userId := range []string{"bob", "carol"} {
+		evt := internal.ChatEvent{Type: internal.Event_UpdateMessage, ChatId: cht.Id, UserId: userId, Details: msg}
+		if err := h.authorize(evt); !errors.Is(err, internal.ErrForbidden) {
+			t.Errorf("update by %s: expected forbidden, got %v", userId, err)
+		}
+	}
+}
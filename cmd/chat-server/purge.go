@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+	"github.com/ellezio/Chat-app-with-Go/internal/store"
+)
+
+type purgeStore interface {
+	GetChats() ([]*internal.Chat, error)
+	PurgeExpiredMessage(chatId string, before time.Time) (*internal.Message, error)
+}
+
+// fileUsage frees storage usage of deleted files.
+type fileUsage interface {
+	ReleaseFileUsage(ctx context.Context, fname string) error
+}
+
+// purger deletes messages older than the message TTL of their chat
+// together with attached files, clients are notified about the deletion.
+type purger struct {
+	client     *http.Client
+	fileServer string
+	adminToken string
+	interval   time.Duration
+
+	store   purgeStore
+	usage   fileUsage
+	publish func(event internal.ChatEvent) error
+	logger  *slog.Logger
+}
+
+func newPurger(cfg config.ChatServer, store purgeStore, usage fileUsage, publish func(event internal.ChatEvent) error) *purger {
+	return &purger{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		fileServer: cfg.FileServer.URL,
+		adminToken: cfg.FileServer.AdminToken,
+		interval:   time.Duration(max(cfg.PurgeIntervalMs, 1000)) * time.Millisecond,
+		store:      store,
+		usage:      usage,
+		publish:    publish,
+		logger:     log.DefaultContextLogger,
+	}
+}
+
+func (p *purger) start() {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			p.purge(now)
+		}
+	}()
+}
+
+// purge deletes messages expired at the time in all chats with a TTL.
+func (p *purger) purge(now time.Time) {
+	chts, err := p.store.GetChats()
+	if err != nil {
+		p.logger.Error("failed to get chats to purge", slog.Any("error", err))
+		return
+	}
+
+	for _, cht := range chts {
+		if cht.MessageTTL > 0 {
+			p.purgeChat(cht.Id, now.Add(-cht.MessageTTL))
+		}
+	}
+}
+
+func (p *purger) purgeChat(chatId string, before time.Time) {
+	for {
+		msg, err := p.store.PurgeExpiredMessage(chatId, before)
+		if errors.Is(err, store.ErrNoRecord) {
+			return
+		} else if err != nil {
+			p.logger.Error("failed to purge message", slog.String("chat_id", chatId), slog.Any("error", err))
+			return
+		}
+
+		logger := p.logger.With(slog.String("message_id", msg.Id.Hex()))
+
+		// files left behind are removed by the file garbage collector
+		if slices.Contains(internal.FileMessageTypes, msg.Type) {
+			p.releaseFileOf(logger, msg)
+		}
+
+		msg.Deleted = true
+		event := internal.ChatEvent{
+			Type:    internal.Event_DeleteMessage,
+			ChatId:  chatId,
+			UserId:  msg.AuthorId,
+			Details: msg,
+		}
+
+		if err := p.publish(event); err != nil {
+			logger.Error("failed to broadcast purged message", slog.Any("error", err))
+		}
+	}
+}
+
+// releaseFileOf releases the file of the purged message, storage usage
+// is freed when the file is deleted.
+func (p *purger) releaseFileOf(logger *slog.Logger, msg *internal.Message) {
+	ctx := context.Background()
+	deleted, err := p.releaseFile(ctx, msg.Content)
+	if err != nil {
+		logger.Warn("failed to release file of purged message", slog.Any("error", err))
+		return
+	}
+
+	if deleted {
+		if err := p.usage.ReleaseFileUsage(ctx, msg.Content); err != nil {
+			logger.Warn("failed to free storage usage of purged file", slog.Any("error", err))
+		}
+	}
+}
+
+// releaseFile drops the reference of the message to the file, the file
+// is deleted when no other message references it.
+//
+// Returns whether the file was deleted.
+func (p *purger) releaseFile(ctx context.Context, fname string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, p.fileServer+"/"+url.PathEscape(fname), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.adminToken)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return res.Header.Get("File-Deleted") == "true", nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+}
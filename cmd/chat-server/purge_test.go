@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/store"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type fakePurgeStore struct {
+	chats []*internal.Chat
+	msgs  []*internal.Message
+}
+
+func (s *fakePurgeStore) GetChats() ([]*internal.Chat, error) {
+	return s.chats, nil
+}
+
+func (s *fakePurgeStore) PurgeExpiredMessage(chatId string, before time.Time) (*internal.Message, error) {
+	for i, msg := range s.msgs {
+		if msg.ChatId.Hex() == chatId && msg.CreatedAt.Before(before) {
+			s.msgs = slices.Delete(s.msgs, i, i+1)
+			return msg, nil
+		}
+	}
+	return nil, store.ErrNoRecord
+}
+
+type fakeFileUsage struct {
+	released []string
+}
+
+func (u *fakeFileUsage) ReleaseFileUsage(ctx context.Context, fname string) error {
+	u.released = append(u.released, fname)
+	return nil
+}
+
+func chatMessage(chatId string, typ internal.MessageType, content string, createdAt time.Time) *internal.Message {
+	msg := internal.New(chatId, bson.NewObjectID().Hex(), content, typ)
+	msg.Id = bson.NewObjectID()
+	msg.CreatedAt = createdAt
+	return msg
+}
+
+func TestPurger_Purge(t *testing.T) {
+	now := time.Now()
+	ephemeral := &internal.Chat{Id: bson.NewObjectID().Hex(), MessageTTL: time.Hour}
+	permanent := &internal.Chat{Id: bson.NewObjectID().Hex()}
+
+	expired := chatMessage(ephemeral.Id, internal.TextMessage, "old", now.Add(-2*time.Hour))
+	expiredFile := chatMessage(ephemeral.Id, internal.FileMessage, "abc.txt", now.Add(-90*time.Minute))
+	sharedFile := chatMessage(ephemeral.Id, internal.ImageMessage, "shared.png", now.Add(-80*time.Minute))
+	recent := chatMessage(ephemeral.Id, internal.TextMessage, "new", now.Add(-time.Minute))
+	kept := chatMessage(permanent.Id, internal.TextMessage, "kept", now.Add(-48*time.Hour))
+
+	st := &fakePurgeStore{
+		chats: []*internal.Chat{ephemeral, permanent},
+		msgs:  []*internal.Message{expired, expiredFile, sharedFile, recent, kept},
+	}
+
+	var released []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		released = append(released, r.URL.Path)
+		// shared.png is still referenced by another message.
+		if r.URL.Path != "/shared.png" {
+			w.Header().Set("File-Deleted", "true")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	usage := &fakeFileUsage{}
+	var events []internal.ChatEvent
+	p := &purger{
+		client:     srv.Client(),
+		fileServer: srv.URL,
+		adminToken: "secret",
+		store:      st,
+		usage:      usage,
+		publish: func(event internal.ChatEvent) error {
+			events = append(events, event)
+			return nil
+		},
+		logger: slog.New(slog.DiscardHandler),
+	}
+
+	p.purge(now)
+
+	if len(st.msgs) != 2 || st.msgs[0] != recent || st.msgs[1] != kept {
+		t.Errorf("messages left after purge: %v", st.msgs)
+	}
+	if !slices.Equal(released, []string{"/abc.txt", "/shared.png"}) {
+		t.Errorf("released files %v expected [/abc.txt /shared.png]", released)
+	}
+	if !slices.Equal(usage.released, []string{"abc.txt"}) {
+		t.Errorf("freed usage of %v expected [abc.txt]", usage.released)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("published %d events expected 3", len(events))
+	}
+	for _, event := range events {
+		msg := event.Details.(*internal.Message)
+		if event.Type != internal.Event_DeleteMessage || event.ChatId != ephemeral.Id || !msg.Deleted {
+			t.Errorf("unexpected event %+v", event)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+)
+
+var errFileNotFound = errors.New("file not found")
+
+type scanStore interface {
+	GetMessagesWithStatus(status internal.MessageStatus) ([]*internal.Message, error)
+	SetMessageStatus(id string, status internal.MessageStatus) (*internal.Message, error)
+}
+
+// scanWatcher waits for results of malware scans of files attached
+// to messages and broadcasts the messages with the final status.
+type scanWatcher struct {
+	client     *http.Client
+	fileServer string
+	adminToken string
+	interval   time.Duration
+
+	store   scanStore
+	publish func(event internal.ChatEvent) error
+	logger  *slog.Logger
+}
+
+func newScanWatcher(cfg config.FileServer, store scanStore, publish func(event internal.ChatEvent) error) *scanWatcher {
+	return &scanWatcher{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		fileServer: cfg.URL,
+		adminToken: cfg.AdminToken,
+		interval:   time.Duration(max(cfg.ScanPollMs, 100)) * time.Millisecond,
+		store:      store,
+		publish:    publish,
+		logger:     log.DefaultContextLogger,
+	}
+}
+
+// resume watches messages left scanning before the restart.
+func (s *scanWatcher) resume() error {
+	msgs, err := s.store.GetMessagesWithStatus(internal.Scanning)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		s.watch(msg)
+	}
+	return nil
+}
+
+func (s *scanWatcher) watch(msg *internal.Message) {
+	if s == nil || msg.Status != internal.Scanning {
+		return
+	}
+	go s.wait(msg.Id.Hex(), msg.Content)
+}
+
+// wait polls the file server until the scan of the file is finished.
+func (s *scanWatcher) wait(messageId string, fname string) {
+	logger := s.logger.With(slog.String("message_id", messageId), slog.String("file", fname))
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := s.scanStatus(context.Background(), fname)
+		status := internal.Error
+		switch {
+		case errors.Is(err, errFileNotFound):
+			logger.Warn("scanned file is missing")
+		case err != nil:
+			logger.Debug("failed to get scan status", slog.Any("error", err))
+			continue
+		case result == "clean":
+			status = internal.Sent
+		case result == "infected":
+			status = internal.Infected
+		case result == "failed":
+			status = internal.ScanFailed
+		default:
+			continue
+		}
+
+		s.finish(logger, messageId, status)
+		return
+	}
+}
+
+func (s *scanWatcher) finish(logger *slog.Logger, messageId string, status internal.MessageStatus) {
+	msg, err := s.store.SetMessageStatus(messageId, status)
+	if err != nil {
+		logger.Error("failed to save scan status", slog.Any("error", err))
+		return
+	}
+
+	event := internal.ChatEvent{
+		Type:    internal.Event_UpdateMessage,
+		ChatId:  msg.ChatId.Hex(),
+		UserId:  msg.AuthorId,
+		Details: msg,
+	}
+
+	if err := s.publish(event); err != nil {
+		logger.Error("failed to broadcast scan status", slog.Any("error", err))
+	}
+}
+
+func (s *scanWatcher) scanStatus(ctx context.Context, fname string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.fileServer+"/scan/"+url.PathEscape(fname), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.adminToken)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errFileNotFound
+	default:
+		return "", fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	var result struct {
+		Scan string `json:"scan"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Scan, nil
+}
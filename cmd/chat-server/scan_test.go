@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type fakeScanStore struct {
+	statuses chan internal.MessageStatus
+}
+
+func (s *fakeScanStore) GetMessagesWithStatus(status internal.MessageStatus) ([]*internal.Message, error) {
+	return nil, nil
+}
+
+func (s *fakeScanStore) SetMessageStatus(id string, status internal.MessageStatus) (*internal.Message, error) {
+	s.statuses <- status
+	msgId, _ := bson.ObjectIDFromHex(id)
+	return &internal.Message{Id: msgId, Status: status}, nil
+}
+
+func TestScanWatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   string
+		code     int
+		expected internal.MessageStatus
+	}{
+		{"clean", "clean", http.StatusOK, internal.Sent},
+		{"infected", "infected", http.StatusOK, internal.Infected},
+		{"failed", "failed", http.StatusOK, internal.ScanFailed},
+		{"missing", "", http.StatusNotFound, internal.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/scan/abc.txt" || r.Header.Get("Authorization") != "Bearer secret" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				// the first poll finds the scan unfinished
+				if polls.Add(1) == 1 {
+					w.Write([]byte(`{"scan":"pending"}`))
+					return
+				}
+				w.WriteHeader(tt.code)
+				w.Write([]byte(`{"scan":"` + tt.result + `"}`))
+			}))
+			defer srv.Close()
+
+			store := &fakeScanStore{statuses: make(chan internal.MessageStatus, 1)}
+			published := make(chan internal.ChatEvent, 1)
+			s := &scanWatcher{
+				client:     srv.Client(),
+				fileServer: srv.URL,
+				adminToken: "secret",
+				interval:   10 * time.Millisecond,
+				store:      store,
+				publish: func(event internal.ChatEvent) error {
+					published <- event
+					return nil
+				},
+				logger: slog.New(slog.DiscardHandler),
+			}
+
+			msg := internal.New(bson.NewObjectID().Hex(), "author", "abc.txt", internal.FileMessage)
+			msg.Id = bson.NewObjectID()
+			msg.Status = internal.Scanning
+			s.watch(msg)
+
+			select {
+			case status := <-store.statuses:
+				if status != tt.expected {
+					t.Errorf("message status set to %q expected %q", status, tt.expected)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("message status is not set")
+			}
+
+			select {
+			case event := <-published:
+				if event.Type != internal.Event_UpdateMessage {
+					t.Errorf("published event %v expected update", event.Type)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("message update is not published")
+			}
+
+			if polls.Load() < 2 {
+				t.Error("status set before the scan finished")
+			}
+		})
+	}
+}
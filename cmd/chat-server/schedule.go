@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+	"github.com/ellezio/Chat-app-with-Go/internal/store"
+)
+
+// claimTimeout is the time after which messages claimed by a scheduler
+// which didn't post them are claimed again.
+const claimTimeout = time.Minute
+
+type scheduleStore interface {
+	ClaimDueScheduledMessage(now time.Time, staleBefore time.Time) (*internal.Message, error)
+	DeleteScheduledMessage(id string) error
+}
+
+// scheduler posts scheduled messages at their time. Messages are kept in
+// the store, so they are posted after restarts as well.
+type scheduler struct {
+	interval time.Duration
+
+	store scheduleStore
+	// enqueue publishes the event to the chat servers, the same way
+	// the webapp does
+	enqueue func(event internal.ChatEvent) error
+	logger  *slog.Logger
+}
+
+func newScheduler(pollMs int, store scheduleStore, enqueue func(event internal.ChatEvent) error) *scheduler {
+	return &scheduler{
+		interval: time.Duration(max(pollMs, 100)) * time.Millisecond,
+		store:    store,
+		enqueue:  enqueue,
+		logger:   log.DefaultContextLogger,
+	}
+}
+
+func (s *scheduler) start() {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			s.postDue(now)
+		}
+	}()
+}
+
+// postDue publishes all messages due at the time as new messages.
+func (s *scheduler) postDue(now time.Time) {
+	for {
+		msg, err := s.store.ClaimDueScheduledMessage(now, now.Add(-claimTimeout))
+		if errors.Is(err, store.ErrNoRecord) {
+			return
+		} else if err != nil {
+			s.logger.Error("failed to claim scheduled message", slog.Any("error", err))
+			return
+		}
+
+		logger := s.logger.With(slog.String("message_id", msg.Id.Hex()))
+		event := internal.ChatEvent{
+			Type:   internal.Event_NewMessage,
+			ChatId: msg.ChatId.Hex(),
+			UserId: msg.AuthorId,
+			Details: internal.MessageEventDetails{
+				Content: msg.Content,
+				Type:    msg.Type,
+			},
+		}
+
+		// the claim expires, so the message is posted on a later try
+		if err := s.enqueue(event); err != nil {
+			logger.Error("failed to post scheduled message", slog.Any("error", err))
+			return
+		}
+
+		if err := s.store.DeleteScheduledMessage(msg.Id.Hex()); err != nil {
+			logger.Error("failed to delete posted scheduled message", slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/store"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type fakeScheduleStore struct {
+	msgs    []*internal.Message
+	claims  map[bson.ObjectID]time.Time
+	deleted []bson.ObjectID
+}
+
+func (s *fakeScheduleStore) ClaimDueScheduledMessage(now time.Time, staleBefore time.Time) (*internal.Message, error) {
+	for _, msg := range s.msgs {
+		claimedAt, claimed := s.claims[msg.Id]
+		if msg.ScheduledAt.After(now) || (claimed && !claimedAt.Before(staleBefore)) {
+			continue
+		}
+		s.claims[msg.Id] = now
+		return msg, nil
+	}
+	return nil, store.ErrNoRecord
+}
+
+func (s *fakeScheduleStore) DeleteScheduledMessage(id string) error {
+	msgId, _ := bson.ObjectIDFromHex(id)
+	s.deleted = append(s.deleted, msgId)
+	s.msgs = slices.DeleteFunc(s.msgs, func(m *internal.Message) bool { return m.Id == msgId })
+	return nil
+}
+
+func scheduledMessage(content string, at time.Time) *internal.Message {
+	msg := internal.New(bson.NewObjectID().Hex(), bson.NewObjectID().Hex(), content, internal.TextMessage)
+	msg.Id = bson.NewObjectID()
+	msg.ScheduledAt = at
+	return msg
+}
+
+func TestScheduler_PostDue(t *testing.T) {
+	now := time.Now()
+	due := scheduledMessage("due", now.Add(-time.Second))
+	later := scheduledMessage("later", now.Add(time.Hour))
+	st := &fakeScheduleStore{msgs: []*internal.Message{due, later}, claims: make(map[bson.ObjectID]time.Time)}
+
+	var events []internal.ChatEvent
+	s := &scheduler{
+		store: st,
+		enqueue: func(event internal.ChatEvent) error {
+			events = append(events, event)
+			return nil
+		},
+		logger: slog.New(slog.DiscardHandler),
+	}
+
+	s.postDue(now)
+
+	if len(events) != 1 {
+		t.Fatalf("posted %d messages expected 1", len(events))
+	}
+	evt := events[0]
+	details, _ := evt.Details.(internal.MessageEventDetails)
+	if evt.Type != internal.Event_NewMessage || evt.ChatId != due.ChatId.Hex() || evt.UserId != due.AuthorId || details.Content != "due" {
+		t.Errorf("unexpected event %+v", evt)
+	}
+	if !slices.Equal(st.deleted, []bson.ObjectID{due.Id}) {
+		t.Errorf("deleted %v expected only the posted message", st.deleted)
+	}
+}
+
+func TestScheduler_RetriesFailedPost(t *testing.T) {
+	now := time.Now()
+	msg := scheduledMessage("due", now.Add(-time.Second))
+	st := &fakeScheduleStore{msgs: []*internal.Message{msg}, claims: make(map[bson.ObjectID]time.Time)}
+
+	fail := true
+	posted := 0
+	s := &scheduler{
+		store: st,
+		enqueue: func(event internal.ChatEvent) error {
+			if fail {
+				return errors.New("broker unavailable")
+			}
+			posted++
+			return nil
+		},
+		logger: slog.New(slog.DiscardHandler),
+	}
+
+	s.postDue(now)
+	if len(st.deleted) != 0 {
+		t.Fatal("message deleted without being posted")
+	}
+
+	// the claim is still valid
+	fail = false
+	s.postDue(now.Add(time.Second))
+	if posted != 0 {
+		t.Fatal("claimed message posted again before the claim expired")
+	}
+
+	s.postDue(now.Add(claimTimeout + time.Second))
+	if posted != 1 || len(st.deleted) != 1 {
+		t.Errorf("message posted %d times and deleted %d times after the claim expired", posted, len(st.deleted))
+	}
+}
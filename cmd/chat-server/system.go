@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/rabbitmq"
+)
+
+// systemMessage returns the chat and the content of the system message
+// recorded in the timeline after the event, empty content for events
+// which aren't recorded. The member is the user whose role was set, who was
+// muted or banned, events changing members without one aren't recorded.
+func systemMessage(event internal.ChatEvent, member *internal.User) (chatId string, content string) {
+	if event.UserId == "" {
+		return "", ""
+	}
+
+	switch event.Type {
+	case internal.Event_NewChat:
+		if cht, ok := event.Details.(*internal.Chat); ok {
+			return cht.Id, fmt.Sprintf("created the chat %q", cht.Name)
+		}
+	case internal.Event_RenameChat:
+		if cht, ok := event.Details.(*internal.Chat); ok {
+			return cht.Id, fmt.Sprintf("renamed the chat to %q", cht.Name)
+		}
+	case internal.Event_DescribeChat:
+		if cht, ok := event.Details.(*internal.Chat); ok {
+			return cht.Id, "changed the chat description"
+		}
+	case internal.Event_ArchiveChat:
+		if cht, ok := event.Details.(*internal.Chat); ok && cht.Archived {
+			return cht.Id, "archived the chat"
+		} else if ok {
+			return cht.Id, "unarchived the chat"
+		}
+	}
+
+	cht, ok := event.Details.(*internal.Chat)
+	if !ok || member == nil {
+		return "", ""
+	}
+	memberId := member.Id.Hex()
+
+	switch event.Type {
+	case internal.Event_SetRole:
+		switch cht.Role(memberId) {
+		case internal.RoleModerator:
+			return cht.Id, fmt.Sprintf("made %s a moderator", member.Name)
+		case internal.RoleMember:
+			return cht.Id, fmt.Sprintf("made %s a member", member.Name)
+		case internal.RoleReadOnly:
+			return cht.Id, fmt.Sprintf("made %s read-only", member.Name)
+		}
+	case internal.Event_MuteUser:
+		// the time is the same for everyone reading the timeline
+		if until, muted := cht.Mutes[memberId]; muted {
+			return cht.Id, fmt.Sprintf("muted %s until %s", member.Name, until.UTC().Format("2006-01-02 15:04 UTC"))
+		}
+		return cht.Id, fmt.Sprintf("unmuted %s", member.Name)
+	case internal.Event_BanUser:
+		if cht.Banned(memberId) {
+			return cht.Id, fmt.Sprintf("banned %s", member.Name)
+		}
+		return cht.Id, fmt.Sprintf("unbanned %s", member.Name)
+	}
+
+	return "", ""
+}
+
+// eventMember returns the user whose role is set, who is muted or banned by
+// the event, nil for other events.
+func (h *handler) eventMember(event internal.ChatEvent) *internal.User {
+	details, ok := event.Details.(internal.ChatEventDetails)
+	if !ok || details.MemberId == "" {
+		return nil
+	}
+
+	member, err := h.store.GetUserById(details.MemberId)
+	if err != nil {
+		return nil
+	}
+	return member
+}
+
+func (h *handler) postSystemMessage(pub *rabbitmq.Publisher, chatId string, userId string, content string) error {
+	msg := internal.New(chatId, userId, content, internal.SystemMessage)
+	msg.Status = internal.Sent
+	if err := h.store.SaveMessage(msg); err != nil {
+		return fmt.Errorf("saving system message: %w", err)
+	}
+
+	return notify(pub, internal.ChatEvent{
+		Type:    internal.Event_NewMessage,
+		ChatId:  chatId,
+		UserId:  userId,
+		Details: msg,
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestSystemMessage(t *testing.T) {
+	cht := internal.NewChat("general", nil)
+	alice := &internal.User{Id: bson.NewObjectID(), Name: "alice"}
+	until := time.Date(2025, 3, 1, 14, 30, 0, 0, time.FixedZone("CET", 3600))
+
+	// chat after the change of alice
+	changed := func(change func(cht *internal.Chat)) *internal.Chat {
+		cht := &internal.Chat{Id: cht.Id}
+		change(cht)
+		return cht
+	}
+
+	tests := []struct {
+		name    string
+		event   internal.ChatEvent
+		member  *internal.User
+		content string
+	}{
+		{
+			"new chat",
+			internal.ChatEvent{Type: internal.Event_NewChat, UserId: "user", Details: cht},
+			nil,
+			`created the chat "general"`,
+		},
+		{
+			"new chat without creator",
+			internal.ChatEvent{Type: internal.Event_NewChat, Details: cht},
+			nil,
+			"",
+		},
+		{
+			"rename",
+			internal.ChatEvent{Type: internal.Event_RenameChat, UserId: "user", Details: cht},
+			nil,
+			`renamed the chat to "general"`,
+		},
+		{
+			"archive",
+			internal.ChatEvent{Type: internal.Event_ArchiveChat, UserId: "user", Details: &internal.Chat{Id: cht.Id, Archived: true}},
+			nil,
+			"archived the chat",
+		},
+		{
+			"delete",
+			internal.ChatEvent{Type: internal.Event_DeleteChat, UserId: "user", Details: cht},
+			nil,
+			"",
+		},
+		{
+			"new message",
+			internal.ChatEvent{Type: internal.Event_NewMessage, UserId: "user", Details: internal.MessageEventDetails{}},
+			nil,
+			"",
+		},
+		{
+			"moderator role",
+			internal.ChatEvent{Type: internal.Event_SetRole, UserId: "user", Details: changed(func(cht *internal.Chat) {
+				cht.Members = map[string]internal.Role{alice.Id.Hex(): internal.RoleModerator}
+			})},
+			alice,
+			"made alice a moderator",
+		},
+		{
+			"member role",
+			internal.ChatEvent{Type: internal.Event_SetRole, UserId: "user", Details: changed(func(cht *internal.Chat) {})},
+			alice,
+			"made alice a member",
+		},
+		{
+			"read-only role",
+			internal.ChatEvent{Type: internal.Event_SetRole, UserId: "user", Details: changed(func(cht *internal.Chat) {
+				cht.Members = map[string]internal.Role{alice.Id.Hex(): internal.RoleReadOnly}
+			})},
+			alice,
+			"made alice read-only",
+		},
+		{
+			"role of unknown user",
+			internal.ChatEvent{Type: internal.Event_SetRole, UserId: "user", Details: cht},
+			nil,
+			"",
+		},
+		{
+			"mute",
+			internal.ChatEvent{Type: internal.Event_MuteUser, UserId: "user", Details: changed(func(cht *internal.Chat) {
+				cht.Mutes = map[string]time.Time{alice.Id.Hex(): until}
+			})},
+			alice,
+			"muted alice until 2025-03-01 13:30 UTC",
+		},
+		{
+			"unmute",
+			internal.ChatEvent{Type: internal.Event_MuteUser, UserId: "user", Details: changed(func(cht *internal.Chat) {})},
+			alice,
+			"unmuted alice",
+		},
+		{
+			"ban",
+			internal.ChatEvent{Type: internal.Event_BanUser, UserId: "user", Details: changed(func(cht *internal.Chat) {
+				cht.Bans = map[string]bool{alice.Id.Hex(): true}
+			})},
+			alice,
+			"banned alice",
+		},
+		{
+			"unban",
+			internal.ChatEvent{Type: internal.Event_BanUser, UserId: "user", Details: changed(func(cht *internal.Chat) {})},
+			alice,
+			"unbanned alice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chatId, content := systemMessage(tt.event, tt.member)
+			if content != tt.content {
+				t.Errorf("got content %q expected %q", content, tt.content)
+			}
+			if content != "" && chatId != cht.Id {
+				t.Errorf("got chat %q expected %q", chatId, cht.Id)
+			}
+		})
+	}
+}
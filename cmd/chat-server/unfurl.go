@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+	"golang.org/x/net/html"
+)
+
+const maxPreviewsPerMessage = 3
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+var errBlockedAddress = errors.New("address is not allowed")
+
+// blockedPrefixes are ranges which are not covered by netip.Addr helpers
+// but still must not be reachable from the unfurler.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// isPublicAddr reports whether addr is a globally routable unicast address.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type unfurlJob struct {
+	messageId string
+	urls      []string
+	// replace existing previews even when none were found
+	replace bool
+}
+
+// unfurler fetches link previews of messages in background workers
+// and broadcasts updated messages.
+type unfurler struct {
+	client   *http.Client
+	maxBytes int64
+	workers  int
+	jobs     chan unfurlJob
+
+	store   internal.Store
+	publish func(event internal.ChatEvent) error
+	logger  *slog.Logger
+}
+
+func newUnfurler(cfg config.Unfurl, store internal.Store, publish func(event internal.ChatEvent) error) *unfurler {
+	u := &unfurler{
+		maxBytes: cfg.MaxBytes,
+		workers:  cfg.Workers,
+		jobs:     make(chan unfurlJob, 100),
+		store:    store,
+		publish:  publish,
+		logger:   log.DefaultContextLogger,
+	}
+
+	u.client = newUnfurlClient(time.Duration(cfg.TimeoutMs)*time.Millisecond, func(addr netip.AddrPort) bool {
+		return isPublicAddr(addr.Addr())
+	})
+	return u
+}
+
+// newUnfurlClient creates a client which refuses to connect to addresses
+// rejected by allow. The check runs after name resolution so DNS records
+// pointing at internal hosts are blocked as well.
+func newUnfurlClient(timeout time.Duration, allow func(netip.AddrPort) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !allow(addrPort) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, addrPort.Addr())
+			}
+
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		// proxy is not used as it would bypass the address check
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("unsupported redirect scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// extractURLs returns unique http(s) URLs found in content.
+func extractURLs(content string) []string {
+	var urls []string
+	for _, u := range urlRegexp.FindAllString(content, -1) {
+		u = strings.TrimRight(u, ".,;:!?)]}")
+		if !slices.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+
+		if len(urls) == maxPreviewsPerMessage {
+			break
+		}
+	}
+
+	return urls
+}
+
+func (u *unfurler) start() {
+	for range u.workers {
+		go func() {
+			for job := range u.jobs {
+				u.process(job)
+			}
+		}()
+	}
+}
+
+// enqueue schedules unfurling of links in the message. When the queue
+// is full the message is skipped rather than blocking the handler.
+func (u *unfurler) enqueue(msg *internal.Message, replace bool) {
+	if u == nil || u.workers <= 0 || msg.Type != internal.TextMessage {
+		return
+	}
+
+	urls := extractURLs(msg.Content)
+	if len(urls) == 0 && !replace {
+		return
+	}
+
+	select {
+	case u.jobs <- unfurlJob{messageId: msg.Id.Hex(), urls: urls, replace: replace}:
+	default:
+		u.logger.Warn("unfurl queue is full, skipping message", slog.String("message_id", msg.Id.Hex()))
+	}
+}
+
+func (u *unfurler) process(job unfurlJob) {
+	logger := u.logger.With(slog.String("message_id", job.messageId))
+
+	previews := make([]internal.LinkPreview, 0, len(job.urls))
+	for _, link := range job.urls {
+		preview, err := u.fetch(context.Background(), link)
+		if err != nil {
+			logger.Debug("failed to unfurl link", slog.String("url", link), slog.Any("error", err))
+			continue
+		}
+		previews = append(previews, *preview)
+	}
+
+	if len(previews) == 0 && !job.replace {
+		return
+	}
+
+	msg, err := u.store.SetMessagePreviews(job.messageId, previews)
+	if err != nil {
+		logger.Error("failed to save link previews", slog.Any("error", err))
+		return
+	}
+
+	event := internal.ChatEvent{
+		Type:    internal.Event_UpdateMessage,
+		ChatId:  msg.ChatId.Hex(),
+		UserId:  msg.AuthorId,
+		Details: msg,
+	}
+
+	if err := u.publish(event); err != nil {
+		logger.Error("failed to broadcast link previews", slog.Any("error", err))
+	}
+}
+
+// fetch downloads at most maxBytes of the page and reads its title
+// and OpenGraph metadata.
+func (u *unfurler) fetch(ctx context.Context, link string) (*internal.LinkPreview, error) {
+	pageURL, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	if pageURL.Scheme != "http" && pageURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", pageURL.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "ChatAppUnfurler/1.0")
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	mediatype, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediatype != "text/html" && mediatype != "application/xhtml+xml" {
+		return nil, fmt.Errorf("unsupported content type %q", mediatype)
+	}
+
+	preview := parsePreview(io.LimitReader(res.Body, u.maxBytes), res.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return nil, errors.New("page has no metadata")
+	}
+
+	preview.URL = link
+	return preview, nil
+}
+
+// parsePreview reads metadata from the document head. Parsing stops at
+// the body as metadata outside of the head is ignored.
+func parsePreview(r io.Reader, base *url.URL) *internal.LinkPreview {
+	var preview internal.LinkPreview
+	var title, description string
+
+	z := html.NewTokenizer(r)
+	inTitle := false
+
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tn, hasAttr := z.TagName()
+			switch string(tn) {
+			case "body":
+				break loop
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta":
+				if !hasAttr {
+					continue
+				}
+
+				var key, content string
+				for {
+					k, v, more := z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						key = strings.ToLower(string(v))
+					case "content":
+						content = strings.TrimSpace(string(v))
+					}
+					if !more {
+						break
+					}
+				}
+
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "og:site_name":
+					preview.SiteName = content
+				case "description":
+					description = content
+				}
+			}
+		case html.EndTagToken:
+			tn, _ := z.TagName()
+			switch string(tn) {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		}
+	}
+
+	if preview.Title == "" {
+		preview.Title = title
+	}
+	if preview.Description == "" {
+		preview.Description = description
+	}
+	if preview.SiteName == "" && base != nil {
+		preview.SiteName = base.Hostname()
+	}
+
+	return &preview
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>Plain title</title>
+	<meta property="og:title" content="OpenGraph title">
+	<meta property="og:description" content="Page description">
+	<meta property="og:image" content="/img/cover.png">
+	<meta property="og:site_name" content="Example">
+</head>
+<body><meta property="og:title" content="ignored"></body>
+</html>`
+
+func newTestUnfurler(allow func(netip.AddrPort) bool) *unfurler {
+	return &unfurler{
+		client:   newUnfurlClient(time.Second, allow),
+		maxBytes: 1 << 16,
+	}
+}
+
+func allowAll(netip.AddrPort) bool { return true }
+
+func TestUnfurler_Fetch(t *testing.T) {
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(testPage))
+	}))
+	defer srv.Close()
+
+	u := newTestUnfurler(allowAll)
+	preview, err := u.fetch(context.Background(), srv.URL+"/article")
+	if err != nil {
+		t.Fatal("fetch failed:", err)
+	}
+
+	if preview.Title != "OpenGraph title" {
+		t.Errorf("title is %q expected %q", preview.Title, "OpenGraph title")
+	}
+	if preview.Description != "Page description" {
+		t.Errorf("description is %q expected %q", preview.Description, "Page description")
+	}
+	if preview.SiteName != "Example" {
+		t.Errorf("site name is %q expected %q", preview.SiteName, "Example")
+	}
+	if preview.URL != srv.URL+"/article" {
+		t.Errorf("url is %q expected %q", preview.URL, srv.URL+"/article")
+	}
+
+	// the og:image is neither fetched nor kept in the preview
+	b, err := json.Marshal(preview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "cover.png") {
+		t.Errorf("preview %s refers to the image", b)
+	}
+	if len(requested) != 1 {
+		t.Errorf("requested %v expected only the page", requested)
+	}
+}
+
+func TestUnfurler_FetchFallsBackToTitle(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title> Only title </title><meta name="description" content="desc"></head></html>`))
+	}))
+	defer srv.Close()
+
+	preview, err := newTestUnfurler(allowAll).fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal("fetch failed:", err)
+	}
+
+	if preview.Title != "Only title" || preview.Description != "desc" {
+		t.Errorf("got title %q and description %q", preview.Title, preview.Description)
+	}
+}
+
+func TestUnfurler_BlocksPrivateAddresses(t *testing.T) {
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer srv.Close()
+
+	u := newTestUnfurler(func(addr netip.AddrPort) bool { return isPublicAddr(addr.Addr()) })
+	_, err := u.fetch(context.Background(), srv.URL)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("expected blocked address error, got %v", err)
+	}
+
+	if requested {
+		t.Error("request reached loopback server")
+	}
+}
+
+func TestUnfurler_BlocksRedirectToPrivateAddress(t *testing.T) {
+	internalSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("redirect reached internal server")
+	}))
+	defer internalSrv.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internalSrv.URL, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	// both servers listen on loopback, so only the first one is treated as public
+	public := netip.MustParseAddrPort(strings.TrimPrefix(srv.URL, "http://"))
+	u := newTestUnfurler(func(addr netip.AddrPort) bool { return addr == public })
+
+	_, err := u.fetch(context.Background(), srv.URL)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("expected blocked address error, got %v", err)
+	}
+}
+
+func TestUnfurler_SizeLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><!--" + strings.Repeat("x", 1<<17) + "--><title>Too far</title></head></html>"))
+	}))
+	defer srv.Close()
+
+	_, err := newTestUnfurler(allowAll).fetch(context.Background(), srv.URL)
+	if err == nil {
+		t.Error("expected metadata past the size limit to be ignored")
+	}
+}
+
+func TestUnfurler_Timeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	u := newTestUnfurler(allowAll)
+	u.client = newUnfurlClient(100*time.Millisecond, allowAll)
+
+	start := time.Now()
+	if _, err := u.fetch(context.Background(), srv.URL); err == nil {
+		t.Error("expected fetch to time out")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fetch took %s despite timeout", elapsed)
+	}
+}
+
+func TestUnfurler_RejectsNonHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(testPage))
+	}))
+	defer srv.Close()
+
+	if _, err := newTestUnfurler(allowAll).fetch(context.Background(), srv.URL); err == nil {
+		t.Error("expected non html content to be rejected")
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::":    true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"::1":                  false,
+		"fd00::1":              false,
+		"fe80::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:93.184.216.34": true,
+		"64:ff9b::7f00:1":      false,
+		"224.0.0.1":            false,
+	}
+
+	for addr, expected := range cases {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != expected {
+			t.Errorf("isPublicAddr(%s) = %v expected %v", addr, got, expected)
+		}
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	urls := extractURLs("see https://example.com/a, and (http://example.org/b). again https://example.com/a https://c.io https://d.io")
+	expected := []string{"https://example.com/a", "http://example.org/b", "https://c.io"}
+
+	if strings.Join(urls, " ") != strings.Join(expected, " ") {
+		t.Errorf("extracted %v expected %v", urls, expected)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// storedFile describes a file in the file server listing.
+type storedFile struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Refs       int       `json:"refs"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// findOrphans returns files not referenced by any message and not used
+// within the grace period, which protects files uploaded for messages
+// that are not saved yet.
+func findOrphans(files []storedFile, referenced map[string]bool, now time.Time, grace time.Duration) []storedFile {
+	var orphans []storedFile
+	for _, f := range files {
+		if referenced[f.Name] || now.Sub(f.LastUsedAt) < grace {
+			continue
+		}
+		orphans = append(orphans, f)
+	}
+
+	slices.SortFunc(orphans, func(a, b storedFile) int { return strings.Compare(a.Name, b.Name) })
+	return orphans
+}
+
+// fileServer calls administrative endpoints of the file server.
+type fileServer struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func (fs *fileServer) request(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, fs.addr+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+fs.token)
+
+	res, err := fs.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	return res, nil
+}
+
+func (fs *fileServer) listFiles(ctx context.Context) ([]storedFile, error) {
+	res, err := fs.request(ctx, "GET", "/admin/files")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected status %d with body %s", res.StatusCode, body)
+	}
+
+	var files []storedFile
+	if err := json.NewDecoder(res.Body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+	return files, nil
+}
+
+// deleteFile removes the file with its variants regardless of references.
+func (fs *fileServer) deleteFile(ctx context.Context, name string) error {
+	res, err := fs.request(ctx, "DELETE", "/"+url.PathEscape(name)+"?force=true")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status %d with body %s", res.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindOrphans(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	grace := 24 * time.Hour
+
+	files := []storedFile{
+		{Name: "referenced.png", LastUsedAt: now.Add(-48 * time.Hour)},
+		{Name: "orphan.png", LastUsedAt: now.Add(-48 * time.Hour)},
+		{Name: "recent.png", LastUsedAt: now.Add(-time.Hour)},
+		{Name: "a-orphan.pdf", Refs: 3, LastUsedAt: now.Add(-25 * time.Hour)},
+	}
+	referenced := map[string]bool{"referenced.png": true, "deleted.png": true}
+
+	orphans := findOrphans(files, referenced, now, grace)
+
+	if len(orphans) != 2 || orphans[0].Name != "a-orphan.pdf" || orphans[1].Name != "orphan.png" {
+		t.Errorf("expected unreferenced files past grace period, got %+v", orphans)
+	}
+}
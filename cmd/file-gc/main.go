@@ -0,0 +1,124 @@
+// Command file-gc deletes stored files no longer referenced by messages,
+// like files of deleted messages or uploads whose message failed to save.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
+	"github.com/ellezio/Chat-app-with-Go/internal/store"
+)
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo})).
+		With("service", "file-gc")
+
+	addr := flag.String("file-server", "http://localhost:3001", "address of the file server")
+	token := flag.String("admin-token", os.Getenv("FILE_ADMIN_TOKEN"), "admin token of the file server, defaults to the FILE_ADMIN_TOKEN environment variable")
+	grace := flag.Duration("grace", 24*time.Hour, "minimum time since a file was stored or referenced before it's deleted")
+	dryRun := flag.Bool("dry-run", false, "only report files which would be deleted")
+	flag.Parse()
+
+	if *token == "" {
+		logger.Error("the -admin-token flag is required")
+		os.Exit(2)
+	}
+
+	b, err := os.ReadFile("config.json")
+	if err != nil {
+		logger.Error("failed to read config file", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	var cfg config.Configuration
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		logger.Error("failed to load config", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	// the cache is not used by queries of the collector
+	sto := store.NewMongodbStore(cfg.MongoDB, nil)
+	if err := sto.Connect(); err != nil {
+		logger.Error("failed to establish store connection", slog.Any("error", err))
+		os.Exit(1)
+	}
+	defer sto.Disconnect()
+
+	usage := store.NewRedisStore(cfg.Redis)
+
+	ctx := context.Background()
+	fsrv := &fileServer{
+		addr:   strings.TrimSuffix(*addr, "/"),
+		token:  *token,
+		client: &http.Client{Timeout: time.Minute},
+	}
+
+	// files are listed before reading references, so a file uploaded
+	// in between is not listed
+	files, err := fsrv.listFiles(ctx)
+	if err != nil {
+		logger.Error("failed to list files", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	referenced, err := sto.GetReferencedFiles()
+	if err != nil {
+		logger.Error("failed to get referenced files", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	orphans := findOrphans(files, referenced, now, *grace)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSIZE\tLAST USED\tSTATUS")
+
+	var deleted, failed int
+	var freed int64
+	for _, f := range orphans {
+		status := "orphaned"
+		if !*dryRun {
+			if err := fsrv.deleteFile(ctx, f.Name); err != nil {
+				logger.Error("failed to delete file", slog.String("file", f.Name), slog.Any("error", err))
+				status = "failed"
+				failed++
+			} else {
+				status = "deleted"
+				deleted++
+				freed += f.Size
+
+				if err := usage.ReleaseFileUsage(ctx, f.Name); err != nil {
+					logger.Warn("failed to free storage usage of file", slog.String("file", f.Name), slog.Any("error", err))
+				}
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", f.Name, f.Size, now.Sub(f.LastUsedAt).Round(time.Second), status)
+	}
+	tw.Flush()
+
+	var orphanedSize int64
+	for _, f := range orphans {
+		orphanedSize += f.Size
+	}
+
+	fmt.Printf("\n%d files stored, %d referenced, %d orphaned (%d bytes)", len(files), len(files)-len(orphans), len(orphans), orphanedSize)
+	if *dryRun {
+		fmt.Println(", dry run - nothing deleted")
+	} else {
+		fmt.Printf(", %d deleted (%d bytes freed), %d failed\n", deleted, freed, failed)
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
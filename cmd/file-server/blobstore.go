@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore stores file contents by name. Names are slash separated,
+// names of internal blobs like metadata start with a dot.
+//
+// Errors returned for missing blobs wrap fs.ErrNotExist.
+type BlobStore interface {
+	// Put stores size bytes read from r under the name, replacing
+	// the existing blob.
+	Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error
+	// Open returns the blob content with its description.
+	// The caller must close the reader.
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, BlobInfo, error)
+	Stat(ctx context.Context, name string) (BlobInfo, error)
+	Delete(ctx context.Context, name string) error
+	// List returns descriptions of all stored blobs.
+	List(ctx context.Context) ([]BlobInfo, error)
+}
+
+// Presigner is implemented by stores clients can download blobs from directly.
+type Presigner interface {
+	// PresignGet returns URL valid for the expiry duration. Params are added
+	// to the query to override headers of the response.
+	PresignGet(ctx context.Context, name string, expiry time.Duration, params url.Values) (string, error)
+}
+
+type BlobInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// localStore keeps blobs as files in the directory.
+type localStore struct {
+	dir string
+}
+
+func newLocalStore(dir string) (*localStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localStore{dir: filepath.Clean(dir)}, nil
+}
+
+func (s *localStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// Put writes the blob to a temporary file first, so readers never
+// see partially written content.
+func (s *localStore) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *localStore) Open(ctx context.Context, name string) (io.ReadSeekCloser, BlobInfo, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+
+	return f, BlobInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localStore) Stat(ctx context.Context, name string) (BlobInfo, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localStore) Delete(ctx context.Context, name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *localStore) List(ctx context.Context) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip files being written
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+
+		blobs = append(blobs, BlobInfo{Name: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return blobs, err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveGet(method, name string, header http.Header) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{filename}", handleGet)
+
+	req := httptest.NewRequest(method, "/"+name, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGet_CacheHeaders(t *testing.T) {
+	setupStorage(t, "local")
+	_, meta := upload(t, "hello world")
+
+	rec := serveGet("GET", meta.Name, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get returned %d", rec.Code)
+	}
+	if etag := rec.Header().Get("ETag"); etag != `"`+meta.Hash+`"` {
+		t.Errorf("etag is %s expected the quoted hash", etag)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != immutableCacheControl {
+		t.Errorf("cache control is %q", cc)
+	}
+	if rec.Header().Get("Accept-Ranges") != "bytes" {
+		t.Error("ranges are not advertised")
+	}
+}
+
+func TestGet_Range(t *testing.T) {
+	setupStorage(t, "local")
+	_, meta := upload(t, "hello world")
+	etag := `"` + meta.Hash + `"`
+
+	tests := []struct {
+		name         string
+		header       http.Header
+		code         int
+		body         string
+		contentRange string
+	}{
+		{"prefix", http.Header{"Range": {"bytes=0-4"}}, http.StatusPartialContent, "hello", "bytes 0-4/11"},
+		{"suffix", http.Header{"Range": {"bytes=-5"}}, http.StatusPartialContent, "world", "bytes 6-10/11"},
+		{"open ended", http.Header{"Range": {"bytes=6-"}}, http.StatusPartialContent, "world", "bytes 6-10/11"},
+		{"unsatisfiable", http.Header{"Range": {"bytes=20-"}}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */11"},
+		{"matching if-range", http.Header{"Range": {"bytes=0-4"}, "If-Range": {etag}}, http.StatusPartialContent, "hello", "bytes 0-4/11"},
+		{"stale if-range", http.Header{"Range": {"bytes=0-4"}, "If-Range": {`"other"`}}, http.StatusOK, "hello world", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveGet("GET", meta.Name, tt.header)
+			if rec.Code != tt.code {
+				t.Fatalf("get returned %d expected %d", rec.Code, tt.code)
+			}
+			if tt.code != http.StatusRequestedRangeNotSatisfiable && rec.Body.String() != tt.body {
+				t.Errorf("body is %q expected %q", rec.Body, tt.body)
+			}
+			if cr := rec.Header().Get("Content-Range"); cr != tt.contentRange {
+				t.Errorf("content range is %q expected %q", cr, tt.contentRange)
+			}
+		})
+	}
+}
+
+func TestGet_NotModified(t *testing.T) {
+	setupStorage(t, "local")
+	_, meta := upload(t, "hello world")
+
+	rec := serveGet("GET", meta.Name, http.Header{"If-None-Match": {`"` + meta.Hash + `"`}})
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional get returned %d expected %d", rec.Code, http.StatusNotModified)
+	}
+	if rec.Body.Len() != 0 {
+		t.Error("not modified response has a body")
+	}
+
+	rec = serveGet("GET", meta.Name, http.Header{"If-None-Match": {`"other"`}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("get with other etag returned %d expected %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestGet_Head(t *testing.T) {
+	setupStorage(t, "local")
+	_, meta := upload(t, "hello world")
+
+	rec := serveGet("HEAD", meta.Name, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("head returned %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Length") != "11" || rec.Header().Get("ETag") == "" {
+		t.Errorf("head returned headers %v", rec.Header())
+	}
+	if rec.Body.Len() != 0 {
+		t.Error("head response has a body")
+	}
+}
@@ -1,54 +1,144 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/ellezio/Chat-app-with-Go/internal/log"
+	"github.com/ellezio/Chat-app-with-Go/internal/signedurl"
 )
 
-var supportedFileFormat = []string{
-	"jpeg",
-	"png",
+// fileExtensions maps supported media types to extensions of stored files.
+var fileExtensions = map[string]string{
+	"image/jpeg":      "jpeg",
+	"image/png":       "png",
+	"image/gif":       "gif",
+	"image/webp":      "webp",
+	"application/pdf": "pdf",
+	"text/plain":      "txt",
+	"application/zip": "zip",
+	"audio/mpeg":      "mp3",
+	"audio/wave":      "wav",
+	"audio/ogg":       "oga",
+	"application/ogg": "ogg",
+	"audio/webm":      "weba",
+	"audio/mp4":       "m4a",
+	"video/mp4":       "mp4",
+	"video/webm":      "webm",
 }
 
-var mu sync.Mutex
-var seqNum int64
-var lastUnixSec int64
+const defaultAllowedTypes = "image/jpeg,image/png,image/gif,image/webp,application/pdf,text/plain,application/zip,audio/mpeg,audio/wave,audio/ogg,application/ogg,audio/webm,audio/mp4,video/mp4,video/webm"
 
 type config struct {
-	// path to directory where the files will be stored
+	// blob store keeping the files, local or s3
+	storage string
+	// path to directory where the files will be stored by the local store
 	dir string
+	s3  s3Options
+	// validity of presigned download URLs
+	presignExpiry time.Duration
+	// media types accepted on upload
+	allowedTypes []string
+	// keep EXIF and other metadata of uploaded images
+	keepMetadata bool
+	// directory of partial resumable uploads
+	uploadDir string
+	// time after which resumable uploads with no activity are removed
+	uploadExpiry time.Duration
+	// maximum length of resumable uploads
+	maxUploadSize int64
+	// key verifying signed download URLs, downloads are not verified when empty
+	signingKey string
+	// token required by administrative requests, they are rejected when empty
+	adminToken string
+	// address of the ClamAV daemon, files are not scanned when empty
+	clamdAddr string
+	// time limit of a single scan
+	scanTimeout time.Duration
+	// interval of scanning files left pending
+	rescanInterval time.Duration
+	// largest file sent to the scanner, larger uploads are rejected
+	// when scanning is enabled
+	maxScanSize int64
 }
 
 var cfg config
 
 func parseFlags() error {
-	flag.StringVar(&cfg.dir, "dir", "", "path to directory where the files will be stored")
+	var allowedTypes string
+	flag.StringVar(&cfg.storage, "storage", "local", "blob store keeping the files, local or s3")
+	flag.StringVar(&cfg.dir, "dir", "", "path to directory where the files will be stored, required by the local storage")
+	flag.StringVar(&cfg.s3.Endpoint, "s3-endpoint", "", "host and port of the S3 compatible service, it must be reachable by clients")
+	flag.StringVar(&cfg.s3.Bucket, "s3-bucket", "", "bucket where the files will be stored")
+	flag.StringVar(&cfg.s3.Region, "s3-region", "us-east-1", "region of the bucket")
+	flag.StringVar(&cfg.s3.AccessKey, "s3-access-key", os.Getenv("S3_ACCESS_KEY"), "access key, defaults to the S3_ACCESS_KEY environment variable")
+	flag.StringVar(&cfg.s3.SecretKey, "s3-secret-key", os.Getenv("S3_SECRET_KEY"), "secret key, defaults to the S3_SECRET_KEY environment variable")
+	flag.BoolVar(&cfg.s3.Secure, "s3-secure", true, "connect to the S3 compatible service over HTTPS")
+	flag.DurationVar(&cfg.presignExpiry, "presign-expiry", 15*time.Minute, "validity of presigned download URLs")
+	flag.StringVar(&allowedTypes, "allowed-types", defaultAllowedTypes, "comma separated list of media types accepted on upload")
+	flag.BoolVar(&cfg.keepMetadata, "keep-metadata", false, "keep EXIF and other metadata of uploaded JPEG and PNG images")
+	flag.StringVar(&cfg.uploadDir, "upload-dir", filepath.Join(os.TempDir(), "file-server-uploads"), "directory of partial resumable uploads")
+	flag.DurationVar(&cfg.uploadExpiry, "upload-expiry", 24*time.Hour, "time after which resumable uploads with no activity are removed")
+	flag.Int64Var(&cfg.maxUploadSize, "max-upload-size", 2<<30, "maximum length of resumable uploads in bytes")
+	flag.StringVar(&cfg.signingKey, "signing-key", os.Getenv("FILE_SIGNING_KEY"), "key verifying signed download URLs, defaults to the FILE_SIGNING_KEY environment variable")
+	flag.StringVar(&cfg.adminToken, "admin-token", "", "token required by administrative requests like deleting files")
+	flag.StringVar(&cfg.clamdAddr, "clamd-addr", "", "TCP address of the ClamAV daemon scanning uploaded files, files are not scanned when empty")
+	flag.DurationVar(&cfg.scanTimeout, "scan-timeout", 2*time.Minute, "time limit of a single scan")
+	flag.DurationVar(&cfg.rescanInterval, "rescan-interval", 5*time.Minute, "interval of scanning files left pending after failed scans or restarts")
+	flag.Int64Var(&cfg.maxScanSize, "max-scan-size", 25<<20, "largest file in bytes accepted when scanning is enabled, it should match StreamMaxLength of clamd")
 	flag.Parse()
 
-	if cfg.dir == "" {
-		return errors.New("the -dir flag is required")
-	} else {
+	switch cfg.storage {
+	case "local":
+		if cfg.dir == "" {
+			return errors.New("the -dir flag is required by the local storage")
+		}
 		cfg.dir = filepath.Clean(cfg.dir)
+	case "s3":
+		if cfg.s3.Endpoint == "" || cfg.s3.Bucket == "" {
+			return errors.New("the -s3-endpoint and -s3-bucket flags are required by the s3 storage")
+		}
+	default:
+		return fmt.Errorf("unknown storage %q", cfg.storage)
 	}
+
+	for _, t := range strings.Split(allowedTypes, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+
+		if _, ok := fileExtensions[t]; !ok {
+			return fmt.Errorf("media type %q is not supported", t)
+		}
+		cfg.allowedTypes = append(cfg.allowedTypes, t)
+	}
+
 	return nil
 }
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	logger := log.Ctx(r.Context())
 
-	file, _, err := r.FormFile("file")
+	file, header, err := r.FormFile("file")
 	if err != nil {
 		logger.Error("failed to parse file", slog.Any("error", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -60,69 +150,405 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		r.MultipartForm.RemoveAll()
 	}()
 
+	if tooLargeToScan(header.Size) {
+		http.Error(w, "file is too large to be scanned", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta, created, err := processUpload(r.Context(), file)
+	if err != nil {
+		writeUploadError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, meta)
+}
+
+var (
+	errEmptyFile        = errors.New("empty file")
+	errInvalidMediaType = errors.New("invalid media type")
+)
+
+// processUpload validates the uploaded content and stores it, the same
+// content is stored once.
+//
+// Returns whether the file was newly created.
+func processUpload(ctx context.Context, file io.ReadSeeker) (*fileMeta, bool, error) {
 	buf := make([]byte, 512)
-	if _, err := io.ReadFull(file, buf); err != nil {
-		logger.Error("failed to read file", slog.Any("error", err))
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return nil, false, errEmptyFile
+		}
+		return nil, false, fmt.Errorf("reading file: %w", err)
+	}
+
+	mediatype, _, err := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	// containers of audio recordings are sniffed as video
+	media, probeErr := probeMedia(file, mediatype)
+	if probeErr == nil && media.AudioOnly {
+		mediatype = audioMediaType(mediatype)
+	} else if probeErr != nil && !errors.Is(probeErr, errUnsupportedMedia) {
+		log.Ctx(ctx).Warn("failed to probe media", slog.Any("error", probeErr))
+	}
+	if err != nil || !slices.Contains(cfg.allowedTypes, mediatype) {
+		return nil, false, fmt.Errorf("%w - supported types are %s", errInvalidMediaType, strings.Join(cfg.allowedTypes, ", "))
+	}
+
+	h := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(h, file)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("hashing file: %w", err)
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	// known content is not stored again
+	if meta, err := addRef(ctx, hash); err == nil {
+		return meta, false, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, fmt.Errorf("adding file reference: %w", err)
+	}
+
+	dst, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, false, fmt.Errorf("creating file: %w", err)
+	}
+	defer func() {
+		dst.Close()
+		os.Remove(dst.Name())
+	}()
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, false, fmt.Errorf("seeking file: %w", err)
+	}
+
+	if cfg.keepMetadata {
+		_, err = io.Copy(dst, file)
+	} else {
+		err = stripMetadata(dst, file, mediatype)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("copying file: %w", err)
+	}
+
+	info, err := dst.Stat()
+	if err != nil {
+		return nil, false, fmt.Errorf("stating file: %w", err)
+	}
+
+	meta := &fileMeta{
+		Name: hash + "." + fileExtensions[mediatype],
+		Hash: hash,
+		MIME: mediatype,
+		Size: info.Size(),
+	}
+	if scanner != nil {
+		meta.Scan = scanPending
+	}
+	if media.Duration > 0 {
+		meta.Duration = media.Duration.Seconds()
+	}
+	if strings.HasPrefix(mediatype, "image/") {
+		// dimensions are read from the stored file as orientation may have been applied
+		if _, err := dst.Seek(0, io.SeekStart); err == nil {
+			meta.Width, meta.Height, err = imageDimensions(dst)
+			if err != nil {
+				log.Ctx(ctx).Warn("failed to read image dimensions", slog.Any("error", err))
+			}
+		}
+	}
+
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return nil, false, fmt.Errorf("seeking file: %w", err)
+	}
+
+	meta, created, err := storeFile(ctx, dst, meta)
+	if err != nil {
+		return nil, false, fmt.Errorf("storing file: %w", err)
+	}
+	if created && meta.Scan == scanPending {
+		startScan(context.WithoutCancel(ctx), meta.Hash)
+	}
+	return meta, created, nil
+}
+
+// tooLargeToScan reports whether the upload must be rejected as the scanner
+// can't read all of it.
+func tooLargeToScan(size int64) bool {
+	return scanner != nil && size > cfg.maxScanSize
+}
+
+// writeUploadError responds with bad request to invalid content
+// and with internal server error otherwise.
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errEmptyFile) || errors.Is(err, errInvalidMediaType) || errors.Is(err, errInvalidImage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Ctx(r.Context()).Error("failed to process upload", slog.Any("error", err))
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// handleAddRef adds a reference to already stored content,
+// so clients knowing the hash can skip the upload.
+// Only requests with the admin token are allowed, others could keep
+// files from being deleted.
+func handleAddRef(w http.ResponseWriter, r *http.Request) {
+	if !authorizedAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	hash := r.PathValue("hash")
+	if !validHash(hash) {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := addRef(r.Context(), hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Ctx(r.Context()).Error("failed to add file reference", slog.Any("error", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	mediatype := http.DetectContentType(buf)
-	mediaParts := strings.SplitN(mediatype, "/", 2)
-	if len(mediaParts) != 2 || mediaParts[0] != "image" {
-		http.Error(w, "invalid media type - only image are supported", http.StatusBadRequest)
+	writeJSON(w, http.StatusOK, meta)
+}
+
+// handleDelete removes a reference to the file, with the force parameter
+// the file is removed regardless of references. The File-Deleted header
+// is set when the file was removed.
+// Only requests with the admin token are allowed.
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	if !authorizedAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	fname := r.PathValue("filename")
+	if !validFilename(fname) {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+	deleted, err := releaseFile(r.Context(), fname, force)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Ctx(r.Context()).Error("failed to delete file", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if !slices.Contains(supportedFileFormat, mediaParts[1]) {
-		http.Error(w, "invalid media type - only image/jpeg and image/png are supported", http.StatusBadRequest)
+	if deleted {
+		w.Header().Set("File-Deleted", "true")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListFiles lists stored files for maintenance jobs.
+// Only requests with the admin token are allowed.
+func handleListFiles(w http.ResponseWriter, r *http.Request) {
+	if !authorizedAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
 
-	fname := generateFilename() + "." + mediaParts[1]
-	fpath := filepath.Join(cfg.dir, fname)
-	dst, err := os.Create(fpath)
+	files, err := listFiles(r.Context())
 	if err != nil {
-		logger.Error("failed to create file", slog.Any("error", err))
+		log.Ctx(r.Context()).Error("failed to list files", slog.Any("error", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		dst.Close()
-		os.Remove(fpath)
-		logger.Error("failed to seek file", slog.Any("error", err))
+	writeJSON(w, http.StatusOK, files)
+}
+
+// handleScanStatus reports the scan status of the file.
+// Only requests with the admin token are allowed.
+func handleScanStatus(w http.ResponseWriter, r *http.Request) {
+	if !authorizedAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	fname := r.PathValue("filename")
+	if !validFilename(fname) {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := readMeta(r.Context(), fileHash(fname))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Ctx(r.Context()).Error("failed to read metadata", slog.Any("error", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	_, err = io.Copy(dst, file)
-	dst.Close()
-	if err != nil {
-		os.Remove(fpath)
-		logger.Error("failed to copy file", slog.Any("error", err))
+	status := meta.Scan
+	if status == "" {
+		status = scanClean
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"name":      meta.Name,
+		"scan":      status,
+		"signature": meta.Signature,
+		"error":     meta.ScanError,
+	})
+}
+
+func authorizedAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return cfg.adminToken != "" && ok &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(cfg.adminToken)) == 1
+}
+
+// validFilename reports whether the name refers to a stored file,
+// paths and hidden files used for metadata and temporary files are rejected.
+func validFilename(fname string) bool {
+	return fname == filepath.Base(fname) && fname != "" && !strings.HasPrefix(fname, ".")
+}
+
+// immutableCacheControl is sent with file contents, names of stored files
+// and their variants are derived from the content so they never change.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// fileETag returns the strong entity tag of the stored file or variant.
+func fileETag(name string) string {
+	return `"` + strings.TrimSuffix(name, path.Ext(name)) + `"`
+}
+
+// handleGet serves the file or its variant. With the signing key set only
+// URLs signed by the webapp are served. Stores supporting presigned URLs
+// serve the content directly, the client is redirected to them.
+//
+// Contents are served with ranges, conditional requests and HEAD supported.
+func handleGet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	fname := r.PathValue("filename")
+	if !validFilename(fname) {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	if cfg.signingKey != "" {
+		if err := signedurl.Verify([]byte(cfg.signingKey), fname, r.URL.Query(), time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	meta, err := readMeta(ctx, fileHash(fname))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Ctx(ctx).Error("failed to read metadata", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if meta != nil && meta.quarantined() {
+		http.Error(w, "file is quarantined", http.StatusForbidden)
+		return
+	}
+
+	name := fname
+	if size := r.URL.Query().Get("size"); size != "" {
+		if _, err := blobs.Stat(ctx, fname); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		vname, err := variantName(ctx, fname, size)
+		if err != nil {
+			log.Ctx(ctx).Error("failed to get image variant", slog.Any("error", err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name = vname
+	}
+
+	mediatype := extensionMediaType(strings.TrimPrefix(path.Ext(name), "."))
+
+	if p, ok := blobs.(Presigner); ok {
+		params := url.Values{}
+		if mediatype != "" {
+			params.Set("response-content-type", mediatype)
+		}
+		if !isInline(mediatype) {
+			params.Set("response-content-disposition", "attachment")
+		}
+		params.Set("response-cache-control", immutableCacheControl)
+
+		u, err := p.PresignGet(ctx, name, cfg.presignExpiry, params)
+		if err != nil {
+			log.Ctx(ctx).Error("failed to presign URL", slog.Any("error", err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	content, info, err := blobs.Open(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Ctx(ctx).Error("failed to open file", slog.Any("error", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer content.Close()
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fname))
+	if mediatype != "" {
+		w.Header().Set("Content-Type", mediatype)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !isInline(mediatype) {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	// the entity tag takes precedence over the modification time
+	// in conditional requests
+	w.Header().Set("ETag", fileETag(name))
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	http.ServeContent(w, r, name, info.ModTime, content)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
 
-func generateFilename() string {
-	mu.Lock()
-	us := time.Now().Unix()
-	var seq int64
-	if us != lastUnixSec {
-		seqNum = 0
-		lastUnixSec = us
+// extensionMediaType returns the media type of stored files with the extension.
+func extensionMediaType(ext string) string {
+	for mediatype, e := range fileExtensions {
+		if e == ext {
+			return mediatype
+		}
 	}
-	seq = seqNum
-	seqNum++
-	mu.Unlock()
+	return ""
+}
 
-	return fmt.Sprintf("%d_%d", us, seq)
+// isInline reports whether the file of the media type can be displayed
+// by the browser, other files are served as attachments.
+func isInline(mediatype string) bool {
+	kind, _, _ := strings.Cut(mediatype, "/")
+	return kind == "image" || kind == "audio" || kind == "video" || mediatype == "application/ogg"
 }
 
 func main() {
@@ -134,27 +560,44 @@ func main() {
 		panic(err)
 	}
 
-	if _, err := os.Stat(cfg.dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(cfg.dir, 0755); err != nil {
-			panic(err)
-		}
-	} else if err != nil {
+	var err error
+	switch cfg.storage {
+	case "local":
+		blobs, err = newLocalStore(cfg.dir)
+	case "s3":
+		blobs, err = newS3Store(cfg.s3)
+	}
+	if err != nil {
 		panic(err)
 	}
 
+	if cfg.signingKey == "" {
+		logger.Warn("signing key is not set, downloads are not verified")
+	}
+
+	if err := os.MkdirAll(cfg.uploadDir, 0755); err != nil {
+		panic(err)
+	}
+	go expireUploads(log.WithContext(context.Background(), logger), min(cfg.uploadExpiry, time.Minute))
+
+	if cfg.clamdAddr != "" {
+		scanner = &clamdScanner{addr: cfg.clamdAddr, timeout: cfg.scanTimeout}
+		go rescanPendingFiles(log.WithContext(context.Background(), logger), cfg.rescanInterval)
+	} else {
+		logger.Warn("clamd address is not set, uploaded files are not scanned")
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("POST /", handleUpload)
-	mux.Handle("GET /{filename}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fname := r.PathValue("filename")
-		// only accept file name not a path
-		if fname != filepath.Base(fname) {
-			http.Error(w, "invalid filename", http.StatusBadRequest)
-			return
-		}
-
-		fpath := filepath.Join(cfg.dir, fname)
-		http.ServeFile(w, r, fpath)
-	}))
+	mux.HandleFunc("POST /refs/{hash}", handleAddRef)
+	mux.HandleFunc("DELETE /{filename}", handleDelete)
+	mux.HandleFunc("GET /admin/files", handleListFiles)
+	mux.HandleFunc("GET /scan/{filename}", handleScanStatus)
+	mux.HandleFunc("POST /uploads", handleCreateUpload)
+	mux.HandleFunc("HEAD /uploads/{id}", handleUploadStatus)
+	mux.HandleFunc("PATCH /uploads/{id}", handlePatchUpload)
+	mux.HandleFunc("DELETE /uploads/{id}", handleDeleteUpload)
+	mux.HandleFunc("GET /{filename}", handleGet)
 
 	if err := http.ListenAndServe(":3001", log.Middleware(mux, logger)); err != nil {
 		panic(err)
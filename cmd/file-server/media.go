@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// mediaInfo describes an audio or video file.
+type mediaInfo struct {
+	// zero when unknown
+	Duration time.Duration
+	// the file has no video tracks
+	AudioOnly bool
+}
+
+var errUnsupportedMedia = errors.New("unsupported media container")
+
+// probeMedia reads the duration and kind of tracks of the file with
+// the sniffed media type. Only headers and block headers are read,
+// block contents are skipped.
+func probeMedia(r io.ReadSeeker, mediatype string) (mediaInfo, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return mediaInfo{}, err
+	}
+
+	switch mediatype {
+	case "video/webm", "audio/webm":
+		return probeWebM(r)
+	case "video/mp4", "audio/mp4":
+		return probeMP4(r)
+	case "application/ogg", "audio/ogg":
+		return probeOgg(r)
+	case "audio/wave":
+		return probeWAV(r)
+	}
+	return mediaInfo{}, errUnsupportedMedia
+}
+
+// audioMediaType returns the audio variant of the container media type
+// sniffed as video.
+func audioMediaType(mediatype string) string {
+	switch mediatype {
+	case "video/webm":
+		return "audio/webm"
+	case "video/mp4":
+		return "audio/mp4"
+	case "application/ogg":
+		return "audio/ogg"
+	}
+	return mediatype
+}
+
+/*
+
+WebM is a Matroska subset built of EBML elements, each with a variable
+length ID and size. Recorders streaming the file, like MediaRecorder in
+browsers, write the segment and clusters with unknown sizes and leave out
+the duration, so it's computed from timecodes of the last block.
+
+Elements are read as a flat stream, children of the elements listed in
+webmMasters are read in place of their parent and others are skipped.
+
+*/
+
+const (
+	ebmlHeaderID   = 0x1A45DFA3
+	segmentID      = 0x18538067
+	infoID         = 0x1549A966
+	timecodeScale  = 0x2AD7B1
+	durationID     = 0x4489
+	tracksID       = 0x1654AE6B
+	trackEntryID   = 0xAE
+	trackTypeID    = 0x83
+	clusterID      = 0x1F43B675
+	timecodeID     = 0xE7
+	simpleBlockID  = 0xA3
+	blockGroupID   = 0xA0
+	blockID        = 0xA1
+	webmVideoTrack = 1
+
+	unknownSize = -1
+)
+
+var webmMasters = map[uint32]bool{
+	segmentID:    true,
+	infoID:       true,
+	tracksID:     true,
+	trackEntryID: true,
+	clusterID:    true,
+	blockGroupID: true,
+}
+
+// readVint reads an EBML variable length integer. IDs keep the length
+// marker, sizes have it cleared. Sizes with all bits set are unknown.
+func readVint(r io.Reader, keepMarker bool) (int64, int, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return 0, 0, err
+	}
+
+	length := 1
+	for mask := byte(0x80); length <= 8 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, errors.New("invalid EBML integer")
+	}
+
+	value := int64(first[0])
+	if !keepMarker {
+		value &= int64(0xFF >> length)
+	}
+	allOnes := value == int64(0xFF>>length)
+
+	rest := make([]byte, length-1)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return 0, 0, err
+	}
+	for _, b := range rest {
+		value = value<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+
+	if !keepMarker && allOnes {
+		return unknownSize, length, nil
+	}
+	return value, length, nil
+}
+
+func readUint(r io.Reader, size int64) (uint64, error) {
+	if size > 8 {
+		return 0, errors.New("integer too long")
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return v, nil
+}
+
+func probeWebM(r io.ReadSeeker) (mediaInfo, error) {
+	var (
+		scale           uint64 = 1000000
+		declared        float64
+		clusterTimecode int64
+		lastTimecode    int64
+		hasVideo        bool
+		hasTracks       bool
+	)
+
+	for first := true; ; first = false {
+		id, _, err := readVint(r, true)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return mediaInfo{}, err
+		}
+		if first && id != ebmlHeaderID {
+			return mediaInfo{}, errors.New("missing EBML header")
+		}
+
+		size, _, err := readVint(r, false)
+		if err != nil {
+			return mediaInfo{}, err
+		}
+
+		if webmMasters[uint32(id)] {
+			continue
+		}
+		if size == unknownSize {
+			// size of other elements is needed to skip them
+			break
+		}
+
+		switch id {
+		case timecodeScale:
+			scale, err = readUint(r, size)
+		case durationID:
+			var b []byte
+			b, err = readN(r, size)
+			switch len(b) {
+			case 4:
+				declared = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+			case 8:
+				declared = math.Float64frombits(binary.BigEndian.Uint64(b))
+			}
+		case trackTypeID:
+			var typ uint64
+			typ, err = readUint(r, size)
+			hasTracks = true
+			hasVideo = hasVideo || typ == webmVideoTrack
+		case timecodeID:
+			var tc uint64
+			tc, err = readUint(r, size)
+			clusterTimecode = int64(tc)
+		case simpleBlockID, blockID:
+			var n int
+			// the block starts with the track number and the timecode
+			// relative to the cluster
+			if _, n, err = readVint(r, false); err == nil {
+				var rel int16
+				if err = binary.Read(r, binary.BigEndian, &rel); err == nil {
+					lastTimecode = max(lastTimecode, clusterTimecode+int64(rel))
+					_, err = r.Seek(size-int64(n)-2, io.SeekCurrent)
+				}
+			}
+		default:
+			_, err = r.Seek(size, io.SeekCurrent)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// truncated recordings still have the duration of read blocks
+			break
+		} else if err != nil {
+			return mediaInfo{}, err
+		}
+	}
+
+	info := mediaInfo{AudioOnly: hasTracks && !hasVideo}
+	if declared > 0 {
+		info.Duration = time.Duration(declared * float64(scale))
+	} else {
+		info.Duration = time.Duration(lastTimecode * int64(scale))
+	}
+	return info, nil
+}
+
+func readN(r io.Reader, size int64) ([]byte, error) {
+	if size > 1<<20 {
+		return nil, fmt.Errorf("element of %d bytes is too large", size)
+	}
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+/*
+
+MP4 is built of boxes with a 32 bit size, or a 64 bit one when the size is
+1, followed by the type. The duration is in the movie header and handlers of
+tracks tell their kind. Fragmented files written while recording have zero
+duration in the header, it's left unknown for them.
+
+*/
+
+var mp4Containers = map[string]bool{"moov": true, "trak": true, "mdia": true}
+
+func probeMP4(r io.ReadSeeker) (mediaInfo, error) {
+	var (
+		info      mediaInfo
+		hasTracks bool
+		hasVideo  bool
+	)
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return mediaInfo{}, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// the last box extends to the end of the file
+			size = math.MaxInt64
+		case 1:
+			var large uint64
+			if err := binary.Read(r, binary.BigEndian, &large); err != nil {
+				return mediaInfo{}, err
+			}
+			size = int64(large)
+			headerSize = 16
+		}
+		if size < headerSize {
+			return mediaInfo{}, fmt.Errorf("invalid size of %q box", typ)
+		}
+
+		if mp4Containers[typ] {
+			continue
+		}
+		if size == math.MaxInt64 {
+			break
+		}
+
+		var err error
+		body := size - headerSize
+		switch typ {
+		case "mvhd":
+			var b []byte
+			if b, err = readN(r, body); err == nil {
+				info.Duration, err = mvhdDuration(b)
+			}
+		case "hdlr":
+			var b []byte
+			if b, err = readN(r, body); err == nil && len(b) >= 12 {
+				hasTracks = true
+				hasVideo = hasVideo || string(b[8:12]) == "vide"
+			}
+		default:
+			_, err = r.Seek(body, io.SeekCurrent)
+		}
+		if err != nil {
+			return mediaInfo{}, err
+		}
+	}
+
+	info.AudioOnly = hasTracks && !hasVideo
+	return info, nil
+}
+
+func mvhdDuration(b []byte) (time.Duration, error) {
+	if len(b) < 1 {
+		return 0, errors.New("invalid movie header")
+	}
+
+	var timescale, duration uint64
+	switch b[0] {
+	case 0:
+		if len(b) < 20 {
+			return 0, errors.New("invalid movie header")
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[12:]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:]))
+	case 1:
+		if len(b) < 32 {
+			return 0, errors.New("invalid movie header")
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[20:]))
+		duration = binary.BigEndian.Uint64(b[24:])
+	default:
+		return 0, fmt.Errorf("unknown movie header version %d", b[0])
+	}
+
+	// unknown durations are written as all ones
+	if timescale == 0 || duration == math.MaxUint32 || duration == math.MaxUint64 {
+		return 0, nil
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+}
+
+/*
+
+Ogg streams are split into pages, each with the granule position of the
+last complete packet. For Opus and Vorbis it's the number of samples, so
+the duration is the granule of the last page divided by the sample rate,
+less the samples Opus skips at the start.
+
+*/
+
+const oggPageHeaderSize = 27
+
+// oggTail is the part of the file searched for the last page, pages are
+// at most 64KiB long.
+const oggTail = 65307
+
+func probeOgg(r io.ReadSeeker) (mediaInfo, error) {
+	first := make([]byte, 512)
+	n, err := io.ReadFull(r, first)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return mediaInfo{}, err
+	}
+	first = first[:n]
+
+	if len(first) < oggPageHeaderSize || string(first[:4]) != "OggS" ||
+		len(first) < oggPageHeaderSize+int(first[26]) {
+		return mediaInfo{}, errors.New("missing Ogg page")
+	}
+	packet := first[oggPageHeaderSize+int(first[26]):]
+
+	var rate, preSkip uint64
+	switch {
+	case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 12:
+		// granules of Opus are always at 48kHz
+		rate = 48000
+		preSkip = uint64(binary.LittleEndian.Uint16(packet[10:]))
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+		rate = uint64(binary.LittleEndian.Uint32(packet[12:]))
+	default:
+		// other codecs may be video
+		return mediaInfo{}, nil
+	}
+
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return mediaInfo{}, err
+	}
+	start := max(0, end-oggTail)
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return mediaInfo{}, err
+	}
+	tail, err := io.ReadAll(r)
+	if err != nil {
+		return mediaInfo{}, err
+	}
+
+	info := mediaInfo{AudioOnly: true}
+	for i := len(tail) - oggPageHeaderSize; i >= 0; i-- {
+		if string(tail[i:i+4]) != "OggS" || tail[i+4] != 0 {
+			continue
+		}
+
+		granule := binary.LittleEndian.Uint64(tail[i+6:])
+		// pages with no finished packet have the granule of all ones
+		if granule == math.MaxUint64 || rate == 0 {
+			continue
+		}
+		if granule > preSkip {
+			info.Duration = time.Duration(float64(granule-preSkip) / float64(rate) * float64(time.Second))
+		}
+		break
+	}
+	return info, nil
+}
+
+// probeWAV divides the size of the data chunk by the byte rate
+// from the format chunk.
+func probeWAV(r io.ReadSeeker) (mediaInfo, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return mediaInfo{}, err
+	}
+	if string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return mediaInfo{}, errors.New("missing RIFF header")
+	}
+
+	var byteRate uint32
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return mediaInfo{}, err
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			b, err := readN(r, size)
+			if err != nil {
+				return mediaInfo{}, err
+			}
+			if len(b) < 12 {
+				return mediaInfo{}, errors.New("invalid format chunk")
+			}
+			byteRate = binary.LittleEndian.Uint32(b[8:])
+		case "data":
+			if byteRate == 0 {
+				return mediaInfo{}, errors.New("data chunk before format")
+			}
+			return mediaInfo{
+				Duration:  time.Duration(float64(size) / float64(byteRate) * float64(time.Second)),
+				AudioOnly: true,
+			}, nil
+		default:
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return mediaInfo{}, err
+			}
+		}
+		// chunks are padded to even sizes
+		if size%2 == 1 {
+			r.Seek(1, io.SeekCurrent)
+		}
+	}
+}
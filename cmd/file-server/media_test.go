@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ebml encodes the element with a one byte size, or with unknown size
+// like a live recording.
+func ebml(id []byte, data []byte, unknown bool) []byte {
+	b := append([]byte{}, id...)
+	if unknown {
+		return append(append(b, 0xFF), data...)
+	}
+	return append(append(b, 0x80|byte(len(data))), data...)
+}
+
+func simpleBlock(rel int16) []byte {
+	data := []byte{0x81, byte(uint16(rel) >> 8), byte(rel), 0x80, 1, 2, 3}
+	return ebml([]byte{0xA3}, data, false)
+}
+
+func testWebM(trackType byte, duration []byte) []byte {
+	header := ebml([]byte{0x1A, 0x45, 0xDF, 0xA3}, ebml([]byte{0x42, 0x82}, []byte("webm"), false), false)
+
+	info := ebml([]byte{0x2A, 0xD7, 0xB1}, []byte{0x0F, 0x42, 0x40}, false)
+	if duration != nil {
+		info = append(info, ebml([]byte{0x44, 0x89}, duration, false)...)
+	}
+
+	track := ebml([]byte{0xAE}, ebml([]byte{0x83}, []byte{trackType}, false), false)
+
+	// clusters as written by MediaRecorder, with unknown sizes
+	var clusters []byte
+	clusters = append(clusters, ebml([]byte{0x1F, 0x43, 0xB6, 0x75}, nil, true)...)
+	clusters = append(clusters, ebml([]byte{0xE7}, []byte{0}, false)...)
+	clusters = append(clusters, simpleBlock(0)...)
+	clusters = append(clusters, simpleBlock(1500)...)
+	clusters = append(clusters, ebml([]byte{0x1F, 0x43, 0xB6, 0x75}, nil, true)...)
+	clusters = append(clusters, ebml([]byte{0xE7}, []byte{0x0B, 0xB8}, false)...)
+	clusters = append(clusters, simpleBlock(0)...)
+	clusters = append(clusters, simpleBlock(1250)...)
+
+	segment := ebml([]byte{0x15, 0x49, 0xA9, 0x66}, info, false)
+	segment = append(segment, ebml([]byte{0x16, 0x54, 0xAE, 0x6B}, track, false)...)
+	segment = append(segment, clusters...)
+
+	return append(header, ebml([]byte{0x18, 0x53, 0x80, 0x67}, segment, true)...)
+}
+
+func box(typ string, data ...[]byte) []byte {
+	body := bytes.Join(data, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+func testMP4(handler string) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 2500)
+
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], handler)
+
+	return bytes.Join([][]byte{
+		box("ftyp", []byte("isom\x00\x00\x02\x00")),
+		box("moov", box("mvhd", mvhd), box("trak", box("tkhd", make([]byte, 84)), box("mdia", box("hdlr", hdlr)))),
+		box("mdat", make([]byte, 64)),
+	}, nil)
+}
+
+func oggPage(granule uint64, packet []byte) []byte {
+	page := []byte("OggS\x00\x00")
+	page = binary.LittleEndian.AppendUint64(page, granule)
+	page = append(page, make([]byte, 12)...)
+	page = append(page, 1, byte(len(packet)))
+	return append(page, packet...)
+}
+
+func testOpus() []byte {
+	head := []byte("OpusHead\x01\x01")
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = append(head, 0, 0, 0)
+
+	return bytes.Join([][]byte{
+		oggPage(0, head),
+		oggPage(0, []byte("OpusTags")),
+		oggPage(48000, make([]byte, 100)),
+		oggPage(144312, make([]byte, 100)),
+	}, nil)
+}
+
+func testWAV() []byte {
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 16000)
+
+	b := []byte("RIFF\x00\x00\x00\x00WAVE")
+	b = append(b, "fmt "...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(fmtChunk)))
+	b = append(b, fmtChunk...)
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, 24000)
+	return append(b, make([]byte, 24000)...)
+}
+
+func TestProbeMedia(t *testing.T) {
+	declared := binary.BigEndian.AppendUint64(nil, math.Float64bits(6000))
+
+	tests := []struct {
+		name      string
+		mediatype string
+		content   []byte
+		duration  time.Duration
+		audioOnly bool
+	}{
+		{"webm recording", "video/webm", testWebM(2, nil), 4250 * time.Millisecond, true},
+		{"webm with duration", "video/webm", testWebM(2, declared), 6 * time.Second, true},
+		{"webm video", "video/webm", testWebM(1, nil), 4250 * time.Millisecond, false},
+		{"mp4 audio", "video/mp4", testMP4("soun"), 2500 * time.Millisecond, true},
+		{"mp4 video", "video/mp4", testMP4("vide"), 2500 * time.Millisecond, false},
+		{"opus", "application/ogg", testOpus(), 3 * time.Second, true},
+		{"wav", "audio/wave", testWAV(), 1500 * time.Millisecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := probeMedia(bytes.NewReader(tt.content), tt.mediatype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Duration != tt.duration || info.AudioOnly != tt.audioOnly {
+				t.Errorf("got %+v expected duration %s and audio only %v", info, tt.duration, tt.audioOnly)
+			}
+		})
+	}
+}
+
+func TestProbeMedia_Truncated(t *testing.T) {
+	content := testWebM(2, nil)
+	info, err := probeMedia(bytes.NewReader(content[:len(content)-4]), "video/webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration != 4250*time.Millisecond {
+		t.Errorf("truncated recording has duration %s", info.Duration)
+	}
+}
+
+func TestUpload_AudioRecording(t *testing.T) {
+	setupStorage(t, "local")
+	cfg.allowedTypes = []string{"audio/webm"}
+
+	code, meta := upload(t, string(testWebM(2, nil)))
+	if code != http.StatusCreated {
+		t.Fatalf("upload responded with %d", code)
+	}
+	if meta.MIME != "audio/webm" || !strings.HasSuffix(meta.Name, ".weba") {
+		t.Errorf("recording stored as %s %s", meta.MIME, meta.Name)
+	}
+	if meta.Duration != 4.25 {
+		t.Errorf("recording has duration %v", meta.Duration)
+	}
+
+	// video is not accepted as audio
+	_, _, err := processUpload(t.Context(), bytes.NewReader(testWebM(1, nil)))
+	if !errors.Is(err, errInvalidMediaType) {
+		t.Errorf("video upload returned %v", err)
+	}
+}
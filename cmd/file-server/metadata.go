@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"slices"
+)
+
+/*
+
+Metadata is removed without re-encoding whenever possible. JPEG segments and
+PNG chunks carrying EXIF, XMP, IPTC, comments and text are dropped and the
+rest of the file is copied as is. Only when EXIF orientation is other than
+normal the image is decoded, rotated and encoded again, as after removing the
+tag browsers would display it rotated.
+
+*/
+
+var errInvalidImage = errors.New("invalid image")
+
+// maxImagePixels limits images decoded by the server, so a small file
+// declaring huge dimensions can't exhaust its memory.
+const maxImagePixels = 40_000_000
+
+// checkImagePixels reads dimensions of the image without decoding it and
+// rejects images with more than maxImagePixels.
+func checkImagePixels(r io.Reader) error {
+	c, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	if int64(c.Width)*int64(c.Height) > maxImagePixels {
+		return fmt.Errorf("%w: %dx%d is more than %d pixels", errInvalidImage, c.Width, c.Height, maxImagePixels)
+	}
+	return nil
+}
+
+const exifOrientationTag = 0x0112
+
+// stripMetadata writes the image read from r to w without metadata.
+func stripMetadata(w io.Writer, r io.ReadSeeker, mediatype string) error {
+	switch mediatype {
+	case "image/jpeg":
+		return stripJPEG(w, r)
+	case "image/png":
+		return stripPNG(w, r)
+	default:
+		_, err := io.Copy(w, r)
+		return err
+	}
+}
+
+var jpegDroppedMarkers = []byte{
+	0xE1, // APP1 - EXIF, XMP
+	0xED, // APP13 - IPTC
+	0xFE, // COM
+}
+
+func stripJPEG(w io.Writer, r io.ReadSeeker) error {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return fmt.Errorf("%w: missing JPEG start of image", errInvalidImage)
+	}
+
+	var out bytes.Buffer
+	out.Write(soi[:])
+	orientation := 1
+
+	for {
+		marker, err := readJPEGMarker(br)
+		if err != nil {
+			return err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return fmt.Errorf("%w: truncated segment: %v", errInvalidImage, err)
+		}
+
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return fmt.Errorf("%w: invalid segment length", errInvalidImage)
+		}
+
+		data := make([]byte, n-2)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return fmt.Errorf("%w: truncated segment: %v", errInvalidImage, err)
+		}
+
+		if marker == 0xE1 && bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+			orientation = exifOrientation(data[6:])
+		}
+
+		if !slices.Contains(jpegDroppedMarkers, marker) {
+			out.Write([]byte{0xFF, marker})
+			out.Write(length[:])
+			out.Write(data)
+		}
+
+		// start of scan, entropy coded data follows up to the end of file
+		if marker == 0xDA {
+			break
+		}
+	}
+
+	if orientation != 1 {
+		return reencodeOriented(w, r, orientation, "jpeg")
+	}
+
+	if _, err := out.WriteTo(w); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(w, br)
+	return err
+}
+
+func readJPEGMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("%w: expected marker", errInvalidImage)
+	}
+
+	// markers may be preceded by any number of fill bytes
+	for b == 0xFF {
+		if b, err = br.ReadByte(); err != nil {
+			return 0, fmt.Errorf("%w: %v", errInvalidImage, err)
+		}
+	}
+
+	return b, nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+var pngDroppedChunks = []string{"tEXt", "zTXt", "iTXt", "eXIf", "tIME"}
+
+// stripPNG copies chunks of the image to w except the dropped ones. Chunks
+// are read twice, first to find the orientation, so nothing is written when
+// the image has to be encoded again, and then to stream kept chunks.
+func stripPNG(w io.Writer, r io.ReadSeeker) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	orientation := 1
+	err = readPNGChunks(r, size, func(header []byte, typ string, br *bufio.Reader, n int64) error {
+		if typ != "eXIf" {
+			_, err := br.Discard(int(n))
+			return err
+		}
+
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+		orientation = exifOrientation(data[:n-4])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if orientation != 1 {
+		return reencodeOriented(w, r, orientation, "png")
+	}
+
+	if _, err := w.Write(pngSignature); err != nil {
+		return err
+	}
+	return readPNGChunks(r, size, func(header []byte, typ string, br *bufio.Reader, n int64) error {
+		if slices.Contains(pngDroppedChunks, typ) {
+			_, err := br.Discard(int(n))
+			return err
+		}
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		_, err := io.CopyN(w, br, n)
+		return err
+	})
+}
+
+// readPNGChunks calls fn for each chunk of the PNG image of size bytes up to
+// IEND, fn must consume n bytes of the chunk data and CRC from br. Lengths
+// of chunks are checked against the bytes left in the file.
+func readPNGChunks(r io.ReadSeeker, size int64, fn func(header []byte, typ string, br *bufio.Reader, n int64) error) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return fmt.Errorf("%w: missing PNG signature", errInvalidImage)
+	}
+
+	left := size - int64(len(sig))
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return fmt.Errorf("%w: truncated chunk: %v", errInvalidImage, err)
+		}
+		left -= int64(len(header))
+
+		// data followed by CRC
+		n := int64(binary.BigEndian.Uint32(header[:4])) + 4
+		if n > left {
+			return fmt.Errorf("%w: chunk longer than the file", errInvalidImage)
+		}
+		left -= n
+
+		typ := string(header[4:])
+		if err := fn(header[:], typ, br, n); err != nil {
+			return fmt.Errorf("%w: truncated chunk: %v", errInvalidImage, err)
+		}
+
+		if typ == "IEND" {
+			return nil
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag from IFD0 of TIFF formatted EXIF
+// data. Normal orientation is returned when the tag can't be read.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for i := range count {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+
+	return 1
+}
+
+func reencodeOriented(w io.Writer, r io.ReadSeeker, orientation int, format string) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := checkImagePixels(r); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+
+	oriented := applyOrientation(img, orientation)
+	if format == "png" {
+		return png.Encode(w, oriented)
+	}
+	return jpeg.Encode(w, oriented, &jpeg.Options{Quality: 92})
+}
+
+// applyOrientation transforms the image so it's displayed correctly
+// without the EXIF orientation tag.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		for x := range dw {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
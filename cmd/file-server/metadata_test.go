@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	tiff = append(tiff, []byte("GPS 52.2297N 21.0122E")...)
+
+	data := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xFF, 0xE1}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(data)+2))
+	return append(seg, data...)
+}
+
+// testJPEG returns a 4x2 JPEG with white top-left pixel and EXIF and comment
+// segments inserted after the start of image.
+func testJPEG(t *testing.T, orientation uint16) []byte {
+	img := image.NewGray(image.Rect(0, 0, 4, 2))
+	img.SetGray(0, 0, color.Gray{Y: 255})
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	com := []byte{0xFF, 0xFE, 0x00, 0x09, 's', 'e', 'r', 'i', 'a', 'l', '#'}
+	b := buf.Bytes()
+	out := append([]byte{}, b[:2]...)
+	out = append(out, exifSegment(orientation)...)
+	out = append(out, com...)
+	return append(out, b[2:]...)
+}
+
+func TestStripMetadata_JPEG(t *testing.T) {
+	src := testJPEG(t, 1)
+
+	var out bytes.Buffer
+	if err := stripMetadata(&out, bytes.NewReader(src), "image/jpeg"); err != nil {
+		t.Fatal("strip failed:", err)
+	}
+
+	if bytes.Contains(out.Bytes(), []byte("Exif")) || bytes.Contains(out.Bytes(), []byte("GPS")) {
+		t.Error("EXIF data left in the image")
+	}
+	if bytes.Contains(out.Bytes(), []byte("serial#")) {
+		t.Error("comment left in the image")
+	}
+
+	expectedLen := len(src) - len(exifSegment(1)) - 11
+	if out.Len() != expectedLen {
+		t.Errorf("stripped image has %d bytes expected %d, image should not be re-encoded", out.Len(), expectedLen)
+	}
+
+	if _, err := jpeg.Decode(&out); err != nil {
+		t.Error("stripped image is not valid:", err)
+	}
+}
+
+func TestStripMetadata_JPEGAppliesOrientation(t *testing.T) {
+	var out bytes.Buffer
+	if err := stripMetadata(&out, bytes.NewReader(testJPEG(t, 6)), "image/jpeg"); err != nil {
+		t.Fatal("strip failed:", err)
+	}
+
+	if bytes.Contains(out.Bytes(), []byte("GPS")) {
+		t.Error("EXIF data left in the image")
+	}
+
+	img, err := jpeg.Decode(&out)
+	if err != nil {
+		t.Fatal("stripped image is not valid:", err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 4 {
+		t.Fatalf("image is %dx%d expected rotated 2x4", b.Dx(), b.Dy())
+	}
+
+	// rotated clockwise, so the top-left pixel lands in the top-right corner
+	if y, _, _, _ := img.At(1, 0).RGBA(); y < 0x8000 {
+		t.Error("image was not rotated clockwise")
+	}
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+}
+
+func TestStripMetadata_PNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 3, 3))); err != nil {
+		t.Fatal(err)
+	}
+
+	// text chunk placed right after IHDR, signature 8 bytes and IHDR 25 bytes
+	b := buf.Bytes()
+	src := append([]byte{}, b[:33]...)
+	src = append(src, pngChunk("tEXt", []byte("Author\x00secret person"))...)
+	src = append(src, b[33:]...)
+
+	var out bytes.Buffer
+	if err := stripMetadata(&out, bytes.NewReader(src), "image/png"); err != nil {
+		t.Fatal("strip failed:", err)
+	}
+
+	if bytes.Contains(out.Bytes(), []byte("secret person")) {
+		t.Error("text chunk left in the image")
+	}
+
+	if !bytes.Equal(out.Bytes(), b) {
+		t.Error("stripped image differs from the image without metadata")
+	}
+}
+
+func TestStripMetadata_InvalidImage(t *testing.T) {
+	var out bytes.Buffer
+	err := stripMetadata(&out, bytes.NewReader([]byte("\xFF\xD8\xFF\xE1\x00")), "image/jpeg")
+	if err == nil {
+		t.Error("expected truncated image to fail")
+	}
+}
+
+func TestStripMetadata_PNGChunkLongerThanFile(t *testing.T) {
+	// IHDR declaring almost 2 GB of data in a file of a few bytes
+	src := append([]byte{}, pngSignature...)
+	src = binary.BigEndian.AppendUint32(src, 1<<31-1)
+	src = append(src, "IHDR"...)
+
+	var out bytes.Buffer
+	err := stripMetadata(&out, bytes.NewReader(src), "image/png")
+	if !errors.Is(err, errInvalidImage) {
+		t.Errorf("got error %v expected invalid image", err)
+	}
+	if out.Len() != 0 {
+		t.Error("invalid image was written")
+	}
+}
+
+func TestStripMetadata_OrientedImageTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// IHDR rewritten to declare 100000x100000 pixels, the image data would
+	// be decoded only when the orientation is applied
+	b := buf.Bytes()
+	ihdr := append([]byte{}, b[16:29]...)
+	binary.BigEndian.PutUint32(ihdr[0:], 100000)
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+
+	exif := exifSegment(6)[4+6:]
+	src := append([]byte{}, b[:8]...)
+	src = append(src, pngChunk("IHDR", ihdr)...)
+	src = append(src, pngChunk("eXIf", exif)...)
+	src = append(src, b[33:]...)
+
+	var out bytes.Buffer
+	err := stripMetadata(&out, bytes.NewReader(src), "image/png")
+	if !errors.Is(err, errInvalidImage) || !strings.Contains(err.Error(), "pixels") {
+		t.Errorf("got error %v expected image with too many pixels", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Store keeps blobs as objects in a bucket of an S3 compatible service.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+type s3Options struct {
+	// host and optional port of the service, it must be reachable by clients
+	// as downloads are redirected to presigned URLs
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// use HTTPS
+	Secure bool
+	// optional, the default transport is used when nil
+	Transport http.RoundTripper
+}
+
+func newS3Store(opts s3Options) (*s3Store, error) {
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure:    opts.Secure,
+		Region:    opts.Region,
+		Transport: opts.Transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating S3 client: %w", err)
+	}
+
+	return &s3Store{client: client, bucket: opts.Bucket}, nil
+}
+
+// mapError wraps fs.ErrNotExist into errors caused by missing objects.
+func (s *s3Store) mapError(name string, err error) error {
+	if code := minio.ToErrorResponse(err).Code; code == minio.NoSuchKey {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return err
+}
+
+func (s *s3Store) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *s3Store) Open(ctx context.Context, name string) (io.ReadSeekCloser, BlobInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, BlobInfo{}, s.mapError(name, err)
+	}
+
+	// the object is fetched lazily, stat makes the first request
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, BlobInfo{}, s.mapError(name, err)
+	}
+
+	return obj, BlobInfo{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, name string) (BlobInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return BlobInfo{}, s.mapError(name, err)
+	}
+	return BlobInfo{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	return s.mapError(name, s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}))
+}
+
+func (s *s3Store) List(ctx context.Context) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		blobs = append(blobs, BlobInfo{Name: obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return blobs, nil
+}
+
+func (s *s3Store) PresignGet(ctx context.Context, name string, expiry time.Duration, params url.Values) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, name, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
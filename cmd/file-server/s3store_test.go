@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+// fakeS3 is an in-memory stand-in of an S3 compatible service handling
+// object requests made by the store. Signatures are not verified.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]fakeObject
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case "PUT":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = fakeObject{data, r.Header.Get("Content-Type"), time.Now().UTC().Truncate(time.Second)}
+		w.Header().Set("ETag", etag(data))
+		w.WriteHeader(http.StatusOK)
+	case "GET", "HEAD":
+		if key == "" && r.URL.Query().Get("list-type") == "2" {
+			s.list(w)
+			return
+		}
+
+		obj, ok := s.objects[key]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(obj.data))
+		w.Header().Set("Content-Type", obj.contentType)
+		http.ServeContent(w, r, key, obj.modTime, bytes.NewReader(obj.data))
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter) {
+	type content struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: s.bucket}
+
+	for _, key := range slices.Sorted(maps.Keys(s.objects)) {
+		obj := s.objects[key]
+		result.Contents = append(result.Contents, content{key, obj.modTime, etag(obj.data), int64(len(obj.data))})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, "<Error><Code>"+code+"</Code><Message>"+code+"</Message></Error>")
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// newFakeS3Store returns a store backed by the fake service.
+func newFakeS3Store(t *testing.T) (*s3Store, *fakeS3) {
+	fake := &fakeS3{bucket: "files", objects: map[string]fakeObject{}}
+	srv := httptest.NewTLSServer(fake)
+	t.Cleanup(srv.Close)
+
+	store, err := newS3Store(s3Options{
+		Endpoint:  strings.TrimPrefix(srv.URL, "https://"),
+		Bucket:    "files",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Secure:    true,
+		Transport: srv.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+func TestS3Store_NotFound(t *testing.T) {
+	store, _ := newFakeS3Store(t)
+	blobs = store
+	t.Cleanup(func() { blobs = nil })
+
+	if _, err := addRef(t.Context(), strings.Repeat("a", 64)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected missing metadata to be reported as not existing, got %v", err)
+	}
+}
+
+func TestS3Store_RedirectsToPresignedURL(t *testing.T) {
+	setupStorage(t, "s3")
+	_, meta := upload(t, "hello world")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{filename}", handleGet)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/"+meta.Name, nil))
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("get returned %d expected redirect", rec.Code)
+	}
+
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loc.Path != "/files/"+meta.Name {
+		t.Errorf("redirected to %s", loc.Path)
+	}
+	q := loc.Query()
+	if q.Get("X-Amz-Signature") == "" || q.Get("X-Amz-Expires") != "900" {
+		t.Errorf("URL is not presigned: %s", loc)
+	}
+	if q.Get("response-content-disposition") != "attachment" {
+		t.Error("text file is not served as attachment")
+	}
+	if q.Get("response-cache-control") != immutableCacheControl {
+		t.Errorf("presigned URL overrides cache control with %q", q.Get("response-cache-control"))
+	}
+}
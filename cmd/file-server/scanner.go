@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+)
+
+/*
+
+With a scanner configured new files are quarantined, their metadata has
+the pending scan status and they aren't served until a scan marks them
+clean. Infected files are kept in quarantine, so the same content uploaded
+again is rejected right away, and they are removed with their last reference
+like any other file.
+
+Scans run in background after the upload. Files left pending by a failed
+scan or a restart are scanned again periodically. A file the daemon refuses
+to scan, or one failing maxScanAttempts scans, is marked failed and stays in
+quarantine for good, so messages with it don't wait for the scan forever.
+
+The daemon reads streams up to its StreamMaxLength, 25 MB by default, while
+resumable uploads may be much larger. Uploads over the max-scan-size flag,
+which should match the daemon, are rejected when scanning is enabled. Files
+stored before the limit was lowered are marked failed without a scan.
+
+*/
+
+type scanStatus string
+
+const (
+	scanPending  scanStatus = "pending"
+	scanClean    scanStatus = "clean"
+	scanInfected scanStatus = "infected"
+	// the file couldn't be scanned and is never served
+	scanFailed scanStatus = "failed"
+)
+
+// maxScanAttempts limits scans of a file failing with errors which may
+// be temporary, like the daemon being unreachable.
+const maxScanAttempts = 5
+
+// errScanRefused is returned when the daemon replies with an error,
+// scanning the same content again won't succeed.
+var errScanRefused = errors.New("scan refused")
+
+// Scanner checks file contents for malware.
+type Scanner interface {
+	// Scan reads the content and returns the name of the found malware,
+	// empty if the content is clean.
+	Scan(ctx context.Context, r io.Reader) (string, error)
+}
+
+// scanner checks new files, scanning is disabled when nil.
+var scanner Scanner
+
+// clamdScanner streams contents to the ClamAV daemon with the INSTREAM command.
+type clamdScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+// clamdChunkSize must not exceed StreamMaxLength of the daemon, which is
+// checked against the whole stream anyway.
+const clamdChunkSize = 64 << 10
+
+func (s *clamdScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return "", fmt.Errorf("connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// the z prefix makes the daemon use null terminated lines
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("sending command: %w", err)
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				// the daemon closes the connection when the size limit
+				// is exceeded, the reason is in the reply
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("reading content: %w", err)
+		}
+	}
+	// zero length chunk ends the stream
+	conn.Write([]byte{0, 0, 0, 0})
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("reading reply: %w", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply reads replies like "stream: OK" or
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("%w: clamd: %s", errScanRefused, reply)
+	}
+}
+
+// scanning holds hashes of files being scanned.
+var scanning sync.Map
+
+// startScan scans the file in background unless it's being scanned already.
+func startScan(ctx context.Context, hash string) {
+	if _, busy := scanning.LoadOrStore(hash, true); busy {
+		return
+	}
+
+	go func() {
+		defer scanning.Delete(hash)
+		if err := scanFile(ctx, hash); err != nil {
+			log.Ctx(ctx).Error("failed to scan file", slog.String("hash", hash), slog.Any("error", err))
+		}
+	}()
+}
+
+// scanFile scans the pending file and releases or keeps it in quarantine.
+func scanFile(ctx context.Context, hash string) error {
+	meta, err := readMeta(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if meta.Scan != scanPending {
+		return nil
+	}
+
+	var signature string
+	if meta.Size > cfg.maxScanSize {
+		err = fmt.Errorf("%w: file exceeds %d bytes", errScanRefused, cfg.maxScanSize)
+	} else {
+		var content io.ReadCloser
+		content, _, err = blobs.Open(ctx, meta.Name)
+		if err != nil {
+			return err
+		}
+		signature, err = scanner.Scan(ctx, content)
+		content.Close()
+	}
+
+	refsMu.Lock()
+	defer refsMu.Unlock()
+
+	// the file may have been deleted during the scan
+	meta, err2 := readMeta(ctx, hash)
+	if err2 != nil {
+		return errors.Join(err, err2)
+	}
+
+	switch {
+	case err != nil:
+		meta.ScanAttempts++
+		if errors.Is(err, errScanRefused) || meta.ScanAttempts >= maxScanAttempts {
+			meta.Scan = scanFailed
+			meta.ScanError = err.Error()
+			log.Ctx(ctx).Warn("file couldn't be scanned", slog.String("name", meta.Name), slog.Any("error", err))
+		}
+		if werr := writeMeta(ctx, meta); werr != nil {
+			return errors.Join(err, werr)
+		}
+		return err
+	case signature != "":
+		meta.Scan = scanInfected
+		meta.Signature = signature
+		log.Ctx(ctx).Warn("infected file quarantined", slog.String("name", meta.Name), slog.String("signature", signature))
+	default:
+		meta.Scan = scanClean
+	}
+	return writeMeta(ctx, meta)
+}
+
+// scanPendingFiles starts scans of all pending files.
+func scanPendingFiles(ctx context.Context) error {
+	blobInfos, err := blobs.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range blobInfos {
+		hash, ok := strings.CutPrefix(info.Name, metaDir+"/")
+		if !ok {
+			continue
+		}
+
+		meta, err := readMeta(ctx, strings.TrimSuffix(hash, ".json"))
+		if err != nil {
+			log.Ctx(ctx).Warn("failed to read metadata", slog.String("name", info.Name), slog.Any("error", err))
+			continue
+		}
+		if meta.Scan == scanPending {
+			startScan(ctx, meta.Hash)
+		}
+	}
+	return nil
+}
+
+// rescanPendingFiles periodically scans files left pending.
+func rescanPendingFiles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := scanPendingFiles(ctx); err != nil {
+			log.Ctx(ctx).Error("failed to list pending files", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+)
+
+// fakeClamd serves the INSTREAM command, streams containing EICAR are
+// reported infected. Replies wait for the release channel when it's set.
+func fakeClamd(t *testing.T, release <-chan struct{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn, release)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serveClamd(conn net.Conn, release <-chan struct{}) {
+	defer conn.Close()
+
+	cmd := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var content bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&content, conn, int64(size)); err != nil {
+			return
+		}
+	}
+
+	if release != nil {
+		<-release
+	}
+
+	if bytes.Contains(content.Bytes(), []byte("TOOBIG")) {
+		conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+	} else if bytes.Contains(content.Bytes(), []byte("EICAR")) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+	} else {
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	s := &clamdScanner{addr: fakeClamd(t, nil), timeout: time.Second}
+
+	tests := []struct {
+		name      string
+		content   string
+		signature string
+	}{
+		{"clean", "hello world", ""},
+		{"infected", "hello EICAR world", "Eicar-Test-Signature"},
+		// larger than a single chunk
+		{"chunked", strings.Repeat("a", clamdChunkSize) + "EICAR", "Eicar-Test-Signature"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, err := s.Scan(t.Context(), strings.NewReader(tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signature != tt.signature {
+				t.Errorf("got signature %q expected %q", signature, tt.signature)
+			}
+		})
+	}
+}
+
+func TestParseClamdReply_Error(t *testing.T) {
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("error reply parsed as result")
+	}
+}
+
+func setupScanner(t *testing.T, release <-chan struct{}) {
+	setupStorage(t, "local")
+	cfg.maxScanSize = 1 << 10
+	scanner = &clamdScanner{addr: fakeClamd(t, release), timeout: time.Second}
+	t.Cleanup(func() { scanner = nil })
+}
+
+// waitForScan waits until the file is no longer pending.
+func waitForScan(t *testing.T, hash string) *fileMeta {
+	for range 100 {
+		meta, err := readMeta(t.Context(), hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Scan != scanPending {
+			return meta
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("file is still pending")
+	return nil
+}
+
+func getFile(name string) int {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{filename}", handleGet)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/"+name, nil))
+	return rec.Code
+}
+
+func TestScan_QuarantinesUntilClean(t *testing.T) {
+	release := make(chan struct{})
+	setupScanner(t, release)
+
+	_, meta := upload(t, "hello world")
+	if meta.Scan != scanPending {
+		t.Fatalf("uploaded file has scan status %q", meta.Scan)
+	}
+	if code := getFile(meta.Name); code != http.StatusForbidden {
+		t.Errorf("pending file returned %d expected %d", code, http.StatusForbidden)
+	}
+
+	close(release)
+	if meta := waitForScan(t, meta.Hash); meta.Scan != scanClean {
+		t.Fatalf("scanned file has status %q", meta.Scan)
+	}
+	if code := getFile(meta.Name); code != http.StatusOK {
+		t.Errorf("clean file returned %d expected %d", code, http.StatusOK)
+	}
+}
+
+func TestScan_KeepsInfectedInQuarantine(t *testing.T) {
+	setupScanner(t, nil)
+
+	_, meta := upload(t, "hello EICAR world")
+	scanned := waitForScan(t, meta.Hash)
+	if scanned.Scan != scanInfected || scanned.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("scanned file has status %q with signature %q", scanned.Scan, scanned.Signature)
+	}
+	if code := getFile(meta.Name); code != http.StatusForbidden {
+		t.Errorf("infected file returned %d expected %d", code, http.StatusForbidden)
+	}
+
+	// known infected content is reported without another scan
+	if _, again := upload(t, "hello EICAR world"); again.Scan != scanInfected {
+		t.Errorf("upload of infected content has status %q", again.Scan)
+	}
+}
+
+func TestScan_RefusedFileFails(t *testing.T) {
+	setupScanner(t, nil)
+
+	_, meta := upload(t, "hello TOOBIG world")
+	scanned := waitForScan(t, meta.Hash)
+	if scanned.Scan != scanFailed || scanned.ScanError == "" {
+		t.Fatalf("refused file has status %q with error %q", scanned.Scan, scanned.ScanError)
+	}
+	if code := getFile(meta.Name); code != http.StatusForbidden {
+		t.Errorf("unscanned file returned %d expected %d", code, http.StatusForbidden)
+	}
+
+	// failed files aren't scanned again
+	scanPendingFiles(t.Context())
+	if _, busy := scanning.Load(meta.Hash); busy {
+		t.Error("failed file is scanned again")
+	}
+}
+
+type failingScanner struct{}
+
+func (failingScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func TestScan_FailsAfterMaxAttempts(t *testing.T) {
+	setupScanner(t, nil)
+	scanner = failingScanner{}
+	ctx := log.WithContext(t.Context(), slog.New(slog.DiscardHandler))
+
+	_, meta := upload(t, "hello world")
+	// the scan started by the upload
+	for range 100 {
+		if _, busy := scanning.Load(meta.Hash); !busy {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for attempt := 2; attempt <= maxScanAttempts; attempt++ {
+		stored, err := readMeta(t.Context(), meta.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Scan != scanPending {
+			t.Fatalf("file has status %q after %d attempts", stored.Scan, stored.ScanAttempts)
+		}
+		if err := scanFile(ctx, meta.Hash); err == nil {
+			t.Fatal("expected scan error")
+		}
+	}
+
+	stored, err := readMeta(t.Context(), meta.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Scan != scanFailed || stored.ScanAttempts != maxScanAttempts {
+		t.Errorf("file has status %q after %d attempts", stored.Scan, stored.ScanAttempts)
+	}
+}
+
+func TestScan_RejectsFilesTooLargeToScan(t *testing.T) {
+	setupScanner(t, nil)
+	content := strings.Repeat("a", int(cfg.maxScanSize)+1)
+
+	var body bytes.Buffer
+	wr := multipart.NewWriter(&body)
+	part, _ := wr.CreateFormFile("file", "note.txt")
+	part.Write([]byte(content))
+	wr.Close()
+
+	req := httptest.NewRequest("POST", "/", &body)
+	req.Header.Set("Content-Type", wr.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handleUpload(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload returned %d expected %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	req = httptest.NewRequest("POST", "/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(len(content)))
+	rec = httptest.NewRecorder()
+	handleCreateUpload(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("resumable upload returned %d expected %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
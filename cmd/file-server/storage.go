@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Files are content addressed. A file is stored under the hex encoded SHA-256
+of the uploaded bytes followed by the extension of its media type, so the
+same content uploaded many times is stored once and names never collide
+between instances sharing the store.
+
+Every stored file has a metadata record in the hidden .meta prefix, keyed
+by the hash, holding the number of references to the file. An upload of
+known content or a request to the refs endpoint adds a reference, deleting
+the file removes one and the file with its variants is removed with the last
+reference.
+
+NOTE: reference counts are guarded by an in-process mutex, so only a single
+instance of the file server may run against a store. Instances sharing
+a store would race on the same record and lose references, which needs
+a shared lock or a metadata store supporting atomic updates to fix.
+
+*/
+
+const metaDir = ".meta"
+
+// blobs keeps stored files, their variants and metadata.
+var blobs BlobStore
+
+var refsMu sync.Mutex
+
+// fileMeta describes a stored file, it's also the upload response.
+type fileMeta struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	MIME      string    `json:"mime"`
+	Size      int64     `json:"size"`
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+	Duration  float64   `json:"duration,omitempty"` // seconds of audio and video
+	Refs      int       `json:"refs"`
+	CreatedAt time.Time `json:"createdAt"`
+	// time of the last upload of the content or request to the refs endpoint
+	LastRefAt time.Time `json:"lastRefAt"`
+	// empty for files stored without scanning
+	Scan scanStatus `json:"scan,omitempty"`
+	// name of the malware found in infected files
+	Signature string `json:"signature,omitempty"`
+	// failed scans of the file and the error of the last one
+	ScanAttempts int    `json:"scanAttempts,omitempty"`
+	ScanError    string `json:"scanError,omitempty"`
+}
+
+// quarantined reports whether the file must not be served.
+func (m *fileMeta) quarantined() bool {
+	return m.Scan == scanPending || m.Scan == scanInfected || m.Scan == scanFailed
+}
+
+// validHash reports whether s is a hex encoded SHA-256 hash.
+func validHash(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// fileHash returns the hash part of the stored file name.
+func fileHash(fname string) string {
+	stem, _, _ := strings.Cut(fname, ".")
+	return stem
+}
+
+func metaName(hash string) string {
+	return metaDir + "/" + hash + ".json"
+}
+
+func readMeta(ctx context.Context, hash string) (*fileMeta, error) {
+	r, _, err := blobs.Open(ctx, metaName(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var meta fileMeta
+	if err := json.NewDecoder(r).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("decoding metadata of %s: %w", hash, err)
+	}
+	return &meta, nil
+}
+
+func writeMeta(ctx context.Context, meta *fileMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return blobs.Put(ctx, metaName(meta.Hash), bytes.NewReader(b), int64(len(b)), "application/json")
+}
+
+// addRef adds a reference to the stored file with the hash.
+// Returns an error wrapping fs.ErrNotExist if there is no such file.
+func addRef(ctx context.Context, hash string) (*fileMeta, error) {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+
+	meta, err := readMeta(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Refs++
+	meta.LastRefAt = time.Now()
+	if err := writeMeta(ctx, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// storeFile stores the content under its content addressed name.
+// If the content is already stored a reference is added to the existing
+// file instead.
+//
+// Returns whether the file was newly created.
+func storeFile(ctx context.Context, content io.Reader, meta *fileMeta) (*fileMeta, bool, error) {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+
+	if existing, err := readMeta(ctx, meta.Hash); err == nil {
+		existing.Refs++
+		existing.LastRefAt = time.Now()
+		if err := writeMeta(ctx, existing); err != nil {
+			return nil, false, err
+		}
+		return existing, false, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, err
+	}
+
+	if err := blobs.Put(ctx, meta.Name, content, meta.Size, meta.MIME); err != nil {
+		return nil, false, err
+	}
+
+	meta.Refs = 1
+	meta.CreatedAt = time.Now()
+	meta.LastRefAt = meta.CreatedAt
+	if err := writeMeta(ctx, meta); err != nil {
+		return nil, false, err
+	}
+	return meta, true, nil
+}
+
+// releaseFile removes a reference to the stored file and deletes the file
+// with its variants when no references are left, or right away when forced.
+// Files stored before content addressing have no metadata and are deleted
+// right away too.
+//
+// Returns whether the file was deleted.
+func releaseFile(ctx context.Context, fname string, force bool) (bool, error) {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+
+	if _, err := blobs.Stat(ctx, fname); err != nil {
+		return false, err
+	}
+
+	hash := fileHash(fname)
+	meta, err := readMeta(ctx, hash)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	if meta != nil && meta.Refs > 1 && !force {
+		meta.Refs--
+		return false, writeMeta(ctx, meta)
+	}
+
+	for size := range imageVariants {
+		blobs.Delete(ctx, variantFilename(fname, size))
+	}
+	if err := blobs.Delete(ctx, fname); err != nil {
+		return false, err
+	}
+	if meta != nil {
+		if err := blobs.Delete(ctx, metaName(hash)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// storedFile describes a file in the administrative listing.
+type storedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// zero for files stored before content addressing
+	Refs int `json:"refs"`
+	// time the file was stored or last referenced
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// isVariant reports whether the blob is a resized variant of an image.
+func isVariant(name string) bool {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	for size := range imageVariants {
+		if strings.HasSuffix(stem, "_"+size) {
+			return true
+		}
+	}
+	return false
+}
+
+// listFiles returns stored files without their variants and internal blobs.
+func listFiles(ctx context.Context) ([]storedFile, error) {
+	blobInfos, err := blobs.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []storedFile{}
+	for _, info := range blobInfos {
+		if strings.HasPrefix(info.Name, ".") || strings.Contains(info.Name, "/") || isVariant(info.Name) {
+			continue
+		}
+
+		file := storedFile{Name: info.Name, Size: info.Size, LastUsedAt: info.ModTime}
+		if meta, err := readMeta(ctx, fileHash(info.Name)); err == nil {
+			file.Refs = meta.Refs
+			if meta.LastRefAt.After(file.LastUsedAt) {
+				file.LastUsedAt = meta.LastRefAt
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+	return files, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+	"github.com/ellezio/Chat-app-with-Go/internal/signedurl"
+)
+
+var testStorages = []string{"local", "s3"}
+
+func setupStorage(t *testing.T, storage string) {
+	prev := cfg
+	cfg = config{
+		storage:       storage,
+		allowedTypes:  []string{"text/plain"},
+		adminToken:    "secret",
+		presignExpiry: 15 * time.Minute,
+	}
+	t.Cleanup(func() {
+		cfg = prev
+		blobs = nil
+	})
+
+	switch storage {
+	case "local":
+		store, err := newLocalStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs = store
+	case "s3":
+		blobs, _ = newFakeS3Store(t)
+	}
+}
+
+func exists(t *testing.T, name string) bool {
+	_, err := blobs.Stat(t.Context(), name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func upload(t *testing.T, content string) (int, fileMeta) {
+	var body bytes.Buffer
+	wr := multipart.NewWriter(&body)
+	part, _ := wr.CreateFormFile("file", "note.txt")
+	part.Write([]byte(content))
+	wr.Close()
+
+	req := httptest.NewRequest("POST", "/", &body)
+	req = req.WithContext(log.WithContext(req.Context(), slog.New(slog.DiscardHandler)))
+	req.Header.Set("Content-Type", wr.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handleUpload(rec, req)
+
+	var meta fileMeta
+	if err := json.NewDecoder(rec.Body).Decode(&meta); err != nil {
+		t.Fatalf("decoding response with status %d: %v", rec.Code, err)
+	}
+	return rec.Code, meta
+}
+
+// deleteFile returns the status of the deletion and whether the file
+// was removed.
+func deleteFile(name string) (int, bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /{filename}", handleDelete)
+
+	req := httptest.NewRequest("DELETE", "/"+name, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec.Code, rec.Header().Get("File-Deleted") == "true"
+}
+
+func TestUpload_Deduplicates(t *testing.T) {
+	for _, storage := range testStorages {
+		t.Run(storage, func(t *testing.T) {
+			setupStorage(t, storage)
+			testUploadDeduplicates(t)
+		})
+	}
+}
+
+func testUploadDeduplicates(t *testing.T) {
+	status, first := upload(t, "hello world")
+	if status != http.StatusCreated {
+		t.Fatalf("first upload returned %d expected %d", status, http.StatusCreated)
+	}
+
+	const expectedHash = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	if first.Hash != expectedHash || first.Name != expectedHash+".txt" {
+		t.Errorf("file stored as %s with hash %s", first.Name, first.Hash)
+	}
+
+	status, second := upload(t, "hello world")
+	if status != http.StatusOK {
+		t.Errorf("second upload returned %d expected %d", status, http.StatusOK)
+	}
+	if second.Name != first.Name || second.Refs != 2 {
+		t.Errorf("second upload stored as %s with %d refs", second.Name, second.Refs)
+	}
+
+	if !exists(t, first.Name) || !exists(t, metaName(first.Hash)) {
+		t.Error("file or its metadata is not stored")
+	}
+}
+
+func TestDelete_RemovesWithLastReference(t *testing.T) {
+	for _, storage := range testStorages {
+		t.Run(storage, func(t *testing.T) {
+			setupStorage(t, storage)
+			testDeleteRemovesWithLastReference(t)
+		})
+	}
+}
+
+func testDeleteRemovesWithLastReference(t *testing.T) {
+	upload(t, "hello world")
+	_, meta := upload(t, "hello world")
+
+	if code, deleted := deleteFile(meta.Name); code != http.StatusNoContent || deleted {
+		t.Fatalf("delete returned %d, deleted %v", code, deleted)
+	}
+	if !exists(t, meta.Name) {
+		t.Fatal("file removed while still referenced")
+	}
+
+	if code, deleted := deleteFile(meta.Name); code != http.StatusNoContent || !deleted {
+		t.Fatalf("delete returned %d, deleted %v", code, deleted)
+	}
+	if exists(t, meta.Name) {
+		t.Error("file left after removing the last reference")
+	}
+	if exists(t, metaName(meta.Hash)) {
+		t.Error("metadata left after removing the last reference")
+	}
+
+	if code, _ := deleteFile(meta.Name); code != http.StatusNotFound {
+		t.Errorf("deleting removed file returned %d", code)
+	}
+}
+
+func TestDelete_RequiresAdminToken(t *testing.T) {
+	setupStorage(t, "local")
+	_, meta := upload(t, "hello world")
+
+	req := httptest.NewRequest("DELETE", "/"+meta.Name, nil)
+	req.SetPathValue("filename", meta.Name)
+	rec := httptest.NewRecorder()
+	handleDelete(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("delete without token returned %d", rec.Code)
+	}
+}
+
+func TestAddRef_RequiresAdminToken(t *testing.T) {
+	setupStorage(t, "local")
+	_, meta := upload(t, "hello world")
+	hash := strings.TrimSuffix(meta.Name, path.Ext(meta.Name))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /refs/{hash}", handleAddRef)
+	addRef := func(token string) int {
+		req := httptest.NewRequest("POST", "/refs/"+hash, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := addRef(""); code != http.StatusForbidden {
+		t.Errorf("request without token returned %d", code)
+	}
+	if code := addRef("wrong"); code != http.StatusForbidden {
+		t.Errorf("request with wrong token returned %d", code)
+	}
+	if stored, err := readMeta(t.Context(), hash); err != nil || stored.Refs != 1 {
+		t.Fatalf("rejected requests changed refs of %+v, error %v", stored, err)
+	}
+
+	if code := addRef("secret"); code != http.StatusOK {
+		t.Errorf("request with token returned %d", code)
+	}
+	if stored, err := readMeta(t.Context(), hash); err != nil || stored.Refs != 2 {
+		t.Errorf("got %+v with error %v expected 2 refs", stored, err)
+	}
+}
+
+func TestGet_RequiresSignedURL(t *testing.T) {
+	setupStorage(t, "local")
+	cfg.signingKey = "secret"
+	_, meta := upload(t, "hello world")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{filename}", handleGet)
+	get := func(target string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec.Code
+	}
+
+	if code := get("/" + meta.Name); code != http.StatusForbidden {
+		t.Errorf("unsigned request returned %d expected %d", code, http.StatusForbidden)
+	}
+
+	query := signedurl.New([]byte("secret"), time.Minute).Query(meta.Name)
+	if code := get("/" + meta.Name + "?" + query.Encode()); code != http.StatusOK {
+		t.Errorf("signed request returned %d expected %d", code, http.StatusOK)
+	}
+
+	other := signedurl.New([]byte("secret"), time.Minute).Query("other.txt")
+	if code := get("/" + meta.Name + "?" + other.Encode()); code != http.StatusForbidden {
+		t.Errorf("request signed for other file returned %d expected %d", code, http.StatusForbidden)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	for _, storage := range testStorages {
+		t.Run(storage, func(t *testing.T) {
+			setupStorage(t, storage)
+			_, meta := upload(t, "hello world")
+			upload(t, "hello world")
+
+			ctx := t.Context()
+			// a variant and a file stored before content addressing
+			blobs.Put(ctx, variantFilename(meta.Name, "thumb"), strings.NewReader("v"), 1, "text/plain")
+			blobs.Put(ctx, "1700000000_0.txt", strings.NewReader("old"), 3, "text/plain")
+
+			files, err := listFiles(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(files) != 2 {
+				t.Fatalf("listed %+v expected the uploaded and the old file", files)
+			}
+			for _, f := range files {
+				switch f.Name {
+				case meta.Name:
+					if f.Refs != 2 || f.Size != meta.Size {
+						t.Errorf("uploaded file listed as %+v", f)
+					}
+				case "1700000000_0.txt":
+					if f.Refs != 0 || f.LastUsedAt.IsZero() {
+						t.Errorf("old file listed as %+v", f)
+					}
+				default:
+					t.Errorf("unexpected file %s", f.Name)
+				}
+			}
+		})
+	}
+}
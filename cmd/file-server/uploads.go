@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+)
+
+/*
+
+Resumable uploads follow the core of the tus protocol. An upload is created
+with its total length, then the content is sent in any number of PATCH
+requests each starting at the current offset, which can be read with HEAD
+after a broken connection. Chunks sent with the Upload-Checksum header are
+verified and discarded on mismatch, chunks without it are kept up to the byte
+received.
+
+When the last byte arrives the content goes through the same processing as
+a regular upload and the response of the last PATCH describes the stored file.
+Uploads with no activity for the expiry duration are removed.
+
+NOTE: partial uploads are kept on the local disk of the instance, so with
+many instances the requests of one upload must reach the same instance.
+
+*/
+
+// checksumMismatch is the status used by tus when the chunk checksum doesn't match.
+const checksumMismatch = 460
+
+const offsetContentType = "application/offset+octet-stream"
+
+// resumableUpload describes the state of an upload, the offset is the size
+// of its data file.
+type resumableUpload struct {
+	Id     string `json:"id"`
+	Length int64  `json:"length"`
+	// opaque value of the Upload-Metadata header sent on creation
+	Metadata  string    `json:"metadata"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// uploadLocks holds ids of uploads being written to.
+var uploadLocks sync.Map
+
+func lockUpload(id string) bool {
+	_, locked := uploadLocks.LoadOrStore(id, struct{}{})
+	return !locked
+}
+
+func unlockUpload(id string) {
+	uploadLocks.Delete(id)
+}
+
+func validUploadId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+func uploadDataPath(id string) string {
+	return filepath.Join(cfg.uploadDir, id)
+}
+
+func uploadInfoPath(id string) string {
+	return filepath.Join(cfg.uploadDir, id+".json")
+}
+
+func readUpload(id string) (*resumableUpload, error) {
+	b, err := os.ReadFile(uploadInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var u resumableUpload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().After(u.ExpiresAt) {
+		return nil, fs.ErrNotExist
+	}
+	return &u, nil
+}
+
+func writeUpload(u *resumableUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	tmp := uploadInfoPath(u.Id) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, uploadInfoPath(u.Id))
+}
+
+func removeUpload(id string) {
+	os.Remove(uploadDataPath(id))
+	os.Remove(uploadInfoPath(id))
+}
+
+func setUploadHeaders(w http.ResponseWriter, u *resumableUpload, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > cfg.maxUploadSize {
+		http.Error(w, "file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if tooLargeToScan(length) {
+		http.Error(w, "file is too large to be scanned", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	if len(metadata) > 4096 {
+		http.Error(w, "Upload-Metadata is too long", http.StatusBadRequest)
+		return
+	}
+
+	u := &resumableUpload{
+		Id:        newUploadId(),
+		Length:    length,
+		Metadata:  metadata,
+		ExpiresAt: time.Now().Add(cfg.uploadExpiry),
+	}
+
+	if err := os.WriteFile(uploadDataPath(u.Id), nil, 0644); err != nil {
+		log.Ctx(r.Context()).Error("failed to create upload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeUpload(u); err != nil {
+		removeUpload(u.Id)
+		log.Ctx(r.Context()).Error("failed to create upload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setUploadHeaders(w, u, 0)
+	w.Header().Set("Location", "/uploads/"+u.Id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func newUploadId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !validUploadId(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	u, err := readUpload(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	info, err := os.Stat(uploadDataPath(id))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	setUploadHeaders(w, u, info.Size())
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseChecksum parses the Upload-Checksum header, only sha256 is supported.
+func parseChecksum(header string) (hash.Hash, []byte, bool) {
+	algo, encoded, ok := strings.Cut(header, " ")
+	if !ok || algo != "sha256" {
+		return nil, nil, false
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, nil, false
+	}
+	return sha256.New(), sum, true
+}
+
+func handlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	logger := log.Ctx(r.Context())
+
+	id := r.PathValue("id")
+	if !validUploadId(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Header.Get("Content-Type") != offsetContentType {
+		http.Error(w, "content type must be "+offsetContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	var checksum hash.Hash
+	var expectedSum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		var ok bool
+		if checksum, expectedSum, ok = parseChecksum(header); !ok {
+			http.Error(w, "unsupported Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !lockUpload(id) {
+		http.Error(w, "upload is in progress", http.StatusLocked)
+		return
+	}
+	defer unlockUpload(id)
+
+	u, err := readUpload(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := os.OpenFile(uploadDataPath(id), os.O_RDWR, 0)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer data.Close()
+
+	info, err := data.Stat()
+	if err != nil {
+		logger.Error("failed to stat upload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if offset != info.Size() {
+		setUploadHeaders(w, u, info.Size())
+		http.Error(w, "Upload-Offset doesn't match the upload", http.StatusConflict)
+		return
+	}
+
+	if _, err := data.Seek(offset, io.SeekStart); err != nil {
+		logger.Error("failed to seek upload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var body io.Reader = io.LimitReader(r.Body, u.Length-offset)
+	if checksum != nil {
+		body = io.TeeReader(body, checksum)
+	}
+
+	n, err := io.Copy(data, body)
+	if err != nil || (checksum != nil && !bytes.Equal(checksum.Sum(nil), expectedSum)) {
+		// only verified chunks are kept, unverified are kept up to the byte received
+		if checksum != nil {
+			data.Truncate(offset)
+			n = 0
+		}
+
+		if err == nil {
+			setUploadHeaders(w, u, offset)
+			http.Error(w, "checksum mismatch", checksumMismatch)
+			return
+		}
+
+		logger.Warn("upload interrupted", slog.String("id", id), slog.Int64("received", n), slog.Any("error", err))
+		setUploadHeaders(w, u, offset+n)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset += n
+
+	u.ExpiresAt = time.Now().Add(cfg.uploadExpiry)
+	if err := writeUpload(u); err != nil {
+		logger.Error("failed to update upload", slog.Any("error", err))
+	}
+
+	if offset < u.Length {
+		setUploadHeaders(w, u, offset)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		logger.Error("failed to seek upload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// on failure the upload is kept complete, so an empty PATCH at the end
+	// retries processing
+	meta, created, err := processUpload(r.Context(), data)
+	if err != nil {
+		// invalid content won't get valid by retrying
+		if errors.Is(err, errEmptyFile) || errors.Is(err, errInvalidMediaType) || errors.Is(err, errInvalidImage) {
+			removeUpload(id)
+		}
+		writeUploadError(w, r, err)
+		return
+	}
+	removeUpload(id)
+
+	setUploadHeaders(w, u, offset)
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, meta)
+}
+
+func handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !validUploadId(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !lockUpload(id) {
+		http.Error(w, "upload is in progress", http.StatusLocked)
+		return
+	}
+	defer unlockUpload(id)
+
+	if _, err := os.Stat(uploadInfoPath(id)); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	removeUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireUploads removes uploads with no activity for the expiry duration
+// every interval until the context is done.
+func expireUploads(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removeExpiredUploads(ctx)
+		}
+	}
+}
+
+func removeExpiredUploads(ctx context.Context) {
+	entries, err := os.ReadDir(cfg.uploadDir)
+	if err != nil {
+		log.Ctx(ctx).Error("failed to list uploads", slog.Any("error", err))
+		return
+	}
+
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validUploadId(id) || !lockUpload(id) {
+			continue
+		}
+
+		if _, err := readUpload(id); errors.Is(err, fs.ErrNotExist) {
+			log.Ctx(ctx).Info("removing expired upload", slog.String("id", id))
+			removeUpload(id)
+		}
+		unlockUpload(id)
+	}
+}
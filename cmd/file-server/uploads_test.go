@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+)
+
+func setupUploads(t *testing.T) *http.ServeMux {
+	setupStorage(t, "local")
+	cfg.uploadDir = t.TempDir()
+	cfg.uploadExpiry = time.Hour
+	cfg.maxUploadSize = 1 << 20
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /uploads", handleCreateUpload)
+	mux.HandleFunc("HEAD /uploads/{id}", handleUploadStatus)
+	mux.HandleFunc("PATCH /uploads/{id}", handlePatchUpload)
+	return mux
+}
+
+func createUpload(t *testing.T, mux *http.ServeMux, length int) string {
+	req := httptest.NewRequest("POST", "/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "filename bm90ZS50eHQ=")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create returned %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Header().Get("Location")
+}
+
+func patchUpload(mux *http.ServeMux, location string, offset int, chunk string, checksum string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PATCH", location, strings.NewReader(chunk))
+	req.Header.Set("Content-Type", offsetContentType)
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	if checksum != "" {
+		req.Header.Set("Upload-Checksum", checksum)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func sha256Checksum(chunk string) string {
+	sum := sha256.Sum256([]byte(chunk))
+	return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func uploadOffset(t *testing.T, mux *http.ServeMux, location string) string {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("HEAD", location, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("head returned %d", rec.Code)
+	}
+	return rec.Header().Get("Upload-Offset")
+}
+
+func TestResumableUpload(t *testing.T) {
+	mux := setupUploads(t)
+	location := createUpload(t, mux, len("hello world"))
+
+	rec := patchUpload(mux, location, 0, "hello ", sha256Checksum("hello "))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("patch returned %d with offset %s", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+
+	if offset := uploadOffset(t, mux, location); offset != "6" {
+		t.Errorf("head reports offset %s expected 6", offset)
+	}
+
+	rec = patchUpload(mux, location, 6, "world", sha256Checksum("world"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("last patch returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Upload-Metadata") != "filename bm90ZS50eHQ=" {
+		t.Error("metadata is not returned with the stored file")
+	}
+
+	var meta fileMeta
+	if err := json.NewDecoder(rec.Body).Decode(&meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Hash != "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" || !exists(t, meta.Name) {
+		t.Errorf("file is not stored, got %+v", meta)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("HEAD", location, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("finished upload is still available, head returned %d", rec.Code)
+	}
+}
+
+func TestResumableUpload_ChecksumMismatch(t *testing.T) {
+	mux := setupUploads(t)
+	location := createUpload(t, mux, len("hello world"))
+
+	rec := patchUpload(mux, location, 0, "hello ", sha256Checksum("other"))
+	if rec.Code != checksumMismatch {
+		t.Fatalf("patch returned %d expected %d", rec.Code, checksumMismatch)
+	}
+
+	if offset := uploadOffset(t, mux, location); offset != "0" {
+		t.Errorf("chunk with invalid checksum was kept, offset is %s", offset)
+	}
+}
+
+func TestResumableUpload_OffsetMismatch(t *testing.T) {
+	mux := setupUploads(t)
+	location := createUpload(t, mux, len("hello world"))
+	patchUpload(mux, location, 0, "hello ", "")
+
+	rec := patchUpload(mux, location, 0, "hello ", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("patch at stale offset returned %d expected %d", rec.Code, http.StatusConflict)
+	}
+	if rec.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("conflict reports offset %s expected 6", rec.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestResumableUpload_TooLarge(t *testing.T) {
+	mux := setupUploads(t)
+
+	req := httptest.NewRequest("POST", "/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(2<<20))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("create returned %d expected %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	mux := setupUploads(t)
+	cfg.uploadExpiry = -time.Second
+	location := createUpload(t, mux, 10)
+	id := strings.TrimPrefix(location, "/uploads/")
+
+	removeExpiredUploads(log.WithContext(t.Context(), slog.New(slog.DiscardHandler)))
+
+	if _, err := os.Stat(uploadDataPath(id)); !os.IsNotExist(err) {
+		t.Error("expired upload data left")
+	}
+	if _, err := os.Stat(uploadInfoPath(id)); !os.IsNotExist(err) {
+		t.Error("expired upload info left")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/sync/singleflight"
+)
+
+// imageVariants maps variant names requested with the size parameter
+// to the maximum dimension of the resized image.
+var imageVariants = map[string]int{
+	"thumb":  200,
+	"medium": 800,
+}
+
+var variantGroup singleflight.Group
+
+// variantFilename returns the name under which the variant of the file is stored.
+// Variants of PNG images stay PNG to keep transparency, other images are
+// stored as JPEG.
+func variantFilename(fname, size string) string {
+	ext := path.Ext(fname)
+	stem := strings.TrimSuffix(fname, ext)
+	if ext != ".png" {
+		ext = ".jpeg"
+	}
+	return stem + "_" + size + ext
+}
+
+// imageDimensions reads width and height of the image without decoding it.
+func imageDimensions(r io.Reader) (width, height int, err error) {
+	c, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.Width, c.Height, nil
+}
+
+// variantName returns the name of the resized blob, generating it on first
+// request. If the image already fits the variant the original name is returned.
+// Animated GIFs are always served as original.
+func variantName(ctx context.Context, fname, size string) (string, error) {
+	maxDim, ok := imageVariants[size]
+	if !ok {
+		return "", fmt.Errorf("unknown size %q", size)
+	}
+
+	if !strings.HasPrefix(extensionMediaType(strings.TrimPrefix(path.Ext(fname), ".")), "image/") ||
+		path.Ext(fname) == ".gif" {
+		return fname, nil
+	}
+
+	dst := variantFilename(fname, size)
+	if _, err := blobs.Stat(ctx, dst); err == nil {
+		return dst, nil
+	}
+
+	if fits, err := fitsWithin(ctx, fname, maxDim); err != nil {
+		return "", err
+	} else if fits {
+		return fname, nil
+	}
+
+	_, err, _ := variantGroup.Do(dst, func() (any, error) {
+		// detached from the request, as other requests may wait for the result
+		return nil, generateVariant(context.WithoutCancel(ctx), fname, dst, maxDim)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+func fitsWithin(ctx context.Context, fname string, maxDim int) (bool, error) {
+	r, _, err := blobs.Open(ctx, fname)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	width, height, err := imageDimensions(r)
+	if err != nil {
+		return false, fmt.Errorf("decoding image config: %w", err)
+	}
+	if int64(width)*int64(height) > maxImagePixels {
+		return false, fmt.Errorf("%w: %dx%d is more than %d pixels", errInvalidImage, width, height, maxImagePixels)
+	}
+
+	return width <= maxDim && height <= maxDim, nil
+}
+
+func generateVariant(ctx context.Context, src, dst string, maxDim int) error {
+	r, _, err := blobs.Open(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// dimensions are checked before decoding allocates the image
+	if err := checkImagePixels(r); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return fmt.Errorf("decoding image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		height = max(1, height*maxDim/width)
+		width = maxDim
+	} else {
+		width = max(1, width*maxDim/height)
+		height = maxDim
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	if format != "png" {
+		// JPEG has no transparency, so transparent pixels are put on white
+		draw.Draw(resized, resized.Bounds(), image.White, image.Point{}, draw.Src)
+	}
+	draw.BiLinear.Scale(resized, resized.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	mediatype := "image/jpeg"
+	if format == "png" {
+		mediatype = "image/png"
+		err = png.Encode(&buf, resized)
+	} else {
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return fmt.Errorf("encoding variant: %w", err)
+	}
+
+	return blobs.Put(ctx, dst, &buf, int64(buf.Len()), mediatype)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func putTestImage(t *testing.T, name string, width, height int) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	var buf bytes.Buffer
+	var err error
+	if strings.HasSuffix(name, ".png") {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := blobs.Put(t.Context(), name, &buf, int64(buf.Len()), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVariantFilename(t *testing.T) {
+	tests := []struct {
+		fname    string
+		size     string
+		expected string
+	}{
+		{"1_0.png", "thumb", "1_0_thumb.png"},
+		{"1_0.jpg", "medium", "1_0_medium.jpeg"},
+		{"1_0.webp", "thumb", "1_0_thumb.jpeg"},
+	}
+
+	for _, tt := range tests {
+		if got := variantFilename(tt.fname, tt.size); got != tt.expected {
+			t.Errorf("variantFilename(%q, %q) = %q expected %q", tt.fname, tt.size, got, tt.expected)
+		}
+	}
+}
+
+func TestVariantName(t *testing.T) {
+	setupStorage(t, "local")
+	putTestImage(t, "big.png", 400, 100)
+	putTestImage(t, "small.jpg", 100, 50)
+	if err := blobs.Put(t.Context(), "notes.txt", strings.NewReader("text"), 4, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		fname    string
+		size     string
+		expected string
+	}{
+		{"resized", "big.png", "thumb", "big_thumb.png"},
+		{"fits the variant", "small.jpg", "thumb", "small.jpg"},
+		{"not an image", "notes.txt", "thumb", "notes.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := variantName(t.Context(), tt.fname, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expected {
+				t.Errorf("got %q expected %q", got, tt.expected)
+			}
+		})
+	}
+
+	if _, err := variantName(t.Context(), "big.png", "huge"); err == nil {
+		t.Error("expected unknown size to fail")
+	}
+}
+
+func TestGenerateVariant(t *testing.T) {
+	setupStorage(t, "local")
+	putTestImage(t, "wide.png", 400, 100)
+	putTestImage(t, "tall.jpg", 50, 300)
+
+	tests := []struct {
+		src, dst      string
+		width, height int
+	}{
+		{"wide.png", "wide_thumb.png", 200, 50},
+		{"tall.jpg", "tall_thumb.jpeg", 33, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			if err := generateVariant(t.Context(), tt.src, tt.dst, 200); err != nil {
+				t.Fatal(err)
+			}
+
+			r, _, err := blobs.Open(t.Context(), tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			width, height, err := imageDimensions(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if width != tt.width || height != tt.height {
+				t.Errorf("variant is %dx%d expected %dx%d", width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestGenerateVariant_Rejected(t *testing.T) {
+	setupStorage(t, "local")
+
+	if err := blobs.Put(t.Context(), "fake.png", strings.NewReader("not an image"), 12, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// a tiny PNG declaring 100000x100000 pixels in its header
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	ihdr := append([]byte{}, b[16:29]...)
+	binary.BigEndian.PutUint32(ihdr[0:], 100000)
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	bomb := append(append(append([]byte{}, b[:8]...), pngChunk("IHDR", ihdr)...), b[33:]...)
+	if err := blobs.Put(t.Context(), "bomb.png", bytes.NewReader(bomb), int64(len(bomb)), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fname := range []string{"fake.png", "bomb.png"} {
+		t.Run(fname, func(t *testing.T) {
+			if err := generateVariant(t.Context(), fname, "out.png", 200); err == nil {
+				t.Error("expected variant to fail")
+			}
+			if exists(t, "out.png") {
+				t.Error("variant stored")
+			}
+		})
+	}
+
+	if _, err := variantName(t.Context(), "bomb.png", "thumb"); !errors.Is(err, errInvalidImage) {
+		t.Errorf("got error %v expected invalid image", err)
+	}
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ellezio/Chat-app-with-Go/internal/log"
@@ -20,22 +27,66 @@ import (
 // - try also HTTP/2, gRPC
 type FileUploader struct {
 	host, port string
+	adminToken string
 	client     *http.Client
 }
 
-func NewFileUploader(host, port string) *FileUploader {
+func NewFileUploader(host, port, adminToken string) *FileUploader {
 	client := &http.Client{
 		Transport: http.DefaultTransport,
 		Timeout:   60 * time.Second,
 	}
 
-	return &FileUploader{host, port, client}
+	return &FileUploader{host, port, adminToken, client}
 }
 
-// Upload sends a file to the file server.
+// UploadedFile describes a file stored by the file server.
+type UploadedFile struct {
+	Name     string  `json:"name"`
+	MIME     string  `json:"mime"`
+	Size     int64   `json:"size"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Duration float64 `json:"duration"`
+	// hex encoded SHA-256 of the uploaded content
+	Hash string `json:"hash"`
+	// malware scan status, pending, clean, infected or failed, empty when
+	// the file server doesn't scan files
+	Scan string `json:"scan"`
+}
+
+func (f *UploadedFile) Infected() bool {
+	return f.Scan == "infected"
+}
+
+// ScanFailed reports whether the file server couldn't scan the file,
+// it won't serve the file.
+func (f *UploadedFile) ScanFailed() bool {
+	return f.Scan == "failed"
+}
+
+// Upload sends a file to the file server. If the file is seekable and
+// the admin token is set its content is hashed first and not sent when
+// the file server already stores it.
 //
-// Returns the uploaded file's name
-func (fu *FileUploader) Upload(ctx context.Context, fname string, file io.Reader) (string, error) {
+// Returns the uploaded file's description
+func (fu *FileUploader) Upload(ctx context.Context, fname string, file io.Reader) (*UploadedFile, error) {
+	if rs, ok := file.(io.ReadSeeker); ok && fu.adminToken != "" {
+		h := sha256.New()
+		if _, err := io.Copy(h, rs); err != nil {
+			return nil, fmt.Errorf("hashing file: %w", err)
+		}
+
+		uploaded, err := fu.addRef(ctx, hex.EncodeToString(h.Sum(nil)))
+		if err != nil || uploaded != nil {
+			return uploaded, err
+		}
+
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seeking file: %w", err)
+		}
+	}
+
 	pr, pw := io.Pipe()
 	wr := multipart.NewWriter(pw)
 
@@ -65,7 +116,7 @@ func (fu *FileUploader) Upload(ctx context.Context, fname string, file io.Reader
 	req, err := http.NewRequestWithContext(ctx, "POST", url.String(), pr)
 	if err != nil {
 		pr.CloseWithError(err)
-		return "", fmt.Errorf("creating request: %w", err)
+		return nil, fmt.Errorf("creating request: %w", err)
 	}
 
 	if cid := log.CorrelationIdCtx(ctx); cid != "" {
@@ -74,6 +125,152 @@ func (fu *FileUploader) Upload(ctx context.Context, fname string, file io.Reader
 
 	req.Header.Set("Content-Type", wr.FormDataContentType())
 
+	res, err := fu.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer res.Body.Close()
+
+	// OK is returned when the content was already stored
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode == http.StatusRequestEntityTooLarge {
+			return nil, &UploadError{Status: res.StatusCode, Msg: strings.TrimSpace(string(body))}
+		}
+		return nil, fmt.Errorf("unexpected status %d with body %s", res.StatusCode, body)
+	}
+
+	var uploaded UploadedFile
+	if err := json.NewDecoder(res.Body).Decode(&uploaded); err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+
+	return &uploaded, nil
+}
+
+// addRef adds a reference to the content already stored by the file server.
+//
+// Returns nil file without error if the file server doesn't know the content.
+func (fu *FileUploader) addRef(ctx context.Context, hash string) (*UploadedFile, error) {
+	url := url.URL{Scheme: "http", Host: net.JoinHostPort(fu.host, fu.port), Path: "/refs/" + hash}
+	req, err := http.NewRequestWithContext(ctx, "POST", url.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+fu.adminToken)
+
+	if cid := log.CorrelationIdCtx(ctx); cid != "" {
+		req.Header.Set(log.CorrelationIdHeader, cid)
+	}
+
+	res, err := fu.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected status %d with body %s", res.StatusCode, body)
+	}
+
+	var uploaded UploadedFile
+	if err := json.NewDecoder(res.Body).Decode(&uploaded); err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+
+	return &uploaded, nil
+}
+
+// UploadError is returned by resumable upload methods when the file server
+// rejects the request, the status is meant to be passed to the client.
+type UploadError struct {
+	Status int
+	Msg    string
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("upload rejected with status %d: %s", e.Status, e.Msg)
+}
+
+// UploadStatus describes the state of a resumable upload.
+type UploadStatus struct {
+	Offset int64
+	Length int64
+	// name of the file sent on creation
+	Filename string
+	// chat the file is sent to and the user sending it, given on creation
+	ChatId string
+	UserId string
+	// set when the last chunk was received and the file is stored
+	File *UploadedFile
+}
+
+func (fu *FileUploader) uploadRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	url := url.URL{Scheme: "http", Host: net.JoinHostPort(fu.host, fu.port), Path: path}
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	if cid := log.CorrelationIdCtx(ctx); cid != "" {
+		req.Header.Set(log.CorrelationIdHeader, cid)
+	}
+	return req, nil
+}
+
+// readUploadStatus reads the upload state from response headers.
+func readUploadStatus(res *http.Response) *UploadStatus {
+	status := &UploadStatus{}
+	status.Offset, _ = strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+	status.Length, _ = strconv.ParseInt(res.Header.Get("Upload-Length"), 10, 64)
+
+	// metadata is a comma separated list of keys with base64 encoded values
+	for pair := range strings.SplitSeq(res.Header.Get("Upload-Metadata"), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "filename":
+			status.Filename = string(b)
+		case "chat":
+			status.ChatId = string(b)
+		case "user":
+			status.UserId = string(b)
+		}
+	}
+	return status
+}
+
+func uploadError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return &UploadError{Status: res.StatusCode, Msg: strings.TrimSpace(string(body))}
+}
+
+// CreateUpload starts a resumable upload of the file with the length.
+//
+// The chat and the user are kept with the upload, so its chunks can be
+// checked to come from the same user.
+//
+// Returns id of the upload
+func (fu *FileUploader) CreateUpload(ctx context.Context, fname string, chatId string, userId string, length int64) (string, error) {
+	req, err := fu.uploadRequest(ctx, "POST", "/uploads", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
+	req.Header.Set("Upload-Metadata", strings.Join([]string{
+		"filename " + base64.StdEncoding.EncodeToString([]byte(fname)),
+		"chat " + base64.StdEncoding.EncodeToString([]byte(chatId)),
+		"user " + base64.StdEncoding.EncodeToString([]byte(userId)),
+	}, ","))
+
 	res, err := fu.client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("sending request: %w", err)
@@ -81,14 +278,66 @@ func (fu *FileUploader) Upload(ctx context.Context, fname string, file io.Reader
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(res.Body)
-		return "", fmt.Errorf("unexpected status %d with body %s", res.StatusCode, body)
+		return "", uploadError(res)
 	}
 
-	savedFilename, err := io.ReadAll(res.Body)
+	return path.Base(res.Header.Get("Location")), nil
+}
+
+// GetUploadStatus returns the state of the resumable upload, the offset
+// is where the next chunk should start.
+func (fu *FileUploader) GetUploadStatus(ctx context.Context, id string) (*UploadStatus, error) {
+	req, err := fu.uploadRequest(ctx, "HEAD", "/uploads/"+id, nil)
 	if err != nil {
-		return "", fmt.Errorf("reading response body: %w", err)
+		return nil, err
 	}
 
-	return string(savedFilename), nil
+	res, err := fu.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &UploadError{Status: res.StatusCode, Msg: http.StatusText(res.StatusCode)}
+	}
+
+	return readUploadStatus(res), nil
+}
+
+// PatchUpload sends a chunk of the resumable upload starting at the offset.
+// The checksum is passed as is in the Upload-Checksum header when not empty.
+//
+// Returns the state after the chunk, with the stored file after the last one
+func (fu *FileUploader) PatchUpload(ctx context.Context, id string, offset int64, checksum string, chunk io.Reader, size int64) (*UploadStatus, error) {
+	req, err := fu.uploadRequest(ctx, "PATCH", "/uploads/"+id, chunk)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if checksum != "" {
+		req.Header.Set("Upload-Checksum", checksum)
+	}
+
+	res, err := fu.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return readUploadStatus(res), nil
+	case http.StatusOK, http.StatusCreated:
+		status := readUploadStatus(res)
+		status.File = &UploadedFile{}
+		if err := json.NewDecoder(res.Body).Decode(status.File); err != nil {
+			return nil, fmt.Errorf("reading response body: %w", err)
+		}
+		return status, nil
+	default:
+		return nil, uploadError(res)
+	}
 }
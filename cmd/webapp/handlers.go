@@ -2,16 +2,27 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/a-h/templ"
 	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
 	"github.com/ellezio/Chat-app-with-Go/internal/log"
 	"github.com/ellezio/Chat-app-with-Go/internal/session"
 	"github.com/ellezio/Chat-app-with-Go/internal/store"
@@ -29,20 +40,51 @@ type ChatHandler struct {
 	fileUploader *FileUploader
 	hub          *internal.Hub
 	store        internal.Store
+	usage        *store.RedisStore
+	quotas       config.Quotas
+	rateLimits   config.RateLimits
+	proxies      []netip.Prefix
+	admins       map[string]bool
 }
 
-func newChatHandler(store internal.Store, fileUploader *FileUploader) (*ChatHandler, *internal.Hub) {
+func newChatHandler(store internal.Store, fileUploader *FileUploader, usage *store.RedisStore, cfg config.Webapp) (*ChatHandler, *internal.Hub) {
 	h := &ChatHandler{
 		hub:          internal.NewHub(store),
 		store:        store,
 		fileUploader: fileUploader,
+		usage:        usage,
+		quotas:       cfg.Quotas,
+		rateLimits:   cfg.RateLimits,
+		admins:       make(map[string]bool),
+	}
+
+	for _, name := range cfg.Admins {
+		h.admins[name] = true
+	}
+
+	for _, proxy := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if addr, aerr := netip.ParseAddr(proxy); aerr == nil {
+			prefix, err = addr.Prefix(addr.BitLen())
+		}
+		if err != nil {
+			slog.Warn("Ignoring invalid trusted proxy", slog.String("proxy", proxy), slog.Any("error", err))
+			continue
+		}
+		h.proxies = append(h.proxies, prefix)
 	}
 
 	return h, h.hub
 }
 
+// visibleChats returns chats the user isn't banned from.
+func (h *ChatHandler) visibleChats(userId string) []*internal.Chat {
+	return slices.DeleteFunc(h.hub.GetChats(), func(cht *internal.Chat) bool { return cht.Banned(userId) })
+}
+
 func (h *ChatHandler) Homepage(w http.ResponseWriter, r *http.Request) error {
-	chts := h.hub.GetChats()
+	sesh := session.GetSession(r.Context())
+	chts := h.visibleChats(sesh.User.Id)
 
 	var bb bytes.Buffer
 	components.Homepage(chts, "").Render(r.Context(), &bb)
@@ -53,13 +95,14 @@ func (h *ChatHandler) Homepage(w http.ResponseWriter, r *http.Request) error {
 func (h *ChatHandler) ChatPage(w http.ResponseWriter, r *http.Request) error {
 	id := r.PathValue("chatId")
 
-	if cht := h.hub.GetChat(id); cht == nil {
+	sesh := session.GetSession(r.Context())
+	if cht := h.hub.GetChat(id); cht == nil || cht.Banned(sesh.User.Id) {
 		http.Redirect(w, r, "/", 302)
 		return nil
 	}
 
 	var bb bytes.Buffer
-	chts := h.hub.GetChats()
+	chts := h.visibleChats(sesh.User.Id)
 	components.Homepage(chts, id).Render(r.Context(), &bb)
 	bb.WriteTo(w)
 	return nil
@@ -110,6 +153,13 @@ func (h *ChatHandler) Login(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	// attempts are limited per user name to slow down guessing passwords,
+	// counted per address, so others can't lock the user out
+	userKey := username + "@" + clientIP(r, h.proxies)
+	if err := h.rateLimit(w, r, "login", h.rateLimits.Login, userKey, ""); err != nil {
+		return err
+	}
+
 	user, err := h.store.GetUser(username)
 	if err != nil || !user.CheckPass(password) {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -154,6 +204,10 @@ func (h *ChatHandler) Register(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	if err := h.rateLimit(w, r, "register", h.rateLimits.Register, "", ""); err != nil {
+		return err
+	}
+
 	user, err := h.store.GetUser(username)
 	if err != nil && !errors.Is(err, store.ErrNoRecord) {
 		return errors.Join(errors.New("can't find user"), err)
@@ -184,7 +238,13 @@ func (h *ChatHandler) Chatroom(w http.ResponseWriter, r *http.Request) error {
 	defer conn.Close()
 
 	sesh := session.GetSession(r.Context())
-	client := NewHttpClient(conn, sesh.Id, logger)
+	client := NewHttpClient(conn, sesh.Id, sesh.User.Id, logger)
+
+	blocked, err := h.store.GetBlockedUsers(sesh.User.Id)
+	if err != nil {
+		logger.Error("Failed to get blocked users", slog.Any("error", err))
+	}
+	client.SetBlocked(blocked)
 
 	logger.Debug("Client connected", slog.String("name", sesh.User.Name))
 
@@ -220,12 +280,19 @@ func (h *ChatHandler) Chatroom(w http.ResponseWriter, r *http.Request) error {
 			if chatId == "" {
 				continue
 			}
+			if cht := h.hub.GetChat(chatId); cht != nil && cht.Banned(sesh.User.Id) {
+				continue
+			}
 
 			cht, prevCht, err := h.hub.ConnectClient(chatId, client)
 			if err != nil {
 				logger.Error("Failed to connect client", slog.Any("error", err))
 				break
 			}
+			// the chat may be deleted meanwhile
+			if cht == nil {
+				break
+			}
 
 			msgs, err := cht.GetMessages()
 			if err != nil {
@@ -233,10 +300,10 @@ func (h *ChatHandler) Chatroom(w http.ResponseWriter, r *http.Request) error {
 				break
 			}
 
-			ctx := session.ContextWithSessionId(context.Background(), client.SessionId)
+			ctx := client.renderContext()
 
 			var html bytes.Buffer
-			components.ChatWindow(cht.Id, msgs).Render(ctx, &html)
+			components.ChatWindow(cht, msgs).Render(ctx, &html)
 			components.ChatListItem(cht, "active").Render(ctx, &html)
 			if prevCht != nil {
 				components.ChatListItem(prevCht, "").Render(ctx, &html)
@@ -263,6 +330,17 @@ func (h *ChatHandler) NewMessage(w http.ResponseWriter, r *http.Request) error {
 	)
 
 	cht := h.hub.GetChat(chatId)
+	if cht == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if err := checkPosting(r, cht); err != nil {
+		return err
+	}
+	if err := h.rateLimit(w, r, "message", h.rateLimits.Messages, sesh.User.Id, chatId); err != nil {
+		return err
+	}
+
 	cht.NewMessage(msg, sesh.User.Id)
 	return nil
 }
@@ -276,9 +354,22 @@ func (h *ChatHandler) UploadFile(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(http.StatusNotFound)
 		return nil
 	}
+	if err := checkPosting(r, cht); err != nil {
+		return err
+	}
 
 	sesh := session.GetSession(r.Context())
 
+	// the whole body is checked as the form is read before the file
+	// size is known
+	if r.ContentLength < 0 {
+		w.WriteHeader(http.StatusLengthRequired)
+		return nil
+	}
+	if err := h.checkUpload(w, r, sesh.User.Id, chatId, r.ContentLength); err != nil {
+		return err
+	}
+
 	file, fileHeader, err := r.FormFile("file")
 	if err != nil {
 		logger.Error("Can't parse form file", slog.Any("error", err))
@@ -287,19 +378,343 @@ func (h *ChatHandler) UploadFile(w http.ResponseWriter, r *http.Request) error {
 	}
 	defer file.Close()
 
-	savedFilename, err := h.fileUploader.Upload(r.Context(), fileHeader.Filename, file)
-	if err != nil {
+	uploaded, err := h.fileUploader.Upload(r.Context(), fileHeader.Filename, file)
+	var uerr *UploadError
+	if errors.As(err, &uerr) {
+		return &httpError{status: uerr.Status, msg: uerr.Msg}
+	} else if err != nil {
 		return fmt.Errorf("can't upload file: %w", err)
 	}
+	if uploaded.Infected() {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: infectedFileMsg}
+	} else if uploaded.ScanFailed() {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: unscannedFileMsg}
+	}
+
+	msgType := fileMessageType(uploaded.MIME)
+	if r.FormValue("type") == string(internal.VoiceMessage) {
+		if err := checkVoiceMessage(uploaded); err != nil {
+			return err
+		}
+		msgType = internal.VoiceMessage
+	}
+
+	h.addUsage(r.Context(), sesh.User.Id, uploaded)
+	newFileMessage(cht, sesh.User.Id, fileHeader.Filename, uploaded, msgType)
+	return nil
+}
+
+// maxVoiceDuration limits length of voice messages, the recorder
+// in the browser stops at the same time.
+const maxVoiceDuration = 5 * time.Minute
+
+// checkVoiceMessage returns error shown to the user if the uploaded file
+// isn't an audio recording of allowed length.
+func checkVoiceMessage(uploaded *UploadedFile) error {
+	if !strings.HasPrefix(uploaded.MIME, "audio/") || uploaded.Duration <= 0 {
+		return &httpError{
+			status: http.StatusUnprocessableEntity,
+			msg:    "The voice message isn't a supported audio recording.",
+		}
+	}
+	if uploaded.Duration > maxVoiceDuration.Seconds() {
+		return &httpError{
+			status: http.StatusUnprocessableEntity,
+			msg:    fmt.Sprintf("Voice messages can be up to %s long.", components.FormatDuration(maxVoiceDuration.Seconds())),
+		}
+	}
+	return nil
+}
+
+// rateLimit returns error shown to the user if the request exceeds any limit
+// of the action. Limits of empty user or chat are skipped.
+func (h *ChatHandler) rateLimit(w http.ResponseWriter, r *http.Request, action string, limits config.RateLimitScopes, userId string, chatId string) error {
+	var buckets []store.RateBucket
+	add := func(scope string, id string, limit config.RateLimit) {
+		if id != "" && limit.PerMinute > 0 {
+			buckets = append(buckets, store.RateBucket{
+				Key:       action + ":" + scope + ":" + id,
+				PerMinute: limit.PerMinute,
+				Burst:     limit.Burst,
+			})
+		}
+	}
+	add("user", userId, limits.User)
+	add("chat", chatId, limits.Chat)
+	add("ip", clientIP(r, h.proxies), limits.IP)
+
+	wait, err := h.usage.TakeTokens(r.Context(), buckets...)
+	if err != nil {
+		return fmt.Errorf("can't check rate limit: %w", err)
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		return &httpError{
+			status: http.StatusTooManyRequests,
+			msg:    fmt.Sprintf("Too many requests, try again in %d seconds.", seconds),
+		}
+	}
+	return nil
+}
+
+// clientIP returns the address the request came from. Behind trusted
+// proxies it's read from X-Real-IP or the last address in X-Forwarded-For
+// not added by a trusted proxy, headers of other requests are ignored.
+func clientIP(r *http.Request, proxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	trusted := func(addr netip.Addr) bool {
+		return slices.ContainsFunc(proxies, func(p netip.Prefix) bool { return p.Contains(addr.Unmap()) })
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !trusted(addr) {
+		return host
+	}
+
+	if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return ip.String()
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = ip
+		if !trusted(ip) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// checkUpload returns error shown to the user if the upload of size bytes
+// to the chat exceeds the rate limit or storage quotas.
+func (h *ChatHandler) checkUpload(w http.ResponseWriter, r *http.Request, userId string, chatId string, size int64) error {
+	if err := h.rateLimit(w, r, "upload", h.rateLimits.Uploads, userId, chatId); err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	err := h.usage.CheckStorageQuota(ctx, userId, size, h.quotas.UserBytes, h.quotas.GlobalBytes)
+	switch {
+	case errors.Is(err, store.ErrUserQuotaExceeded):
+		used, _, _ := h.usage.GetStorageUsage(ctx, userId)
+		return &httpError{
+			status: http.StatusRequestEntityTooLarge,
+			msg: fmt.Sprintf("The file doesn't fit in your storage quota, %s of %s is used.",
+				components.FormatSize(used), components.FormatSize(h.quotas.UserBytes)),
+		}
+	case errors.Is(err, store.ErrGlobalQuotaExceeded):
+		return &httpError{
+			status: http.StatusInsufficientStorage,
+			msg:    "The server is out of storage, the file can't be uploaded.",
+		}
+	case err != nil:
+		return fmt.Errorf("can't check storage quota: %w", err)
+	}
+
+	return nil
+}
+
+// addUsage counts the uploaded file in storage usage of the user unless its
+// content was stored before. The file is already stored so the error is only
+// logged.
+func (h *ChatHandler) addUsage(ctx context.Context, userId string, file *UploadedFile) {
+	if _, err := h.usage.AddFileUsage(ctx, userId, file.Name, file.Size); err != nil {
+		log.Ctx(ctx).Error("Can't add storage usage", slog.String("user", userId), slog.Any("error", err))
+	}
+}
 
+const (
+	infectedFileMsg  = "The file was rejected by the malware scan."
+	unscannedFileMsg = "The file couldn't be scanned for malware."
+)
+
+// fileMessageType returns type of the message attaching file of the media type.
+func fileMessageType(mediatype string) internal.MessageType {
+	if strings.HasPrefix(mediatype, "image/") {
+		return internal.ImageMessage
+	}
+	return internal.FileMessage
+}
+
+// newFileMessage sends message with the uploaded file to the chat.
+// Files waiting for the malware scan are sent with the scanning status.
+func newFileMessage(cht *internal.Chat, userId string, fname string, uploaded *UploadedFile, msgType internal.MessageType) {
 	msg := internal.New(
 		cht.Id,
-		sesh.User.Id,
-		savedFilename,
-		internal.ImageMessage,
+		userId,
+		uploaded.Name,
+		msgType,
 	)
+	msg.File = &internal.FileInfo{
+		Name:     fname,
+		Size:     uploaded.Size,
+		MIME:     uploaded.MIME,
+		Width:    uploaded.Width,
+		Height:   uploaded.Height,
+		Duration: uploaded.Duration,
+	}
+	if uploaded.Scan == "pending" {
+		msg.Status = internal.Scanning
+	}
 
-	cht.NewMessage(msg, sesh.User.Id)
+	cht.NewMessage(msg, userId)
+}
+
+// maxUploadChunk limits size of a single chunk of resumable upload.
+const maxUploadChunk = 16 << 20
+
+// writeUploadError passes the status of rejected resumable upload requests
+// to the client, other errors are returned.
+func writeUploadError(w http.ResponseWriter, err error) error {
+	var uerr *UploadError
+	if errors.As(err, &uerr) {
+		http.Error(w, uerr.Msg, uerr.Status)
+		return nil
+	}
+	return err
+}
+
+func validUploadId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+// CreateUpload starts a resumable upload of a file to the chat.
+// The file name is sent URL encoded in the Upload-Filename header.
+func (h *ChatHandler) CreateUpload(w http.ResponseWriter, r *http.Request) error {
+	chatId := r.PathValue("chatId")
+	if cht := h.hub.GetChat(chatId); cht == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	} else if err := checkPosting(r, cht); err != nil {
+		return err
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return nil
+	}
+
+	fname, err := url.PathUnescape(r.Header.Get("Upload-Filename"))
+	if err != nil || fname == "" {
+		fname = "file"
+	}
+
+	sesh := session.GetSession(r.Context())
+	if err := h.checkUpload(w, r, sesh.User.Id, chatId, length); err != nil {
+		return err
+	}
+
+	id, err := h.fileUploader.CreateUpload(r.Context(), fname, chatId, sesh.User.Id, length)
+	if err != nil {
+		return writeUploadError(w, fmt.Errorf("can't create upload: %w", err))
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/chats/%s/uploads/%s", chatId, id))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// UploadStatus reports the offset the next chunk of the upload should start at.
+func (h *ChatHandler) UploadStatus(w http.ResponseWriter, r *http.Request) error {
+	status, err := h.ownUpload(w, r)
+	if err != nil || status == nil {
+		return err
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(status.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(status.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// ownUpload returns the state of the upload of the request when it was
+// created in the chat by the user of the request. Otherwise the response
+// is written and the state is nil.
+func (h *ChatHandler) ownUpload(w http.ResponseWriter, r *http.Request) (*UploadStatus, error) {
+	id := r.PathValue("uploadId")
+	if !validUploadId(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil
+	}
+
+	status, err := h.fileUploader.GetUploadStatus(r.Context(), id)
+	if err != nil {
+		return nil, writeUploadError(w, fmt.Errorf("can't get upload status: %w", err))
+	}
+
+	sesh := session.GetSession(r.Context())
+	if status.ChatId != r.PathValue("chatId") || status.UserId != sesh.User.Id {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil
+	}
+	return status, nil
+}
+
+// PatchUpload passes a chunk of the upload to the file server, the message
+// with the file is sent after the last chunk. Posting to the chat is checked
+// before every chunk, so the file isn't stored and counted in the usage of
+// the user when the message would be dropped.
+func (h *ChatHandler) PatchUpload(w http.ResponseWriter, r *http.Request) error {
+	cht := h.hub.GetChat(r.PathValue("chatId"))
+	if cht == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	upload, err := h.ownUpload(w, r)
+	if err != nil || upload == nil {
+		return err
+	}
+	if err := checkPosting(r, cht); err != nil {
+		return err
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return nil
+	}
+
+	if r.ContentLength < 0 || r.ContentLength > maxUploadChunk {
+		http.Error(w, fmt.Sprintf("chunk must have known length up to %d bytes", maxUploadChunk), http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	status, err := h.fileUploader.PatchUpload(r.Context(), r.PathValue("uploadId"), offset, r.Header.Get("Upload-Checksum"), r.Body, r.ContentLength)
+	if err != nil {
+		return writeUploadError(w, fmt.Errorf("can't upload chunk: %w", err))
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(status.Offset, 10))
+	if status.File == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if status.File.Infected() {
+		http.Error(w, infectedFileMsg, http.StatusUnprocessableEntity)
+		return nil
+	} else if status.File.ScanFailed() {
+		http.Error(w, unscannedFileMsg, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	sesh := session.GetSession(r.Context())
+	h.addUsage(r.Context(), sesh.User.Id, status.File)
+	newFileMessage(cht, sesh.User.Id, upload.Filename, status.File, fileMessageType(status.File.MIME))
+	w.WriteHeader(http.StatusCreated)
 	return nil
 }
 
@@ -339,15 +754,38 @@ func (h *ChatHandler) PostMessageEdit(w http.ResponseWriter, r *http.Request) er
 		return nil
 	}
 
+	if err := checkPosting(r, cht); err != nil {
+		return err
+	}
+
+	// edits are sent to the chat like new messages, so they share the limit
+	sesh := session.GetSession(r.Context())
+	if err := h.rateLimit(w, r, "message", h.rateLimits.Messages, sesh.User.Id, chatId); err != nil {
+		return err
+	}
+
 	msgId := r.PathValue("messageId")
+	msg, err := h.store.GetMessage(msgId)
+	if err != nil {
+		return errors.Join(errors.New("can't get message"), err)
+	}
+
+	if msg.AuthorId != sesh.User.Id {
+		return &httpError{status: http.StatusForbidden, msg: "You can edit only your messages."}
+	}
+
 	msgContent := r.FormValue("msgContent")
-	if err := cht.UpdateMessageContent(msgId, msgContent); err != nil {
+	if err := cht.UpdateMessageContent(msgId, msgContent, sesh.User.Id); err != nil {
 		return errors.Join(errors.New("Can't update message's content"), err)
 	}
 	return nil
 }
 
 func (h *ChatHandler) MessagePin(w http.ResponseWriter, r *http.Request) error {
+	if _, err := h.moderatedChat(r); err != nil {
+		return err
+	}
+
 	w.WriteHeader(http.StatusNotImplemented)
 	return nil
 }
@@ -380,60 +818,899 @@ func (h *ChatHandler) MessageDelete(w http.ResponseWriter, r *http.Request) erro
 	}
 
 	msgId := r.PathValue("messageId")
-	err := cht.DeleteMessage(msgId)
+	msg, err := h.store.GetMessage(msgId)
 	if err != nil {
-		errors.Join(errors.New("Failed to delete message"), err)
+		return errors.Join(errors.New("can't get message"), err)
 	}
-	return nil
-}
 
-func (h *ChatHandler) CreateChat(w http.ResponseWriter, r *http.Request) error {
-	r.ParseForm()
-	chatName := r.FormValue("chatName")
-	h.hub.AddChat(chatName)
-	return nil
-}
-
-type HttpClient struct {
-	id        string
-	SessionId session.SessionId
+	sesh := session.GetSession(r.Context())
+	if !cht.CanDeleteMessage(msg, sesh.User.Id) {
+		return &httpError{status: http.StatusForbidden, msg: "You can't delete this message."}
+	}
 
-	conn    *websocket.Conn
-	connMux sync.Mutex
+	err = cht.DeleteMessage(msgId, sesh.User.Id)
+	if err != nil {
+		return errors.Join(errors.New("Failed to delete message"), err)
+	}
 
-	logger *slog.Logger
+	// messages of others can be deleted only by moderators
+	if msg.AuthorId == sesh.User.Id {
+		return nil
+	}
+	return h.saveAuditEntry(&internal.AuditEntry{
+		ChatId:      cht.Id,
+		ModeratorId: sesh.User.Id,
+		Action:      internal.ActionDeleteMessage,
+		MessageId:   msgId,
+		MemberId:    msg.AuthorId,
+	})
 }
 
-func NewHttpClient(conn *websocket.Conn, sessionId session.SessionId, logger *slog.Logger) *HttpClient {
-	return &HttpClient{
-		id:        sessionId.String(),
-		SessionId: sessionId,
-		conn:      conn,
-		connMux:   sync.Mutex{},
-		logger:    logger,
-	}
+// pollDurations are the choices of time after which polls close.
+var pollDurations = map[string]time.Duration{
+	"":     0,
+	"1h":   time.Hour,
+	"24h":  24 * time.Hour,
+	"168h": 7 * 24 * time.Hour,
 }
 
-func (c *HttpClient) GetId() string { return c.id }
+func (h *ChatHandler) CreatePoll(w http.ResponseWriter, r *http.Request) error {
+	chatId := r.PathValue("chatId")
+	cht := h.hub.GetChat(chatId)
+	if cht == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if err := checkPosting(r, cht); err != nil {
+		return err
+	}
 
-func (c *HttpClient) HandleEvent(evtType internal.EventType, evtData internal.EventData) {
-	ctx := session.ContextWithSessionId(context.Background(), c.SessionId)
-	var html bytes.Buffer
+	sesh := session.GetSession(r.Context())
+	if err := h.rateLimit(w, r, "message", h.rateLimits.Messages, sesh.User.Id, chatId); err != nil {
+		return err
+	}
 
-	switch evtType {
-	case internal.Event_NewMessage:
+	if err := r.ParseForm(); err != nil {
+		return errors.Join(errors.New("failed to parse poll form"), err)
+	}
 
-		if evtData.Connected {
-			msg := evtData.Msg
-			components.
-				MessagesList([]*internal.Message{msg}, true).
-				Render(ctx, &html)
+	question := strings.TrimSpace(r.PostForm.Get("question"))
+	if question == "" {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The poll needs a question."}
+	}
 
-			children := components.ContextMenu(msg, false)
-			ctx = templ.WithChildren(ctx, children)
-			components.ContextMenusWrapper(true).Render(ctx, &html)
-		} else {
-			components.ChatListItem(evtData.Cht, "newMessage").Render(ctx, &html)
+	var options []string
+	for _, opt := range r.PostForm["option"] {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		if slices.Contains(options, opt) {
+			return &httpError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("The option %q is repeated.", opt)}
+		}
+		options = append(options, opt)
+	}
+	if len(options) < 2 || len(options) > internal.MaxPollOptions {
+		return &httpError{
+			status: http.StatusUnprocessableEntity,
+			msg:    fmt.Sprintf("The poll needs from 2 to %d options.", internal.MaxPollOptions),
+		}
+	}
+
+	duration, ok := pollDurations[r.PostForm.Get("duration")]
+	if !ok {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "Unknown poll duration."}
+	}
+	var closesAt time.Time
+	if duration > 0 {
+		closesAt = time.Now().Add(duration)
+	}
+
+	msg := internal.New(chatId, sesh.User.Id, question, internal.PollMessage)
+	msg.Poll = internal.NewPoll(
+		options,
+		r.PostForm.Get("multiple") == "on",
+		r.PostForm.Get("anonymous") == "on",
+		closesAt,
+	)
+
+	return cht.NewMessage(msg, sesh.User.Id)
+}
+
+// getPoll returns the poll message of the chat from the request path.
+func (h *ChatHandler) getPoll(r *http.Request) (*internal.Chat, *internal.Message, error) {
+	cht := h.hub.GetChat(r.PathValue("chatId"))
+	if cht == nil {
+		return nil, nil, &httpError{status: http.StatusNotFound, msg: "The chat doesn't exist."}
+	}
+
+	msg, err := h.store.GetMessage(r.PathValue("messageId"))
+	if err != nil {
+		return nil, nil, errors.Join(errors.New("can't get message"), err)
+	}
+	if msg.ChatId.Hex() != cht.Id || msg.Poll == nil || msg.Deleted {
+		return nil, nil, &httpError{status: http.StatusNotFound, msg: "The poll doesn't exist."}
+	}
+
+	return cht, msg, nil
+}
+
+// VotePoll replaces the vote of the user, no options retract the vote.
+// The vote is checked here, so only votes racing with closing the poll
+// are rejected by the chat server.
+func (h *ChatHandler) VotePoll(w http.ResponseWriter, r *http.Request) error {
+	cht, msg, err := h.getPoll(r)
+	if err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return errors.Join(errors.New("failed to parse vote form"), err)
+	}
+
+	var votes []int
+	for _, v := range r.PostForm["option"] {
+		opt, err := strconv.Atoi(v)
+		if err != nil {
+			return &httpError{status: http.StatusUnprocessableEntity, msg: "Unknown poll option."}
+		}
+		votes = append(votes, opt)
+	}
+	slices.Sort(votes)
+
+	err = msg.Poll.CheckVote(votes, time.Now())
+	switch {
+	case errors.Is(err, internal.ErrPollClosed):
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The poll is closed."}
+	case errors.Is(err, internal.ErrInvalidVote):
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The vote doesn't match the poll options."}
+	}
+
+	sesh := session.GetSession(r.Context())
+	// the same vote again changes nothing
+	if slices.Equal(votes, msg.Poll.Votes(sesh.User.Id)) {
+		return nil
+	}
+
+	if err := cht.VotePoll(msg.Id.Hex(), sesh.User.Id, votes); err != nil {
+		return errors.Join(errors.New("Failed to vote"), err)
+	}
+	return nil
+}
+
+func (h *ChatHandler) ClosePoll(w http.ResponseWriter, r *http.Request) error {
+	cht, msg, err := h.getPoll(r)
+	if err != nil {
+		return err
+	}
+
+	sesh := session.GetSession(r.Context())
+	if msg.AuthorId != sesh.User.Id {
+		return &httpError{status: http.StatusForbidden, msg: "Only the author can close the poll."}
+	}
+	if msg.Poll.Closed(time.Now()) {
+		return nil
+	}
+
+	if err := cht.ClosePoll(msg.Id.Hex(), sesh.User.Id); err != nil {
+		return errors.Join(errors.New("Failed to close poll"), err)
+	}
+	return nil
+}
+
+// parseScheduledForm returns the content and time of the scheduled message,
+// the time is sent by the browser in UTC.
+func parseScheduledForm(r *http.Request) (string, time.Time, error) {
+	content := r.FormValue("msg")
+	if strings.TrimSpace(content) == "" {
+		return "", time.Time{}, &httpError{status: http.StatusUnprocessableEntity, msg: "The scheduled message is empty."}
+	}
+
+	at, err := time.Parse(time.RFC3339, r.FormValue("scheduledAt"))
+	if err != nil {
+		return "", time.Time{}, &httpError{status: http.StatusUnprocessableEntity, msg: "Choose when to post the message."}
+	}
+	if !at.After(time.Now()) {
+		return "", time.Time{}, &httpError{status: http.StatusUnprocessableEntity, msg: "The message can be scheduled only in the future."}
+	}
+
+	return content, at, nil
+}
+
+func (h *ChatHandler) ScheduleMessage(w http.ResponseWriter, r *http.Request) error {
+	chatId := r.PathValue("chatId")
+	if cht := h.hub.GetChat(chatId); cht == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	} else if err := checkPosting(r, cht); err != nil {
+		return err
+	}
+
+	// scheduled messages are posted without another check, so they count
+	// as messages when scheduled
+	sesh := session.GetSession(r.Context())
+	if err := h.rateLimit(w, r, "message", h.rateLimits.Messages, sesh.User.Id, chatId); err != nil {
+		return err
+	}
+
+	content, at, err := parseScheduledForm(r)
+	if err != nil {
+		return err
+	}
+
+	msg := internal.New(chatId, sesh.User.Id, content, internal.TextMessage)
+	msg.ScheduledAt = at
+	if err := h.store.ScheduleMessage(msg); err != nil {
+		return errors.Join(errors.New("can't schedule message"), err)
+	}
+
+	return h.renderScheduled(w, r, chatId)
+}
+
+// ScheduledMessages lists messages of the user waiting to be posted in the chat.
+func (h *ChatHandler) ScheduledMessages(w http.ResponseWriter, r *http.Request) error {
+	return h.renderScheduled(w, r, r.PathValue("chatId"))
+}
+
+func (h *ChatHandler) renderScheduled(w http.ResponseWriter, r *http.Request, chatId string) error {
+	sesh := session.GetSession(r.Context())
+	msgs, err := h.store.GetScheduledMessages(chatId, sesh.User.Id)
+	if err != nil {
+		return errors.Join(errors.New("can't get scheduled messages"), err)
+	}
+
+	var bb bytes.Buffer
+	components.ScheduledPanel(chatId, msgs).Render(r.Context(), &bb)
+	bb.WriteTo(w)
+	return nil
+}
+
+func (h *ChatHandler) GetScheduledEdit(w http.ResponseWriter, r *http.Request) error {
+	sesh := session.GetSession(r.Context())
+	msgs, err := h.store.GetScheduledMessages(r.PathValue("chatId"), sesh.User.Id)
+	if err != nil {
+		return errors.Join(errors.New("can't get scheduled messages"), err)
+	}
+
+	msgId := r.PathValue("messageId")
+	i := slices.IndexFunc(msgs, func(m *internal.Message) bool { return m.Id.Hex() == msgId })
+	if i < 0 {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: scheduledPostedMsg}
+	}
+
+	var bb bytes.Buffer
+	components.ScheduledMessageItem(msgs[i], true).Render(r.Context(), &bb)
+	bb.WriteTo(w)
+	return nil
+}
+
+func (h *ChatHandler) UpdateScheduled(w http.ResponseWriter, r *http.Request) error {
+	sesh := session.GetSession(r.Context())
+	if err := h.rateLimit(w, r, "message", h.rateLimits.Messages, sesh.User.Id, r.PathValue("chatId")); err != nil {
+		return err
+	}
+
+	content, at, err := parseScheduledForm(r)
+	if err != nil {
+		return err
+	}
+
+	msg, err := h.store.UpdateScheduledMessage(r.PathValue("messageId"), sesh.User.Id, content, at)
+	if errors.Is(err, store.ErrNoRecord) {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: scheduledPostedMsg}
+	} else if err != nil {
+		return errors.Join(errors.New("can't update scheduled message"), err)
+	}
+
+	var bb bytes.Buffer
+	components.ScheduledMessageItem(msg, false).Render(r.Context(), &bb)
+	bb.WriteTo(w)
+	return nil
+}
+
+func (h *ChatHandler) CancelScheduled(w http.ResponseWriter, r *http.Request) error {
+	sesh := session.GetSession(r.Context())
+	err := h.store.CancelScheduledMessage(r.PathValue("messageId"), sesh.User.Id)
+	if errors.Is(err, store.ErrNoRecord) {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: scheduledPostedMsg}
+	} else if err != nil {
+		return errors.Join(errors.New("can't cancel scheduled message"), err)
+	}
+	return nil
+}
+
+const scheduledPostedMsg = "The message is already posted."
+
+var errArchivedChat = &httpError{status: http.StatusForbidden, msg: "The chat is archived."}
+var errReadOnlyChat = &httpError{status: http.StatusForbidden, msg: "You can't post in this chat."}
+var errNotModerator = &httpError{status: http.StatusForbidden, msg: "Only moderators can do this."}
+var errBanned = &httpError{status: http.StatusForbidden, msg: "You are banned from this chat."}
+
+// checkPosting rejects posting to archived chats and by read-only members.
+func checkPosting(r *http.Request, cht *internal.Chat) error {
+	if cht.IsArchived() {
+		return errArchivedChat
+	}
+
+	sesh := session.GetSession(r.Context())
+	if cht.Banned(sesh.User.Id) {
+		return errBanned
+	}
+	if !cht.Role(sesh.User.Id).CanPost() {
+		return errReadOnlyChat
+	}
+	if cht.Muted(sesh.User.Id, time.Now()) {
+		until := cht.MutedUntil(sesh.User.Id).Local().Format(time.DateTime)
+		return &httpError{status: http.StatusForbidden, msg: "You are muted until " + until + "."}
+	}
+	return nil
+}
+
+func (h *ChatHandler) requestChat(r *http.Request) (*internal.Chat, error) {
+	cht := h.hub.GetChat(r.PathValue("chatId"))
+	if cht == nil {
+		return nil, &httpError{status: http.StatusNotFound, msg: "The chat doesn't exist."}
+	}
+	return cht, nil
+}
+
+// moderatedChat returns the chat of the request, if the user can moderate it.
+func (h *ChatHandler) moderatedChat(r *http.Request) (*internal.Chat, error) {
+	cht, err := h.requestChat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sesh := session.GetSession(r.Context())
+	if !cht.Role(sesh.User.Id).CanModerate() {
+		return nil, errNotModerator
+	}
+
+	return cht, nil
+}
+
+// ownedChat returns the chat of the request, if the user owns it.
+func (h *ChatHandler) ownedChat(r *http.Request) (*internal.Chat, error) {
+	cht, err := h.requestChat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sesh := session.GetSession(r.Context())
+	if !cht.IsOwner(sesh.User.Id) {
+		return nil, &httpError{status: http.StatusForbidden, msg: "Only the owner can do this."}
+	}
+
+	return cht, nil
+}
+
+// UpdateChat renames the chat and changes its description.
+func (h *ChatHandler) UpdateChat(w http.ResponseWriter, r *http.Request) error {
+	cht, err := h.moderatedChat(r)
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The chat needs a name."}
+	}
+	description := strings.TrimSpace(r.FormValue("description"))
+
+	sesh := session.GetSession(r.Context())
+	if name != cht.GetName() {
+		if err := cht.Rename(name, sesh.User.Id); err != nil {
+			return err
+		}
+	}
+	if description != cht.GetDescription() {
+		if err := cht.Describe(description, sesh.User.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *ChatHandler) ArchiveChat(archived bool) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		cht, err := h.moderatedChat(r)
+		if err != nil {
+			return err
+		}
+
+		sesh := session.GetSession(r.Context())
+		return cht.Archive(archived, sesh.User.Id)
+	}
+}
+
+// SetRole gives the role in the chat to the user with the name.
+func (h *ChatHandler) SetRole(w http.ResponseWriter, r *http.Request) error {
+	cht, err := h.ownedChat(r)
+	if err != nil {
+		return err
+	}
+
+	role := internal.Role(r.FormValue("role"))
+	if !slices.Contains(internal.AssignableRoles, role) {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "Unknown role."}
+	}
+
+	user, err := h.store.GetUser(strings.TrimSpace(r.FormValue("name")))
+	if err != nil {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The user doesn't exist."}
+	}
+	if cht.IsOwner(user.Id.Hex()) {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The role of the owner can't be changed."}
+	}
+
+	sesh := session.GetSession(r.Context())
+	if err := cht.SetRole(user.Id.Hex(), role, sesh.User.Id); err != nil {
+		return err
+	}
+	return h.saveAuditEntry(&internal.AuditEntry{
+		ChatId:      cht.Id,
+		ModeratorId: sesh.User.Id,
+		Action:      internal.ActionSetRole,
+		MemberId:    user.Id.Hex(),
+		Role:        role,
+	})
+}
+
+// maxReportReasonLength limits reasons of reports in characters.
+const maxReportReasonLength = 500
+
+// auditLogLength is the number of latest actions shown on the moderation page.
+const auditLogLength = 50
+
+// ReportMessage files a report of the message for moderators of the chat,
+// the reason is given in the prompt.
+func (h *ChatHandler) ReportMessage(w http.ResponseWriter, r *http.Request) error {
+	cht, err := h.requestChat(r)
+	if err != nil {
+		return err
+	}
+
+	sesh := session.GetSession(r.Context())
+	if cht.Banned(sesh.User.Id) {
+		return errBanned
+	}
+
+	reason := strings.TrimSpace(r.Header.Get("HX-Prompt"))
+	if reason == "" {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "Give a reason for the report."}
+	}
+	if len([]rune(reason)) > maxReportReasonLength {
+		return &httpError{
+			status: http.StatusUnprocessableEntity,
+			msg:    fmt.Sprintf("The reason can't be longer than %d characters.", maxReportReasonLength),
+		}
+	}
+
+	msg, err := h.store.GetMessage(r.PathValue("messageId"))
+	if err != nil || msg.ChatId.Hex() != cht.Id {
+		return &httpError{status: http.StatusNotFound, msg: "The message doesn't exist."}
+	}
+	if msg.AuthorId == sesh.User.Id {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "You can't report your own message."}
+	}
+
+	err = h.store.SaveReport(&internal.Report{
+		ChatId:     cht.Id,
+		MessageId:  msg.Id.Hex(),
+		AuthorId:   msg.AuthorId,
+		ReporterId: sesh.User.Id,
+		Reason:     reason,
+		Status:     internal.ReportOpen,
+		CreatedAt:  time.Now(),
+	})
+	if errors.Is(err, store.ErrDuplicateReport) {
+		return &httpError{status: http.StatusConflict, msg: "You have already reported this message."}
+	}
+	return err
+}
+
+// moderatedChats returns chats the user can moderate by their ids.
+func (h *ChatHandler) moderatedChats(userId string) map[string]*internal.Chat {
+	chts := make(map[string]*internal.Chat)
+	for _, cht := range h.hub.GetChats() {
+		if cht.Role(userId).CanModerate() {
+			chts[cht.Id] = cht
+		}
+	}
+	return chts
+}
+
+// userName returns the name of the user or the id if the user can't be found.
+func (h *ChatHandler) userName(userId string) string {
+	if user, err := h.store.GetUserById(userId); err == nil {
+		return user.Name
+	}
+	return userId
+}
+
+// reportContext returns the reported message with two messages before and
+// after it.
+func reportContext(cht *internal.Chat, msgId string) ([]*internal.Message, error) {
+	msgs, err := cht.GetMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := slices.IndexFunc(msgs, func(m *internal.Message) bool { return m.Id.Hex() == msgId })
+	if idx < 0 {
+		return nil, nil
+	}
+	return msgs[max(idx-2, 0):min(idx+3, len(msgs))], nil
+}
+
+// ModerationPage lists open reports and the audit log of chats moderated
+// by the user.
+func (h *ChatHandler) ModerationPage(w http.ResponseWriter, r *http.Request) error {
+	sesh := session.GetSession(r.Context())
+	chts := h.moderatedChats(sesh.User.Id)
+	if len(chts) == 0 {
+		return errNotModerator
+	}
+
+	chatIds := make([]string, 0, len(chts))
+	for id := range chts {
+		chatIds = append(chatIds, id)
+	}
+
+	reports, err := h.store.GetOpenReports(chatIds)
+	if err != nil {
+		return err
+	}
+
+	items := make([]components.ReportItem, 0, len(reports))
+	for _, report := range reports {
+		cht := chts[report.ChatId]
+		msgs, err := reportContext(cht, report.MessageId)
+		if err != nil {
+			return err
+		}
+		item := components.ReportItem{
+			Report:       report,
+			ChatName:     cht.GetName(),
+			ReporterName: "Content filter",
+			AuthorName:   h.userName(report.AuthorId),
+			Context:      msgs,
+		}
+		// reports without a reporter come from the content filter
+		if report.ReporterId != "" {
+			item.ReporterName = h.userName(report.ReporterId)
+		}
+		items = append(items, item)
+	}
+
+	entries, err := h.store.GetAuditLog(chatIds, auditLogLength)
+	if err != nil {
+		return err
+	}
+
+	audit := make([]components.AuditItem, 0, len(entries))
+	for _, entry := range entries {
+		item := components.AuditItem{
+			Entry:         entry,
+			ChatName:      chts[entry.ChatId].GetName(),
+			ModeratorName: h.userName(entry.ModeratorId),
+		}
+		if entry.MemberId != "" {
+			item.MemberName = h.userName(entry.MemberId)
+		}
+		audit = append(audit, item)
+	}
+
+	var bb bytes.Buffer
+	components.ModerationPage(items, audit).Render(r.Context(), &bb)
+	bb.WriteTo(w)
+	return nil
+}
+
+// ModerateReport takes the action on the report and closes it, the action
+// is recorded in the audit log.
+func (h *ChatHandler) ModerateReport(w http.ResponseWriter, r *http.Request) error {
+	report, err := h.store.GetReport(r.PathValue("reportId"))
+	if err != nil {
+		return &httpError{status: http.StatusNotFound, msg: "The report doesn't exist."}
+	}
+	if report.Status != internal.ReportOpen {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The report is closed already."}
+	}
+
+	cht := h.hub.GetChat(report.ChatId)
+	if cht == nil {
+		return &httpError{status: http.StatusNotFound, msg: "The chat doesn't exist."}
+	}
+
+	sesh := session.GetSession(r.Context())
+	if !cht.Role(sesh.User.Id).CanModerate() {
+		return errNotModerator
+	}
+
+	action := internal.ModerationAction(r.PathValue("action"))
+	entry := &internal.AuditEntry{
+		ChatId:      cht.Id,
+		ModeratorId: sesh.User.Id,
+		Action:      action,
+		ReportId:    report.Id.Hex(),
+	}
+
+	switch action {
+	case internal.ActionDismiss:
+	case internal.ActionDeleteMessage:
+		msg, err := h.store.GetMessage(report.MessageId)
+		if err != nil {
+			return &httpError{status: http.StatusUnprocessableEntity, msg: "The message doesn't exist anymore, dismiss the report."}
+		}
+		if !msg.Deleted {
+			if err := cht.DeleteMessage(report.MessageId, sesh.User.Id); err != nil {
+				return err
+			}
+		}
+		entry.MessageId = report.MessageId
+		entry.MemberId = report.AuthorId
+	case internal.ActionMuteAuthor, internal.ActionBanAuthor:
+		if cht.Role(report.AuthorId).CanModerate() {
+			return &httpError{status: http.StatusUnprocessableEntity, msg: "Moderators can't be muted or banned."}
+		}
+
+		if action == internal.ActionMuteAuthor {
+			duration, ok := muteDurations[r.FormValue("duration")]
+			if !ok {
+				return &httpError{status: http.StatusUnprocessableEntity, msg: "Unknown mute duration."}
+			}
+			err = cht.Mute(report.AuthorId, time.Now().Add(duration), sesh.User.Id)
+		} else {
+			err = cht.Ban(report.AuthorId, true, sesh.User.Id)
+		}
+		if err != nil {
+			return err
+		}
+		entry.MemberId = report.AuthorId
+	default:
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "Unknown action."}
+	}
+
+	if _, err := h.store.CloseReport(report.Id.Hex(), action, sesh.User.Id); errors.Is(err, store.ErrNoRecord) {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The report is closed already."}
+	} else if err != nil {
+		return err
+	}
+
+	if err := h.saveAuditEntry(entry); err != nil {
+		return err
+	}
+
+	return h.ModerationPage(w, r)
+}
+
+// saveAuditEntry records the action taken now by the moderator.
+func (h *ChatHandler) saveAuditEntry(entry *internal.AuditEntry) error {
+	entry.CreatedAt = time.Now()
+	return h.store.SaveAuditEntry(entry)
+}
+
+// BlockUser blocks or unblocks the user for the user of the request in all
+// chats, the open chat is rendered again. All chats are shared by their
+// members, there are no direct messages a block would keep the user from
+// opening.
+func (h *ChatHandler) BlockUser(block bool) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		sesh := session.GetSession(r.Context())
+		blockedId := r.PathValue("userId")
+		if blockedId == sesh.User.Id {
+			return &httpError{status: http.StatusUnprocessableEntity, msg: "You can't block yourself."}
+		}
+		if _, err := h.store.GetUserById(blockedId); err != nil {
+			return &httpError{status: http.StatusUnprocessableEntity, msg: "The user doesn't exist."}
+		}
+
+		var err error
+		if block {
+			err = h.store.BlockUser(sesh.User.Id, blockedId)
+		} else {
+			err = h.store.UnblockUser(sesh.User.Id, blockedId)
+		}
+		if err != nil {
+			return err
+		}
+
+		blocked, err := h.store.GetBlockedUsers(sesh.User.Id)
+		if err != nil {
+			return err
+		}
+		for _, cli := range h.hub.GetUserClients(sesh.User.Id) {
+			if client, ok := cli.(*HttpClient); ok {
+				client.SetBlocked(blocked)
+			}
+		}
+
+		cht := h.hub.GetChat(r.FormValue("chatId"))
+		if cht == nil {
+			return nil
+		}
+		msgs, err := cht.GetMessages()
+		if err != nil {
+			return err
+		}
+
+		ctx := components.WithBlockedUsers(r.Context(), blocked)
+		return components.ChatWindow(cht, msgs).Render(ctx, w)
+	}
+}
+
+// muteDurations are the choices of time for which users are muted.
+var muteDurations = map[string]time.Duration{
+	"1h":   time.Hour,
+	"24h":  24 * time.Hour,
+	"168h": 7 * 24 * time.Hour,
+}
+
+// RestrictUser mutes, bans or lifts the restriction of the user given
+// by the id or the name.
+func (h *ChatHandler) RestrictUser(w http.ResponseWriter, r *http.Request) error {
+	cht, err := h.moderatedChat(r)
+	if err != nil {
+		return err
+	}
+
+	var user *internal.User
+	if userId := r.FormValue("userId"); userId != "" {
+		user, err = h.store.GetUserById(userId)
+	} else {
+		user, err = h.store.GetUser(strings.TrimSpace(r.FormValue("name")))
+	}
+	if err != nil {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "The user doesn't exist."}
+	}
+
+	memberId := user.Id.Hex()
+	if cht.Role(memberId).CanModerate() {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "Moderators can't be muted or banned."}
+	}
+
+	sesh := session.GetSession(r.Context())
+	action := internal.ModerationAction(r.FormValue("action"))
+	switch action {
+	case internal.ActionMuteAuthor:
+		duration, ok := muteDurations[r.FormValue("duration")]
+		if !ok {
+			return &httpError{status: http.StatusUnprocessableEntity, msg: "Unknown mute duration."}
+		}
+		err = cht.Mute(memberId, time.Now().Add(duration), sesh.User.Id)
+	case internal.ActionUnmute:
+		err = cht.Mute(memberId, time.Time{}, sesh.User.Id)
+	case internal.ActionBanAuthor:
+		err = cht.Ban(memberId, true, sesh.User.Id)
+	case internal.ActionUnban:
+		err = cht.Ban(memberId, false, sesh.User.Id)
+	default:
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "Unknown action."}
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.saveAuditEntry(&internal.AuditEntry{
+		ChatId:      cht.Id,
+		ModeratorId: sesh.User.Id,
+		Action:      action,
+		MemberId:    memberId,
+	})
+}
+
+func (h *ChatHandler) DeleteChat(w http.ResponseWriter, r *http.Request) error {
+	cht, err := h.ownedChat(r)
+	if err != nil {
+		return err
+	}
+
+	sesh := session.GetSession(r.Context())
+	return cht.Delete(sesh.User.Id)
+}
+
+// messageTTLs are the choices of age after which messages of chats
+// disappear.
+var messageTTLs = map[string]time.Duration{
+	"":     0,
+	"1h":   time.Hour,
+	"24h":  24 * time.Hour,
+	"168h": 7 * 24 * time.Hour,
+}
+
+func (h *ChatHandler) CreateChat(w http.ResponseWriter, r *http.Request) error {
+	r.ParseForm()
+	chatName := r.FormValue("chatName")
+	messageTTL, ok := messageTTLs[r.FormValue("messageTTL")]
+	if !ok {
+		return &httpError{status: http.StatusUnprocessableEntity, msg: "Unknown message lifetime."}
+	}
+	sesh := session.GetSession(r.Context())
+	h.hub.AddChat(chatName, sesh.User.Id, messageTTL)
+	return nil
+}
+
+type HttpClient struct {
+	id        string
+	userId    string
+	SessionId session.SessionId
+
+	// users blocked by the user of the client
+	blocked    []string
+	blockedMux sync.Mutex
+
+	conn    *websocket.Conn
+	connMux sync.Mutex
+
+	logger *slog.Logger
+}
+
+func NewHttpClient(conn *websocket.Conn, sessionId session.SessionId, userId string, logger *slog.Logger) *HttpClient {
+	return &HttpClient{
+		id:        sessionId.String(),
+		userId:    userId,
+		SessionId: sessionId,
+		conn:      conn,
+		connMux:   sync.Mutex{},
+		logger:    logger,
+	}
+}
+
+func (c *HttpClient) GetId() string     { return c.id }
+func (c *HttpClient) GetUserId() string { return c.userId }
+
+func (c *HttpClient) SetBlocked(userIds []string) {
+	c.blockedMux.Lock()
+	defer c.blockedMux.Unlock()
+	c.blocked = userIds
+}
+
+func (c *HttpClient) IsBlocked(userId string) bool {
+	c.blockedMux.Lock()
+	defer c.blockedMux.Unlock()
+	return slices.Contains(c.blocked, userId)
+}
+
+// renderContext carries what is needed to render components for the user.
+func (c *HttpClient) renderContext() context.Context {
+	c.blockedMux.Lock()
+	defer c.blockedMux.Unlock()
+
+	ctx := session.ContextWithSessionId(context.Background(), c.SessionId)
+	return components.WithBlockedUsers(ctx, c.blocked)
+}
+
+func (c *HttpClient) HandleEvent(evtType internal.EventType, evtData internal.EventData) {
+	ctx := c.renderContext()
+	var html bytes.Buffer
+
+	// banned users learn only about the ban
+	if evtData.Cht != nil && evtData.Cht.Banned(c.userId) && evtType != internal.Event_BanUser {
+		return
+	}
+
+	switch evtType {
+	case internal.Event_NewMessage:
+		if evtData.OnlySender && c.userId != evtData.SenderId {
+			break
+		}
+
+		if evtData.Connected {
+			msg := evtData.Msg
+			components.
+				MessagesList([]*internal.Message{msg}, true).
+				Render(ctx, &html)
+
+			// rejected messages aren't saved, so there are no actions on them
+			if msg.Status != internal.Error && msg.Status != internal.Rejected {
+				children := components.ContextMenu(evtData.Cht, msg, false)
+				ctx = templ.WithChildren(ctx, children)
+				components.ContextMenusWrapper(true).Render(ctx, &html)
+			}
+		} else if !evtData.OnlySender && !c.IsBlocked(evtData.SenderId) {
+			components.ChatListItem(evtData.Cht, "newMessage").Render(ctx, &html)
 		}
 
 	case
@@ -442,7 +1719,15 @@ func (c *HttpClient) HandleEvent(evtType internal.EventType, evtData internal.Ev
 		internal.Event_EditMessage,
 		internal.Event_HideMessage,
 		internal.Event_PinMessage:
-		if evtData.OnlySender && c.id != evtData.SenderId {
+		if evtData.OnlySender && c.userId != evtData.SenderId {
+			break
+		}
+
+		// purged messages vanish instead of showing as deleted
+		if evtType == internal.Event_DeleteMessage && evtData.Cht.Expired(evtData.Msg, time.Now()) {
+			if evtData.Connected {
+				components.ExpiredMessage(evtData.Msg).Render(ctx, &html)
+			}
 			break
 		}
 
@@ -454,7 +1739,7 @@ func (c *HttpClient) HandleEvent(evtType internal.EventType, evtData internal.Ev
 				Render(ctx, &html)
 
 			components.
-				ContextMenu(msg, true).
+				ContextMenu(evtData.Cht, msg, true).
 				Render(ctx, &html)
 		} else {
 			components.ChatListItem(evtData.Cht, "newMessage").Render(ctx, &html)
@@ -465,6 +1750,45 @@ func (c *HttpClient) HandleEvent(evtType internal.EventType, evtData internal.Ev
 		components.
 			ChatList([]*internal.Chat{cht}).
 			Render(ctx, &html)
+
+	case
+		internal.Event_RenameChat,
+		internal.Event_DescribeChat,
+		internal.Event_ArchiveChat,
+		internal.Event_SetRole,
+		internal.Event_MuteUser:
+		cht := evtData.Cht
+
+		if evtData.Connected {
+			components.ChatHeader(cht, true).Render(ctx, &html)
+			components.ChatListItem(cht, "active").Render(ctx, &html)
+			// posting depends on the archive, the role and mutes
+			if evtType != internal.Event_RenameChat && evtType != internal.Event_DescribeChat {
+				components.ChatFooter(cht, true).Render(ctx, &html)
+			}
+		} else {
+			components.ChatListItem(cht, "").Render(ctx, &html)
+		}
+
+	case internal.Event_DeleteChat:
+		components.RemovedChatListItem(evtData.Cht).Render(ctx, &html)
+		if evtData.Connected {
+			components.EmptyChatWindow().Render(ctx, &html)
+		}
+
+	case internal.Event_BanUser:
+		if !evtData.Cht.Banned(c.userId) {
+			break
+		}
+
+		components.RemovedChatListItem(evtData.Cht).Render(ctx, &html)
+		if evtData.Connected {
+			components.EmptyChatWindow().Render(ctx, &html)
+		}
+	}
+
+	if html.Len() == 0 {
+		return
 	}
 
 	c.Send(html.Bytes())
@@ -478,3 +1802,62 @@ func (c *HttpClient) Send(data []byte) {
 		c.logger.Error("Failed to write message to http client", slog.Any("error", err))
 	}
 }
+
+// AdminOnly allows the handler only for users listed as admins.
+func (h *ChatHandler) AdminOnly(next func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		sesh := session.GetSession(r.Context())
+		if !h.admins[sesh.User.Name] {
+			return &httpError{status: http.StatusForbidden, msg: "You are not allowed to see this page."}
+		}
+		return next(w, r)
+	}
+}
+
+// UsagePage lists storage usage of users, the most using first.
+func (h *ChatHandler) UsagePage(w http.ResponseWriter, r *http.Request) error {
+	usage, global, err := h.usage.GetUsersStorageUsage(r.Context())
+	if err != nil {
+		return err
+	}
+
+	users := make([]components.UserUsage, 0, len(usage))
+	for id, bytes := range usage {
+		name := id
+		if user, err := h.store.GetUserById(id); err == nil {
+			name = user.Name
+		}
+		users = append(users, components.UserUsage{Id: id, Name: name, Bytes: bytes})
+	}
+	slices.SortFunc(users, func(a, b components.UserUsage) int {
+		return cmp.Compare(b.Bytes, a.Bytes)
+	})
+
+	limits := components.UsageLimits{UserBytes: h.quotas.UserBytes, GlobalBytes: h.quotas.GlobalBytes}
+
+	var bb bytes.Buffer
+	components.UsagePage(users, global, limits).Render(r.Context(), &bb)
+	bb.WriteTo(w)
+	return nil
+}
+
+func (h *ChatHandler) ResetUsage(w http.ResponseWriter, r *http.Request) error {
+	userId := r.PathValue("userId")
+	if err := h.usage.ResetStorageUsage(r.Context(), userId); err != nil {
+		return err
+	}
+
+	sesh := session.GetSession(r.Context())
+	log.Ctx(r.Context()).Info("Storage usage reset", slog.String("user", userId), slog.String("by", sesh.User.Name))
+	return h.UsagePage(w, r)
+}
+
+func (h *ChatHandler) ResetAllUsage(w http.ResponseWriter, r *http.Request) error {
+	if err := h.usage.ResetAllStorageUsage(r.Context()); err != nil {
+		return err
+	}
+
+	sesh := session.GetSession(r.Context())
+	log.Ctx(r.Context()).Info("Storage usage of all users reset", slog.String("by", sesh.User.Name))
+	return h.UsagePage(w, r)
+}
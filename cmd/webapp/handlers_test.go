@@ -0,0 +1,899 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/config"
+	"github.com/ellezio/Chat-app-with-Go/internal/log"
+	"github.com/ellezio/Chat-app-with-Go/internal/session"
+	"github.com/ellezio/Chat-app-with-Go/internal/store"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+	}
+
+	tests := []struct {
+		name     string
+		remote   string
+		realIP   string
+		forwards string
+		expected string
+	}{
+		{"direct", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"headers of untrusted client", "203.0.113.7:5000", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"real ip from proxy", "10.0.0.1:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"forwarded from proxy", "10.0.0.1:5000", "", "198.51.100.9, 198.51.100.1", "198.51.100.1"},
+		{"forwarded through proxies", "10.0.0.1:5000", "", "198.51.100.1, 172.17.0.2", "198.51.100.1"},
+		{"proxy without headers", "10.0.0.1:5000", "", "", "10.0.0.1"},
+		{"invalid real ip", "172.17.0.1:5000", "unknown", "198.51.100.1", "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/login", nil)
+			r.RemoteAddr = tt.remote
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.forwards != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwards)
+			}
+
+			if got := clientIP(r, proxies); got != tt.expected {
+				t.Errorf("got %q expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+// fakeStore keeps chats, messages and users in memory, methods which
+// aren't used by the tests panic.
+type fakeStore struct {
+	internal.Store
+
+	mu        sync.Mutex
+	chats     []*internal.Chat
+	messages  []*internal.Message
+	scheduled []*internal.Message
+	users     map[string]*internal.User
+	blocks    map[string][]string
+	reports   []*internal.Report
+	audit     []*internal.AuditEntry
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		users:  make(map[string]*internal.User),
+		blocks: make(map[string][]string),
+	}
+}
+
+// addChat adds a chat owned by the user.
+func (s *fakeStore) addChat(ownerId string) *internal.Chat {
+	cht := internal.NewChat("general", s)
+	cht.Id = bson.NewObjectID().Hex()
+	cht.OwnerId = ownerId
+	cht.Mutes = make(map[string]time.Time)
+	s.chats = append(s.chats, cht)
+	return cht
+}
+
+func (s *fakeStore) addUser(id string) {
+	s.users[id] = &internal.User{Name: id}
+}
+
+// addNamedUser adds a user with a generated id, the id is returned.
+func (s *fakeStore) addNamedUser(name string) string {
+	id := bson.NewObjectID()
+	s.users[id.Hex()] = &internal.User{Id: id, Name: name}
+	return id.Hex()
+}
+
+// addMessage adds a text message sent by the user.
+func (s *fakeStore) addMessage(cht *internal.Chat, authorId string, content string) *internal.Message {
+	msg := internal.New(cht.Id, authorId, content, internal.TextMessage)
+	msg.Id = bson.NewObjectID()
+	msg.Author = internal.User{Name: authorId}
+	msg.Status = internal.Sent
+	s.messages = append(s.messages, msg)
+	return msg
+}
+
+func (s *fakeStore) GetChats() ([]*internal.Chat, error) {
+	return s.chats, nil
+}
+
+func (s *fakeStore) GetMessages(chatId string) ([]*internal.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*internal.Message
+	for _, msg := range s.messages {
+		if msg.ChatId.Hex() == chatId {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (s *fakeStore) GetMessage(id string) (*internal.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range s.messages {
+		if msg.Id.Hex() == id {
+			return msg, nil
+		}
+	}
+	return nil, store.ErrNoRecord
+}
+
+func (s *fakeStore) ScheduleMessage(msg *internal.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg.Id = bson.NewObjectID()
+	msg.Status = internal.Scheduled
+	s.scheduled = append(s.scheduled, msg)
+	return nil
+}
+
+func (s *fakeStore) GetScheduledMessages(chatId string, authorId string) ([]*internal.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*internal.Message
+	for _, msg := range s.scheduled {
+		if msg.ChatId.Hex() == chatId && msg.AuthorId == authorId {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (s *fakeStore) UpdateScheduledMessage(id string, authorId string, content string, at time.Time) (*internal.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range s.scheduled {
+		if msg.Id.Hex() == id && msg.AuthorId == authorId {
+			msg.Content = content
+			msg.ScheduledAt = at
+			return msg, nil
+		}
+	}
+	return nil, store.ErrNoRecord
+}
+
+func (s *fakeStore) BlockUser(blockerId string, blockedId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !slices.Contains(s.blocks[blockerId], blockedId) {
+		s.blocks[blockerId] = append(s.blocks[blockerId], blockedId)
+	}
+	return nil
+}
+
+func (s *fakeStore) UnblockUser(blockerId string, blockedId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocks[blockerId] = slices.DeleteFunc(s.blocks[blockerId], func(id string) bool { return id == blockedId })
+	return nil
+}
+
+func (s *fakeStore) GetBlockedUsers(blockerId string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.blocks[blockerId]), nil
+}
+
+func (s *fakeStore) GetUserById(id string) (*internal.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok {
+		return user, nil
+	}
+	return nil, store.ErrNoRecord
+}
+
+func (s *fakeStore) GetUser(name string) (*internal.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Name == name {
+			return user, nil
+		}
+	}
+	return nil, store.ErrNoRecord
+}
+
+type testServer struct {
+	handler http.Handler
+	hub     *internal.Hub
+	usage   *store.RedisStore
+
+	mu     sync.Mutex
+	events []internal.ChatEvent
+}
+
+// newTestServer serves the webapp with the store, the file server and the
+// config, events of chats are recorded instead of being published.
+func newTestServer(t *testing.T, st internal.Store, fileServer string, cfg config.Webapp) *testServer {
+	prev := log.DefaultContextLogger
+	log.DefaultContextLogger = slog.New(slog.DiscardHandler)
+	t.Cleanup(func() { log.DefaultContextLogger = prev })
+
+	var uploader *FileUploader
+	if fileServer != "" {
+		u, err := url.Parse(fileServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploader = NewFileUploader(u.Hostname(), u.Port(), "secret")
+	}
+
+	mr := miniredis.RunT(t)
+	usage := store.NewRedisStore(config.Redis{Addr: mr.Addr()})
+
+	h, hub := newChatHandler(st, uploader, usage, cfg)
+	ts := &testServer{handler: setupMux(h), hub: hub, usage: usage}
+	hub.SetPublisher(func(event internal.ChatEvent) error {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.events = append(ts.events, event)
+		return nil
+	})
+	return ts
+}
+
+// newSession returns a session of the user.
+func newSession(userId string) *session.Session {
+	sesh := session.New()
+	sesh.User = session.UserData{Id: userId, Name: userId}
+	sesh.Save()
+	return sesh
+}
+
+// do sends the request as the user.
+func (ts *testServer) do(userId string, req *http.Request) *httptest.ResponseRecorder {
+	req.AddCookie(&http.Cookie{Name: "sessionId", Value: newSession(userId).Id.String()})
+
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (ts *testServer) published() []internal.ChatEvent {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return slices.Clone(ts.events)
+}
+
+// fakeUploadServer serves resumable uploads like the file server, files
+// are stored after the last chunk.
+type fakeUploadServer struct {
+	mu      sync.Mutex
+	uploads map[string]*fakeUpload
+	stored  int
+}
+
+type fakeUpload struct {
+	length, offset int64
+	metadata       string
+}
+
+func newFakeUploadServer(t *testing.T) (*fakeUploadServer, string) {
+	fs := &fakeUploadServer{uploads: make(map[string]*fakeUpload)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /uploads", func(w http.ResponseWriter, r *http.Request) {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		length, _ := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		id := fmt.Sprintf("%032x", len(fs.uploads)+1)
+		fs.uploads[id] = &fakeUpload{length: length, metadata: r.Header.Get("Upload-Metadata")}
+		w.Header().Set("Location", "/uploads/"+id)
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("HEAD /uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		u, ok := fs.uploads[r.PathValue("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		u.writeHeaders(w)
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("PATCH /uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		u, ok := fs.uploads[r.PathValue("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		u.offset += n
+		u.writeHeaders(w)
+		if u.offset < u.length {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		fs.stored++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(UploadedFile{Name: "abc.txt", MIME: "text/plain", Size: u.length})
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return fs, srv.URL
+}
+
+// offset returns the offset of the only upload.
+func (fs *fakeUploadServer) offset() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, u := range fs.uploads {
+		return int(u.offset)
+	}
+	return 0
+}
+
+func (u *fakeUpload) writeHeaders(w http.ResponseWriter) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.length, 10))
+	w.Header().Set("Upload-Metadata", u.metadata)
+}
+
+func TestResumableUpload_BoundToChatAndUser(t *testing.T) {
+	st := newFakeStore()
+	cht, other := st.addChat("alice"), st.addChat("alice")
+	fs, fileServer := newFakeUploadServer(t)
+	ts := newTestServer(t, st, fileServer, config.Webapp{})
+
+	create := httptest.NewRequest("POST", "/chats/"+cht.Id+"/uploads", nil)
+	create.Header.Set("Upload-Length", "10")
+	create.Header.Set("Upload-Filename", "notes.txt")
+	rec := ts.do("bob", create)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create returned %d", rec.Code)
+	}
+	location := rec.Header().Get("Location")
+
+	patch := func(userId string, target string, chunk string) int {
+		req := httptest.NewRequest("PATCH", target, strings.NewReader(chunk))
+		req.Header.Set("Upload-Offset", strconv.Itoa(fs.offset()))
+		return ts.do(userId, req).Code
+	}
+
+	if code := ts.do("carol", httptest.NewRequest("HEAD", location, nil)).Code; code != http.StatusNotFound {
+		t.Errorf("status of upload of other user returned %d", code)
+	}
+	if code := patch("carol", location, "hello"); code != http.StatusNotFound {
+		t.Errorf("chunk from other user returned %d", code)
+	}
+	otherChat := strings.Replace(location, cht.Id, other.Id, 1)
+	if code := patch("bob", otherChat, "hello"); code != http.StatusNotFound {
+		t.Errorf("chunk sent to other chat returned %d", code)
+	}
+	if fs.offset() != 0 {
+		t.Fatalf("rejected chunks were stored, offset %d", fs.offset())
+	}
+
+	if code := patch("bob", location, "hello"); code != http.StatusNoContent {
+		t.Fatalf("first chunk returned %d", code)
+	}
+
+	// the user is muted before the last chunk
+	cht.Mutes["bob"] = time.Now().Add(time.Hour)
+	if code := patch("bob", location, "world"); code != http.StatusForbidden {
+		t.Errorf("chunk of muted user returned %d", code)
+	}
+	if fs.stored != 0 || len(ts.published()) != 0 {
+		t.Fatal("file of muted user was stored or sent")
+	}
+	if used, _, _ := ts.usage.GetStorageUsage(t.Context(), "bob"); used != 0 {
+		t.Errorf("muted user was charged %d bytes", used)
+	}
+
+	delete(cht.Mutes, "bob")
+	if code := patch("bob", location, "world"); code != http.StatusCreated {
+		t.Fatalf("last chunk returned %d", code)
+	}
+	events := ts.published()
+	if len(events) != 1 || events[0].Type != internal.Event_NewMessage || events[0].UserId != "bob" || events[0].ChatId != cht.Id {
+		t.Errorf("expected a message from bob in the chat, published %+v", events)
+	}
+	if used, _, _ := ts.usage.GetStorageUsage(t.Context(), "bob"); used != 10 {
+		t.Errorf("user was charged %d bytes expected 10", used)
+	}
+}
+
+const blockedMessageSummary = "Message from a blocked user"
+
+func TestBlockUser(t *testing.T) {
+	st := newFakeStore()
+	cht := st.addChat("carol")
+	st.addUser("alice")
+	st.addUser("bob")
+	st.addMessage(cht, "bob", "hello from bob")
+	ts := newTestServer(t, st, "", config.Webapp{})
+
+	client := NewHttpClient(nil, newSession("alice").Id, "alice", slog.New(slog.DiscardHandler))
+	if _, _, err := ts.hub.ConnectClient(cht.Id, client); err != nil {
+		t.Fatal(err)
+	}
+
+	block := func(action string, userId string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/users/"+userId+"/"+action, strings.NewReader("chatId="+cht.Id))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return ts.do("alice", req)
+	}
+
+	rec := block("block", "bob")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("block returned %d", rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, blockedMessageSummary) || !strings.Contains(body, "hello from bob") {
+		t.Errorf("message of blocked user isn't collapsed in the chat:\n%s", body)
+	}
+	if blocked, _ := st.GetBlockedUsers("alice"); !slices.Equal(blocked, []string{"bob"}) {
+		t.Errorf("blocked users are %q", blocked)
+	}
+	if !client.IsBlocked("bob") {
+		t.Error("connected client doesn't know about the block")
+	}
+
+	// blocking again keeps a single block
+	block("block", "bob")
+	if blocked, _ := st.GetBlockedUsers("alice"); len(blocked) != 1 {
+		t.Errorf("blocked users are %q", blocked)
+	}
+
+	rec = block("unblock", "bob")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unblock returned %d", rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, blockedMessageSummary) || !strings.Contains(body, "hello from bob") {
+		t.Errorf("message of unblocked user isn't shown:\n%s", body)
+	}
+	if blocked, _ := st.GetBlockedUsers("alice"); len(blocked) != 0 {
+		t.Errorf("blocked users are %q", blocked)
+	}
+	if client.IsBlocked("bob") {
+		t.Error("connected client doesn't know about the unblock")
+	}
+
+	if code := block("block", "alice").Code; code != http.StatusUnprocessableEntity {
+		t.Errorf("blocking yourself returned %d", code)
+	}
+	if code := block("block", "nobody").Code; code != http.StatusUnprocessableEntity {
+		t.Errorf("blocking unknown user returned %d", code)
+	}
+}
+
+func TestHttpClient_CollapsesMessagesOfBlockedUsers(t *testing.T) {
+	st := newFakeStore()
+	cht := st.addChat("carol")
+
+	// the client writes to the server side of a websocket connection
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	conn := <-conns
+	defer conn.Close()
+
+	client := NewHttpClient(conn, newSession("alice").Id, "alice", slog.New(slog.DiscardHandler))
+	client.SetBlocked([]string{"bob"})
+
+	tests := []struct {
+		author    string
+		collapsed bool
+	}{
+		{"bob", true},
+		{"dave", false},
+	}
+
+	for _, tt := range tests {
+		msg := st.addMessage(cht, tt.author, "hello from "+tt.author)
+		client.HandleEvent(internal.Event_NewMessage, internal.EventData{Msg: msg, Cht: cht, Connected: true})
+
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, html, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if collapsed := strings.Contains(string(html), blockedMessageSummary); collapsed != tt.collapsed {
+			t.Errorf("message from %s collapsed %v expected %v:\n%s", tt.author, collapsed, tt.collapsed, html)
+		}
+	}
+}
+
+func (s *fakeStore) SaveReport(report *internal.Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if report.ReporterId != "" && slices.ContainsFunc(s.reports, func(r *internal.Report) bool {
+		return r.MessageId == report.MessageId && r.ReporterId == report.ReporterId
+	}) {
+		return store.ErrDuplicateReport
+	}
+	report.Id = bson.NewObjectID()
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func (s *fakeStore) GetReport(id string) (*internal.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.reports {
+		if r.Id.Hex() == id {
+			report := *r
+			return &report, nil
+		}
+	}
+	return nil, store.ErrNoRecord
+}
+
+func (s *fakeStore) GetOpenReports(chatIds []string) ([]*internal.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reports []*internal.Report
+	for _, r := range s.reports {
+		if r.Status == internal.ReportOpen && slices.Contains(chatIds, r.ChatId) {
+			reports = append(reports, r)
+		}
+	}
+	return reports, nil
+}
+
+func (s *fakeStore) CloseReport(id string, action internal.ModerationAction, moderatorId string) (*internal.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.reports {
+		if r.Id.Hex() == id && r.Status == internal.ReportOpen {
+			r.Status, r.Action, r.ModeratorId = internal.ReportResolved, action, moderatorId
+			if action == internal.ActionDismiss {
+				r.Status = internal.ReportDismissed
+			}
+			return r, nil
+		}
+	}
+	return nil, store.ErrNoRecord
+}
+
+func (s *fakeStore) SaveAuditEntry(entry *internal.AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+func (s *fakeStore) GetAuditLog(chatIds []string, limit int64) ([]*internal.AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.audit), nil
+}
+
+// reportRequest reports the message with the reason.
+func reportRequest(msg *internal.Message, reason string) *http.Request {
+	req := httptest.NewRequest("POST", fmt.Sprintf("/chats/%s/messages/%s/report", msg.ChatId.Hex(), msg.Id.Hex()), nil)
+	req.Header.Set("HX-Prompt", reason)
+	return req
+}
+
+func TestReportMessage_OncePerUser(t *testing.T) {
+	st := newFakeStore()
+	cht := st.addChat("carol")
+	msg := st.addMessage(cht, "bob", "buy cheap pills")
+	ts := newTestServer(t, st, "", config.Webapp{})
+
+	tests := []struct {
+		name     string
+		userId   string
+		expected int
+	}{
+		{"first report", "alice", http.StatusOK},
+		{"same user again", "alice", http.StatusConflict},
+		{"other user", "dave", http.StatusOK},
+		{"own message", "bob", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := ts.do(tt.userId, reportRequest(msg, "spam")).Code; code != tt.expected {
+				t.Errorf("report returned %d expected %d", code, tt.expected)
+			}
+		})
+	}
+
+	reports, _ := st.GetOpenReports([]string{cht.Id})
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %d", len(reports))
+	}
+	for _, r := range reports {
+		if r.MessageId != msg.Id.Hex() || r.AuthorId != "bob" || r.Reason != "spam" {
+			t.Errorf("unexpected report %+v", r)
+		}
+	}
+}
+
+func TestModeration_OnlyModerators(t *testing.T) {
+	st := newFakeStore()
+	cht := st.addChat("carol")
+	cht.Members = map[string]internal.Role{"mia": internal.RoleModerator}
+	msg := st.addMessage(cht, "bob", "buy cheap pills")
+	ts := newTestServer(t, st, "", config.Webapp{})
+
+	if code := ts.do("alice", reportRequest(msg, "spam")).Code; code != http.StatusOK {
+		t.Fatalf("report returned %d", code)
+	}
+	report := st.reports[0]
+
+	for _, userId := range []string{"alice", "bob"} {
+		if code := ts.do(userId, httptest.NewRequest("GET", "/moderation", nil)).Code; code != http.StatusForbidden {
+			t.Errorf("reports listed for %s with %d", userId, code)
+		}
+		req := httptest.NewRequest("POST", "/moderation/reports/"+report.Id.Hex()+"/dismiss", nil)
+		if code := ts.do(userId, req).Code; code != http.StatusForbidden {
+			t.Errorf("report resolved by %s with %d", userId, code)
+		}
+	}
+	if report.Status != internal.ReportOpen {
+		t.Fatalf("report closed by a member, status %q", report.Status)
+	}
+
+	for _, userId := range []string{"carol", "mia"} {
+		rec := ts.do(userId, httptest.NewRequest("GET", "/moderation", nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "buy cheap pills") {
+			t.Errorf("reports not listed for %s, status %d", userId, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/moderation/reports/"+report.Id.Hex()+"/dismiss", nil)
+	if code := ts.do("mia", req).Code; code != http.StatusOK {
+		t.Fatalf("dismiss returned %d", code)
+	}
+	if report.Status != internal.ReportDismissed || report.ModeratorId != "mia" {
+		t.Errorf("report has status %q closed by %q", report.Status, report.ModeratorId)
+	}
+	if len(ts.published()) != 0 {
+		t.Errorf("dismissal published %+v", ts.published())
+	}
+}
+
+func TestModerateReport_DeleteRemovesMessage(t *testing.T) {
+	st := newFakeStore()
+	cht := st.addChat("carol")
+	msg := st.addMessage(cht, "bob", "buy cheap pills")
+	ts := newTestServer(t, st, "", config.Webapp{})
+
+	if code := ts.do("alice", reportRequest(msg, "spam")).Code; code != http.StatusOK {
+		t.Fatalf("report returned %d", code)
+	}
+	report := st.reports[0]
+
+	req := httptest.NewRequest("POST", "/moderation/reports/"+report.Id.Hex()+"/delete", nil)
+	if code := ts.do("carol", req).Code; code != http.StatusOK {
+		t.Fatalf("delete returned %d", code)
+	}
+
+	// the chat server deletes the message on the event of the moderator
+	events := ts.published()
+	if len(events) != 1 {
+		t.Fatalf("expected a single event, published %+v", events)
+	}
+	details, _ := events[0].Details.(internal.MessageEventDetails)
+	if events[0].Type != internal.Event_DeleteMessage || events[0].UserId != "carol" || details.Id != msg.Id.Hex() {
+		t.Errorf("expected deletion of the message by the moderator, published %+v", events[0])
+	}
+
+	if report.Status != internal.ReportResolved || report.Action != internal.ActionDeleteMessage {
+		t.Errorf("report has status %q with action %q", report.Status, report.Action)
+	}
+	if len(st.audit) != 1 || st.audit[0].MessageId != msg.Id.Hex() || st.audit[0].MemberId != "bob" {
+		t.Errorf("unexpected audit log %+v", st.audit)
+	}
+
+	// the report is closed, so the message isn't deleted twice
+	if code := ts.do("carol", req).Code; code != http.StatusUnprocessableEntity {
+		t.Errorf("delete of closed report returned %d", code)
+	}
+	if len(ts.published()) != 1 {
+		t.Error("closed report published another event")
+	}
+}
+
+func TestRestrictUser_RecordedInAuditLog(t *testing.T) {
+	st := newFakeStore()
+	cht := st.addChat("carol")
+	cht.Members = map[string]internal.Role{"mia": internal.RoleModerator}
+	bobId := st.addNamedUser("bob")
+	ts := newTestServer(t, st, "", config.Webapp{})
+
+	restrict := func(userId string, action string) int {
+		form := url.Values{"userId": {bobId}, "action": {action}, "duration": {"1h"}}
+		req := httptest.NewRequest("PUT", "/chats/"+cht.Id+"/restrictions", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return ts.do(userId, req).Code
+	}
+
+	if code := restrict("alice", "ban"); code != http.StatusForbidden {
+		t.Fatalf("ban by a member returned %d", code)
+	}
+	if len(st.audit) != 0 {
+		t.Fatalf("rejected ban was recorded %+v", st.audit)
+	}
+
+	tests := []struct {
+		action   string
+		expected internal.ModerationAction
+	}{
+		{"mute", internal.ActionMuteAuthor},
+		{"unmute", internal.ActionUnmute},
+		{"ban", internal.ActionBanAuthor},
+		{"unban", internal.ActionUnban},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			if code := restrict("mia", tt.action); code != http.StatusOK {
+				t.Fatalf("%s returned %d", tt.action, code)
+			}
+			if len(st.audit) != i+1 {
+				t.Fatalf("expected %d audit entries, got %d", i+1, len(st.audit))
+			}
+			entry := st.audit[i]
+			if entry.ChatId != cht.Id || entry.ModeratorId != "mia" || entry.MemberId != bobId || entry.Action != tt.expected || entry.CreatedAt.IsZero() {
+				t.Errorf("unexpected audit entry %+v", entry)
+			}
+		})
+	}
+}
+
+func TestModeratorActions_RecordedInAuditLog(t *testing.T) {
+	st := newFakeStore()
+	cht := st.addChat("carol")
+	cht.Members = map[string]internal.Role{"mia": internal.RoleModerator}
+	bobId := st.addNamedUser("bob")
+	ts := newTestServer(t, st, "", config.Webapp{})
+
+	deleteMessage := func(userId string, msg *internal.Message) {
+		t.Helper()
+		req := httptest.NewRequest("DELETE", fmt.Sprintf("/chats/%s/messages/%s", cht.Id, msg.Id.Hex()), nil)
+		if code := ts.do(userId, req).Code; code != http.StatusOK {
+			t.Fatalf("delete returned %d", code)
+		}
+	}
+
+	// authors deleting their messages aren't moderating
+	deleteMessage("alice", st.addMessage(cht, "alice", "typo"))
+	if len(st.audit) != 0 {
+		t.Fatalf("deletion by the author was recorded %+v", st.audit)
+	}
+
+	msg := st.addMessage(cht, "bob", "buy cheap pills")
+	deleteMessage("mia", msg)
+	if len(st.audit) != 1 {
+		t.Fatalf("expected an audit entry, got %d", len(st.audit))
+	}
+	if entry := st.audit[0]; entry.Action != internal.ActionDeleteMessage || entry.ModeratorId != "mia" || entry.MessageId != msg.Id.Hex() || entry.MemberId != "bob" {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+
+	form := url.Values{"name": {"bob"}, "role": {string(internal.RoleModerator)}}
+	req := httptest.NewRequest("PUT", "/chats/"+cht.Id+"/roles", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if code := ts.do("carol", req).Code; code != http.StatusOK {
+		t.Fatalf("set role returned %d", code)
+	}
+	if len(st.audit) != 2 {
+		t.Fatalf("expected 2 audit entries, got %d", len(st.audit))
+	}
+	if entry := st.audit[1]; entry.Action != internal.ActionSetRole || entry.ModeratorId != "carol" || entry.MemberId != bobId || entry.Role != internal.RoleModerator {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+}
+
+func TestRateLimit_MessageActions(t *testing.T) {
+	st := newFakeStore()
+	cht := st.addChat("carol")
+	cfg := config.Webapp{RateLimits: config.RateLimits{
+		Messages: config.RateLimitScopes{User: config.RateLimit{PerMinute: 0.01, Burst: 2}},
+	}}
+	ts := newTestServer(t, st, "", cfg)
+
+	scheduledForm := func() url.Values {
+		return url.Values{
+			"msg":         {"see you"},
+			"scheduledAt": {time.Now().Add(time.Hour).UTC().Format(time.RFC3339)},
+		}
+	}
+	formRequest := func(method string, target string, form url.Values) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	tests := []struct {
+		name    string
+		userId  string
+		request func() *http.Request
+	}{
+		{"edit", "alice", func() *http.Request {
+			msg := st.addMessage(cht, "alice", "hello")
+			target := fmt.Sprintf("/chats/%s/messages/%s/edit", cht.Id, msg.Id.Hex())
+			return formRequest("PUT", target, url.Values{"msgContent": {"hello again"}})
+		}},
+		{"schedule", "bob", func() *http.Request {
+			return formRequest("POST", "/chats/"+cht.Id+"/scheduled", scheduledForm())
+		}},
+		{"reschedule", "dave", func() *http.Request {
+			msg := internal.New(cht.Id, "dave", "see you", internal.TextMessage)
+			st.ScheduleMessage(msg)
+			target := fmt.Sprintf("/chats/%s/scheduled/%s", cht.Id, msg.Id.Hex())
+			return formRequest("PUT", target, scheduledForm())
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range 2 {
+				if code := ts.do(tt.userId, tt.request()).Code; code != http.StatusOK {
+					t.Fatalf("request %d returned %d", i+1, code)
+				}
+			}
+
+			rec := ts.do(tt.userId, tt.request())
+			if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+				t.Errorf("request over the limit returned %d", rec.Code)
+			}
+		})
+	}
+}
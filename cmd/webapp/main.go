@@ -2,16 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/ellezio/Chat-app-with-Go/internal/config"
 	"github.com/ellezio/Chat-app-with-Go/internal/log"
 	"github.com/ellezio/Chat-app-with-Go/internal/session"
+	"github.com/ellezio/Chat-app-with-Go/internal/signedurl"
 	"github.com/ellezio/Chat-app-with-Go/internal/store"
 	"github.com/ellezio/Chat-app-with-Go/web/components"
 )
@@ -33,7 +36,18 @@ func setupMux(chatHandler *ChatHandler) http.Handler {
 	loginMux.HandleFunc("GET /chat/{chatId}", handleError(chatHandler.ChatPage))
 	loginMux.HandleFunc("GET /chatroom", handleError(chatHandler.Chatroom))
 	loginMux.HandleFunc("POST /chats", handleError(chatHandler.CreateChat))
+	loginMux.HandleFunc("PUT /chats/{chatId}", handleError(chatHandler.UpdateChat))
+	loginMux.HandleFunc("DELETE /chats/{chatId}", handleError(chatHandler.DeleteChat))
+	loginMux.HandleFunc("PUT /chats/{chatId}/archive", handleError(chatHandler.ArchiveChat(true)))
+	loginMux.HandleFunc("PUT /chats/{chatId}/unarchive", handleError(chatHandler.ArchiveChat(false)))
+	loginMux.HandleFunc("PUT /chats/{chatId}/roles", handleError(chatHandler.SetRole))
+	loginMux.HandleFunc("PUT /chats/{chatId}/restrictions", handleError(chatHandler.RestrictUser))
+	loginMux.HandleFunc("PUT /users/{userId}/block", handleError(chatHandler.BlockUser(true)))
+	loginMux.HandleFunc("PUT /users/{userId}/unblock", handleError(chatHandler.BlockUser(false)))
 	loginMux.HandleFunc("POST /chats/{chatId}/uploadfile", handleError(chatHandler.UploadFile))
+	loginMux.HandleFunc("POST /chats/{chatId}/uploads", handleError(chatHandler.CreateUpload))
+	loginMux.HandleFunc("HEAD /chats/{chatId}/uploads/{uploadId}", handleError(chatHandler.UploadStatus))
+	loginMux.HandleFunc("PATCH /chats/{chatId}/uploads/{uploadId}", handleError(chatHandler.PatchUpload))
 	loginMux.HandleFunc("GET /chats/{chatId}/messages/{messageId}", handleError(chatHandler.GetMessage))
 	loginMux.HandleFunc("GET /chats/{chatId}/messages/{messageId}/edit", handleError(chatHandler.GetMessageEdit))
 	loginMux.HandleFunc("PUT /chats/{chatId}/messages/{messageId}/edit", handleError(chatHandler.PostMessageEdit))
@@ -41,7 +55,21 @@ func setupMux(chatHandler *ChatHandler) http.Handler {
 	loginMux.HandleFunc("PUT /chats/{chatId}/messages/{messageId}/hide", handleError(chatHandler.MessageHide(true)))
 	loginMux.HandleFunc("PUT /chats/{chatId}/messages/{messageId}/show", handleError(chatHandler.MessageHide(false)))
 	loginMux.HandleFunc("DELETE /chats/{chatId}/messages/{messageId}", handleError(chatHandler.MessageDelete))
+	loginMux.HandleFunc("POST /chats/{chatId}/messages/{messageId}/report", handleError(chatHandler.ReportMessage))
 	loginMux.HandleFunc("POST /chats/{chatId}/messages", handleError(chatHandler.NewMessage))
+	loginMux.HandleFunc("POST /chats/{chatId}/polls", handleError(chatHandler.CreatePoll))
+	loginMux.HandleFunc("GET /chats/{chatId}/scheduled", handleError(chatHandler.ScheduledMessages))
+	loginMux.HandleFunc("POST /chats/{chatId}/scheduled", handleError(chatHandler.ScheduleMessage))
+	loginMux.HandleFunc("GET /chats/{chatId}/scheduled/{messageId}/edit", handleError(chatHandler.GetScheduledEdit))
+	loginMux.HandleFunc("PUT /chats/{chatId}/scheduled/{messageId}", handleError(chatHandler.UpdateScheduled))
+	loginMux.HandleFunc("DELETE /chats/{chatId}/scheduled/{messageId}", handleError(chatHandler.CancelScheduled))
+	loginMux.HandleFunc("POST /chats/{chatId}/messages/{messageId}/vote", handleError(chatHandler.VotePoll))
+	loginMux.HandleFunc("POST /chats/{chatId}/messages/{messageId}/close", handleError(chatHandler.ClosePoll))
+	loginMux.HandleFunc("GET /moderation", handleError(chatHandler.ModerationPage))
+	loginMux.HandleFunc("POST /moderation/reports/{reportId}/{action}", handleError(chatHandler.ModerateReport))
+	loginMux.HandleFunc("GET /admin/usage", handleError(chatHandler.AdminOnly(chatHandler.UsagePage)))
+	loginMux.HandleFunc("POST /admin/usage/reset", handleError(chatHandler.AdminOnly(chatHandler.ResetAllUsage)))
+	loginMux.HandleFunc("POST /admin/usage/{userId}/reset", handleError(chatHandler.AdminOnly(chatHandler.ResetUsage)))
 	mux.Handle("/", AuthMiddleware(loginMux))
 
 	return session.Middleware(mux)
@@ -65,14 +93,36 @@ func handleError(h func(http.ResponseWriter, *http.Request) error) http.HandlerF
 
 		err := h(w, r)
 		if err != nil {
-			log.Ctx(r.Context()).Error("Handler returned error", slog.Any("error", err))
+			var herr *httpError
+			if errors.As(err, &herr) && herr.status < 500 {
+				log.Ctx(r.Context()).Info("Request rejected", slog.Any("error", err))
+			} else {
+				log.Ctx(r.Context()).Error("Handler returned error", slog.Any("error", err))
+			}
 			renderError(w, r, err)
 		}
 	}
 }
 
+// httpError is returned by handlers to show the message to the user
+// with the status other than 500.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
 func renderError(w http.ResponseWriter, r *http.Request, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
+	status := http.StatusInternalServerError
+	var herr *httpError
+	if errors.As(err, &herr) {
+		status = herr.status
+	}
+
+	w.WriteHeader(status)
 	if r.Header.Get("Hx-Request") == "true" {
 		if err := components.ErrorPopup(err.Error()).Render(r.Context(), w); err != nil {
 			log.Ctx(r.Context()).Error("failed to render error popup", slog.Any("error", err))
@@ -127,6 +177,13 @@ func main() {
 	flag.Parse()
 
 	cfg := readConfig()
+	components.CodeBlockCollapseLines = cfg.Webapp.CodeBlockCollapseLines
+	if cfg.Webapp.FileSigningKey != "" {
+		ttl := time.Duration(max(cfg.Webapp.FileURLTTLMinutes, 1)) * time.Minute
+		components.FileURLSigner = signedurl.New([]byte(cfg.Webapp.FileSigningKey), ttl)
+	} else {
+		logger.Warn("file signing key is not set, file URLs are not signed")
+	}
 
 	cache := store.NewRedisStore(cfg.Redis)
 	sto := store.NewMongodbStore(cfg.MongoDB, cache)
@@ -135,8 +192,8 @@ func main() {
 		panic(err)
 	}
 
-	fileUploader := NewFileUploader(*fileHost, *fielPort)
-	chatHandler, hub := newChatHandler(sto, fileUploader)
+	fileUploader := NewFileUploader(*fileHost, *fielPort, cfg.Webapp.FileAdminToken)
+	chatHandler, hub := newChatHandler(sto, fileUploader, cache, cfg.Webapp)
 	err = hub.Start(cfg.RabbitMQ)
 	if err != nil {
 		panic(err)
@@ -25,24 +25,72 @@ type MessageStatus string
 const (
 	TextMessage  MessageType = "text"
 	ImageMessage MessageType = "image"
+	FileMessage  MessageType = "file"
+	VoiceMessage MessageType = "voice"
+	PollMessage  MessageType = "poll"
+	// generated by the chat server to record events in the chat,
+	// the content describes what the author did
+	SystemMessage MessageType = "system"
 
 	Sending MessageStatus = "sending"
 	Sent    MessageStatus = "sent"
 	Error   MessageStatus = "error"
+	// the attached file waits for the malware scan
+	Scanning MessageStatus = "scanning"
+	// the attached file failed the malware scan
+	Infected MessageStatus = "infected"
+	// the attached file couldn't be scanned, it isn't served
+	ScanFailed MessageStatus = "scanFailed"
+	// waiting to be posted at the scheduled time
+	Scheduled MessageStatus = "scheduled"
+	// kept out of the chat by the content filter, it isn't saved
+	Rejected MessageStatus = "rejected"
+	// parts of the message were masked by the content filter
+	Masked MessageStatus = "masked"
+	// the content filter reported the message to moderators
+	Flagged MessageStatus = "flagged"
 )
 
+// FileMessageTypes are types of messages with content naming a stored file.
+var FileMessageTypes = []MessageType{ImageMessage, FileMessage, VoiceMessage}
+
 type Message struct {
-	Id         bson.ObjectID `json:"id"`
-	ChatId     bson.ObjectID `json:"chatId"`
-	AuthorId   string        `json:"authorId"`
-	Content    string        `json:"content"`
-	Type       MessageType   `json:"type"`
-	CreatedAt  time.Time     `json:"createdAt"`
-	ModifiedAt time.Time     `json:"modifiedAt"`
-	Status     MessageStatus `json:"status"`
-	HiddenFor  []string      `json:"hiddenFor"`
-	Deleted    bool          `json:"deleted"`
-	Author     User          `json:"author"`
+	Id          bson.ObjectID `json:"id"`
+	ChatId      bson.ObjectID `json:"chatId"`
+	AuthorId    string        `json:"authorId"`
+	Content     string        `json:"content"`
+	Type        MessageType   `json:"type"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	ModifiedAt  time.Time     `json:"modifiedAt"`
+	Status      MessageStatus `json:"status"`
+	HiddenFor   []string      `json:"hiddenFor"`
+	Deleted     bool          `json:"deleted"`
+	Previews    []LinkPreview `json:"previews"`
+	File        *FileInfo     `json:"file,omitempty"`
+	Poll        *Poll         `json:"poll,omitempty"`
+	ScheduledAt time.Time     `json:"scheduledAt,omitzero"` // time of posting scheduled messages
+	Author      User          `json:"author"`
+}
+
+// FileInfo describes a file attached to a message. The stored file name
+// is kept in the message content.
+type FileInfo struct {
+	Name     string  `bson:"name"               json:"name"`
+	Size     int64   `bson:"size"               json:"size"`
+	MIME     string  `bson:"mime"               json:"mime"`
+	Width    int     `bson:"width,omitempty"    json:"width,omitempty"`
+	Height   int     `bson:"height,omitempty"   json:"height,omitempty"`
+	Duration float64 `bson:"duration,omitempty" json:"duration,omitempty"` // seconds of audio and video
+}
+
+// LinkPreview holds metadata of a page linked in a message. Images of
+// pages are left out, loading them would reveal addresses of readers to
+// the linked site.
+type LinkPreview struct {
+	URL         string `bson:"url"         json:"url"`
+	Title       string `bson:"title"       json:"title"`
+	Description string `bson:"description" json:"description"`
+	SiteName    string `bson:"siteName"    json:"siteName"`
 }
 
 func (m *Message) MarshalBinary() ([]byte, error) {
@@ -116,6 +164,15 @@ const (
 	Event_DeleteMessage
 	Event_PinMessage
 	Event_NewChat
+	Event_VotePoll
+	Event_ClosePoll
+	Event_RenameChat
+	Event_DescribeChat
+	Event_ArchiveChat
+	Event_DeleteChat
+	Event_SetRole
+	Event_MuteUser
+	Event_BanUser
 )
 
 type MessageEventDetails struct {
@@ -125,9 +182,24 @@ type MessageEventDetails struct {
 	Status  MessageStatus `json:"status"`
 	Hidden  bool          `json:"hidden"`
 	Deleted bool          `json:"deleted"`
+	File    *FileInfo     `json:"file,omitempty"`
+	Poll    *Poll         `json:"poll,omitempty"`
+	// indexes of voted poll options
+	Votes []int `json:"votes,omitempty"`
 }
 
-type ChatEventDetails struct{}
+// ChatEventDetails are changes of the chat made by its owner.
+type ChatEventDetails struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Archived    bool   `json:"archived"`
+	// user whose role is set, who is muted or banned
+	MemberId string `json:"memberId,omitempty"`
+	Role     Role   `json:"role,omitempty"`
+	// end of the mute, zero unmutes the user
+	Until  time.Time `json:"until,omitzero"`
+	Banned bool      `json:"banned,omitempty"`
+}
 
 type ChatEvent struct {
 	Type    EventType `json:"type"`
@@ -153,7 +225,8 @@ func (ce *ChatEvent) UnmarshalJSON(data []byte) error {
 	ce.UserId = temp.UserId
 
 	switch temp.Type {
-	case Event_NewMessage, Event_EditMessage, Event_HideMessage, Event_DeleteMessage, Event_PinMessage:
+	case Event_NewMessage, Event_EditMessage, Event_HideMessage, Event_DeleteMessage, Event_PinMessage,
+		Event_VotePoll, Event_ClosePoll:
 		var details MessageEventDetails
 		if err := json.Unmarshal(temp.Details, &details); err != nil {
 			return err
@@ -171,6 +244,13 @@ func (ce *ChatEvent) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		ce.Details = &details
+	case Event_RenameChat, Event_DescribeChat, Event_ArchiveChat, Event_DeleteChat, Event_SetRole,
+		Event_MuteUser, Event_BanUser:
+		var details ChatEventDetails
+		if err := json.Unmarshal(temp.Details, &details); err != nil {
+			return err
+		}
+		ce.Details = details
 	default:
 		return fmt.Errorf("Event \"%v\" not recognised", temp.Type)
 	}
@@ -188,28 +268,69 @@ type EventData struct {
 
 type Client interface {
 	GetId() string
+	GetUserId() string
 	HandleEvent(evt EventType, data EventData)
 }
 
 type Store interface {
 	GetChats() ([]*Chat, error)
+	GetChat(chatId string) (*Chat, error)
 	SaveChat(cht *Chat) error
+	DeleteChat(chatId string) error
 
 	GetMessage(msgId string) (*Message, error)
 	GetMessages(chatId string) ([]*Message, error)
 	SaveMessage(msg *Message) error
+	SetMessageStatus(id string, status MessageStatus) (*Message, error)
 
 	UpdateMessageContent(id string, content string) (*Message, error)
 	SetHideMessage(id string, user string, value bool) (*Message, error)
 	DeleteMessage(id string) (*Message, error)
+	SetMessagePreviews(id string, previews []LinkPreview) (*Message, error)
+
+	VotePoll(id string, voter PollVoter, options []int) (*Message, error)
+	ClosePoll(id string, at time.Time) (*Message, error)
+
+	ScheduleMessage(msg *Message) error
+	GetScheduledMessages(chatId string, authorId string) ([]*Message, error)
+	UpdateScheduledMessage(id string, authorId string, content string, at time.Time) (*Message, error)
+	CancelScheduledMessage(id string, authorId string) error
 
 	GetUser(string) (*User, error)
+	GetUserById(string) (*User, error)
 	CreateUser(*User) error
+
+	BlockUser(blockerId string, blockedId string) error
+	UnblockUser(blockerId string, blockedId string) error
+	GetBlockedUsers(blockerId string) ([]string, error)
+
+	SaveReport(report *Report) error
+	GetReport(id string) (*Report, error)
+	GetOpenReports(chatIds []string) ([]*Report, error)
+	CloseReport(id string, action ModerationAction, moderatorId string) (*Report, error)
+	SaveAuditEntry(entry *AuditEntry) error
+	GetAuditLog(chatIds []string, limit int64) ([]*AuditEntry, error)
 }
 
 type Chat struct {
-	Id   string
-	Name string
+	Id          string
+	Name        string
+	Description string
+	// user who created the chat, only the owner can change it
+	OwnerId string
+	// archived chats are kept read-only
+	Archived bool
+	// roles of users other than members and the owner
+	Members map[string]Role
+	// users muted until the time
+	Mutes map[string]time.Time
+	// users banned from the chat
+	Bans map[string]bool
+	// age after which messages are purged, zero keeps them
+	MessageTTL time.Duration
+	// guards the name, description, archived state, roles, mutes and bans
+	// changed by events of the chat while clients read them
+	settingsMutex sync.RWMutex
 
 	store Store
 
@@ -264,9 +385,96 @@ func (self *Chat) GetMessages() ([]*Message, error) {
 		return nil, err
 	}
 
+	// expired messages may not be purged yet
+	now := time.Now()
+	msgs = slices.DeleteFunc(msgs, func(msg *Message) bool { return self.Expired(msg, now) })
+
 	return msgs, nil
 }
 
+func (self *Chat) GetName() string {
+	self.settingsMutex.RLock()
+	defer self.settingsMutex.RUnlock()
+	return self.Name
+}
+
+func (self *Chat) GetDescription() string {
+	self.settingsMutex.RLock()
+	defer self.settingsMutex.RUnlock()
+	return self.Description
+}
+
+func (self *Chat) IsArchived() bool {
+	self.settingsMutex.RLock()
+	defer self.settingsMutex.RUnlock()
+	return self.Archived
+}
+
+// updateSettings replaces the settings of the chat with the settings of
+// the changed chat.
+func (self *Chat) updateSettings(changed *Chat) {
+	self.settingsMutex.Lock()
+	defer self.settingsMutex.Unlock()
+
+	self.Name = changed.Name
+	self.Description = changed.Description
+	self.Archived = changed.Archived
+	self.Members = changed.Members
+	self.Mutes = changed.Mutes
+	self.Bans = changed.Bans
+}
+
+func (self *Chat) IsOwner(userId string) bool {
+	return self.OwnerId != "" && self.OwnerId == userId
+}
+
+func (self *Chat) Rename(name string, userId string) error {
+	return self.publishChatEvent(Event_RenameChat, userId, ChatEventDetails{Name: name})
+}
+
+func (self *Chat) Describe(description string, userId string) error {
+	return self.publishChatEvent(Event_DescribeChat, userId, ChatEventDetails{Description: description})
+}
+
+func (self *Chat) Archive(archived bool, userId string) error {
+	return self.publishChatEvent(Event_ArchiveChat, userId, ChatEventDetails{Archived: archived})
+}
+
+// SetRole gives the role to the user, only the owner can assign roles.
+func (self *Chat) SetRole(memberId string, role Role, userId string) error {
+	return self.publishChatEvent(Event_SetRole, userId, ChatEventDetails{MemberId: memberId, Role: role})
+}
+
+// Mute keeps the user from posting until the time, zero time unmutes.
+func (self *Chat) Mute(memberId string, until time.Time, userId string) error {
+	return self.publishChatEvent(Event_MuteUser, userId, ChatEventDetails{MemberId: memberId, Until: until})
+}
+
+func (self *Chat) Ban(memberId string, banned bool, userId string) error {
+	return self.publishChatEvent(Event_BanUser, userId, ChatEventDetails{MemberId: memberId, Banned: banned})
+}
+
+// Delete deletes the chat with all its messages.
+func (self *Chat) Delete(userId string) error {
+	return self.publishChatEvent(Event_DeleteChat, userId, ChatEventDetails{})
+}
+
+func (self *Chat) publishChatEvent(evtType EventType, userId string, details ChatEventDetails) error {
+	event := ChatEvent{
+		Type:    evtType,
+		ChatId:  self.Id,
+		UserId:  userId,
+		Details: details,
+	}
+
+	return self.publishEvent(event)
+}
+
+// Expired reports whether the message is older than the message TTL.
+func (self *Chat) Expired(msg *Message, now time.Time) bool {
+	return self.MessageTTL > 0 && msg.CreatedAt.Before(now.Add(-self.MessageTTL))
+}
+
 func (self *Chat) NewMessage(message *Message, authorId string) error {
 	details := MessageEventDetails{
 		Id:      message.Id.Hex(),
@@ -275,6 +483,8 @@ func (self *Chat) NewMessage(message *Message, authorId string) error {
 		Status:  message.Status,
 		Hidden:  false,
 		Deleted: message.Deleted,
+		File:    message.File,
+		Poll:    message.Poll,
 	}
 
 	event := ChatEvent{
@@ -298,7 +508,7 @@ func (self *Chat) UpdateMessage(message *Message, userId string) error {
 	return self.publishEvent(event)
 }
 
-func (self *Chat) UpdateMessageContent(id string, content string) error {
+func (self *Chat) UpdateMessageContent(id string, content string, userId string) error {
 	details := MessageEventDetails{
 		Id:      id,
 		Content: content,
@@ -307,6 +517,7 @@ func (self *Chat) UpdateMessageContent(id string, content string) error {
 	event := ChatEvent{
 		Type:    Event_EditMessage,
 		ChatId:  self.Id,
+		UserId:  userId,
 		Details: details,
 	}
 
@@ -329,7 +540,7 @@ func (self *Chat) SetHideMessage(id string, userId string, hide bool) error {
 	return self.publishEvent(event)
 }
 
-func (self *Chat) DeleteMessage(id string) error {
+func (self *Chat) DeleteMessage(id string, userId string) error {
 	details := MessageEventDetails{
 		Id:      id,
 		Deleted: true,
@@ -338,6 +549,39 @@ func (self *Chat) DeleteMessage(id string) error {
 	event := ChatEvent{
 		Type:    Event_DeleteMessage,
 		ChatId:  self.Id,
+		UserId:  userId,
+		Details: details,
+	}
+
+	return self.publishEvent(event)
+}
+
+// VotePoll replaces the vote of the user in the poll with the options.
+func (self *Chat) VotePoll(id string, userId string, options []int) error {
+	details := MessageEventDetails{
+		Id:    id,
+		Votes: options,
+	}
+
+	event := ChatEvent{
+		Type:    Event_VotePoll,
+		ChatId:  self.Id,
+		UserId:  userId,
+		Details: details,
+	}
+
+	return self.publishEvent(event)
+}
+
+func (self *Chat) ClosePoll(id string, userId string) error {
+	details := MessageEventDetails{
+		Id: id,
+	}
+
+	event := ChatEvent{
+		Type:    Event_ClosePoll,
+		ChatId:  self.Id,
+		UserId:  userId,
 		Details: details,
 	}
 
@@ -375,6 +619,8 @@ type Hub struct {
 
 	rabbitmqClient   *rabbitmq.Client
 	messagePublisher *rabbitmq.Publisher
+	// publishes events instead of RabbitMQ when set
+	publish func(event ChatEvent) error
 }
 
 func NewHub(store Store) *Hub {
@@ -457,15 +703,36 @@ func (self *Hub) processRabbitmqMessage(msg amqp.Delivery) {
 		self.chats[cht.Id] = cht
 		self.chatsMutex.Unlock()
 
-		evtData := EventData{
-			Cht: cht,
+		self.notifyClients(Event_NewChat, cht)
+	case Event_RenameChat, Event_DescribeChat, Event_ArchiveChat, Event_SetRole,
+		Event_MuteUser, Event_BanUser:
+		var details Chat
+		if err := json.Unmarshal(temp.Details, &details); err != nil {
+			log.Printf("Cannot process entity with type \"%T\" while updating chat", event.Details)
+			return
+		}
+
+		cht := self.GetChat(event.ChatId)
+		if cht == nil {
+			log.Printf("Chat id: %q, unknown chat, ignoring update", event.ChatId)
+			return
 		}
 
-		self.clientMetasMutex.Lock()
-		for _, cliMeta := range self.clientMetas {
-			cliMeta.Client.HandleEvent(Event_NewChat, evtData)
+		cht.updateSettings(&details)
+
+		self.notifyClients(event.Type, cht)
+		if event.Type == Event_BanUser {
+			self.removeBannedClients(cht)
+		}
+	case Event_DeleteChat:
+		self.chatsMutex.Lock()
+		cht, ok := self.chats[event.ChatId]
+		delete(self.chats, event.ChatId)
+		self.chatsMutex.Unlock()
+
+		if ok {
+			self.notifyClients(Event_DeleteChat, cht)
 		}
-		self.clientMetasMutex.Unlock()
 	default:
 		cht := self.GetChat(event.ChatId)
 		if cht == nil {
@@ -483,12 +750,47 @@ func (self *Hub) processRabbitmqMessage(msg amqp.Delivery) {
 			Msg:      &msg,
 			SenderId: event.UserId,
 			Cht:      cht,
+			// rejected messages are pushed back only to their authors
+			OnlySender: msg.Status == Error || msg.Status == Rejected,
 		}
 
 		cht.Broadcast(event.Type, evt)
 	}
 }
 
+// notifyClients passes the change of the chat to all clients of the hub,
+// the clients which have the chat open are marked connected.
+func (self *Hub) notifyClients(evtType EventType, cht *Chat) {
+	self.clientMetasMutex.Lock()
+	defer self.clientMetasMutex.Unlock()
+
+	for _, cliMeta := range self.clientMetas {
+		evtData := EventData{
+			Cht:       cht,
+			Connected: cliMeta.CurrentChat == cht.Id,
+		}
+		cliMeta.Client.HandleEvent(evtType, evtData)
+	}
+}
+
+// removeBannedClients disconnects clients of banned users from the chat.
+// The clients stay in the hub, they are still notified about other chats.
+func (self *Hub) removeBannedClients(cht *Chat) {
+	self.clientMetasMutex.Lock()
+	defer self.clientMetasMutex.Unlock()
+
+	for _, cliMeta := range self.clientMetas {
+		if !cht.Banned(cliMeta.Client.GetUserId()) {
+			continue
+		}
+
+		cht.RemoveClient(cliMeta.Client)
+		if cliMeta.CurrentChat == cht.Id {
+			cliMeta.CurrentChat = ""
+		}
+	}
+}
+
 func (self *Hub) LoadChatsFromStore() error {
 	if self.store == nil {
 		return errors.New("Store not set.")
@@ -509,7 +811,17 @@ func (self *Hub) LoadChatsFromStore() error {
 	return nil
 }
 
+// SetPublisher makes the hub publish events with the function instead of
+// sending them to RabbitMQ.
+func (self *Hub) SetPublisher(publish func(event ChatEvent) error) {
+	self.publish = publish
+}
+
 func (self *Hub) PublishEvent(event ChatEvent) error {
+	if self.publish != nil {
+		return self.publish(event)
+	}
+
 	body, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("Failed to send publish message: %v", err)
@@ -623,11 +935,28 @@ func (self *Hub) RemoveClient(client Client) {
 	delete(self.clientMetas, client.GetId())
 }
 
-func (self *Hub) AddChat(name string) {
+// GetUserClients returns clients of the user connected to the hub.
+func (self *Hub) GetUserClients(userId string) []Client {
+	self.clientMetasMutex.Lock()
+	defer self.clientMetasMutex.Unlock()
+
+	var clients []Client
+	for _, cliMeta := range self.clientMetas {
+		if cliMeta.Client.GetUserId() == userId {
+			clients = append(clients, cliMeta.Client)
+		}
+	}
+	return clients
+}
+
+func (self *Hub) AddChat(name string, userId string, messageTTL time.Duration) {
 	cht := NewChat(name, self.store)
+	cht.OwnerId = userId
+	cht.MessageTTL = messageTTL
 
 	event := ChatEvent{
 		Type:    Event_NewChat,
+		UserId:  userId,
 		Details: cht,
 	}
 
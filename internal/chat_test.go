@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 type event struct {
@@ -27,6 +28,9 @@ func newMockClient(id string) *mockClient {
 func (mc *mockClient) GetId() string {
 	return mc.id
 }
+func (mc *mockClient) GetUserId() string {
+	return mc.id
+}
 func (mc *mockClient) HandleEvent(evt EventType, data EventData) {
 	mc.events = append(mc.events, event{evt, data})
 }
@@ -124,7 +128,16 @@ func TestChatEvent_UnmarshalJSON(t *testing.T) {
 	cht.NewMessage(msg, "authorId")
 	cht.UpdateMessage(msg, "authortId")
 	cht.SetHideMessage("msgId", "userId", true)
-	cht.DeleteMessage("msgId")
+	cht.DeleteMessage("msgId", "userId")
+	cht.VotePoll("msgId", "userId", []int{0, 2})
+	cht.ClosePoll("msgId", "userId")
+	cht.Rename("renamed", "userId")
+	cht.Describe("about", "userId")
+	cht.Archive(true, "userId")
+	cht.SetRole("memberId", RoleModerator, "userId")
+	cht.Mute("memberId", time.Now().Add(time.Hour), "userId")
+	cht.Ban("memberId", true, "userId")
+	cht.Delete("userId")
 
 	for _, evt := range events {
 		jsonEvt, err := json.Marshal(evt)
@@ -9,9 +9,111 @@ type Configuration struct {
 }
 
 type Webapp struct {
+	// number of lines after which a code block in a message is collapsed,
+	// zero disables collapsing
+	CodeBlockCollapseLines int `json:"codeBlockCollapseLines"`
+	// key signing URLs of files, it must match the key of the file server,
+	// empty disables signing
+	FileSigningKey string `json:"fileSigningKey"`
+	// minimum validity of signed file URLs in minutes
+	FileURLTTLMinutes int `json:"fileURLTTLMinutes"`
+	// token of administrative requests, it must match the admin token of
+	// the file server, empty disables lookups of already stored content
+	FileAdminToken string `json:"fileAdminToken"`
+	// names of users allowed to manage the server
+	Admins []string `json:"admins"`
+	// addresses or CIDR ranges of proxies in front of the webapp, client
+	// addresses are read from headers only of requests coming from them
+	TrustedProxies []string   `json:"trustedProxies"`
+	Quotas         Quotas     `json:"quotas"`
+	RateLimits     RateLimits `json:"rateLimits"`
+}
+
+// Quotas limits uploads of files, zero values are unlimited.
+type Quotas struct {
+	// maximum number of bytes uploaded by a single user
+	UserBytes int64 `json:"userBytes"`
+	// maximum number of bytes uploaded by all users
+	GlobalBytes int64 `json:"globalBytes"`
+}
+
+// RateLimits of requests of users, shared by all webapp instances.
+type RateLimits struct {
+	Messages RateLimitScopes `json:"messages"`
+	Uploads  RateLimitScopes `json:"uploads"`
+	Login    RateLimitScopes `json:"login"`
+	Register RateLimitScopes `json:"register"`
+}
+
+// RateLimitScopes are limits counted separately per user, per chat and per
+// IP address. Login is limited per user name from an IP address, so others
+// can't lock the user out, register has no user or chat.
+type RateLimitScopes struct {
+	User RateLimit `json:"user"`
+	Chat RateLimit `json:"chat"`
+	IP   RateLimit `json:"ip"`
+}
+
+// RateLimit allows a burst of requests at once, refilled at the rate of
+// requests per minute. Zero rate disables the limit.
+type RateLimit struct {
+	PerMinute float64 `json:"perMinute"`
+	Burst     int     `json:"burst"`
 }
 
 type ChatServer struct {
+	Unfurl     Unfurl     `json:"unfurl"`
+	FileServer FileServer `json:"fileServer"`
+	// interval of posting due scheduled messages in milliseconds
+	SchedulePollMs int `json:"schedulePollMs"`
+	// interval of purging messages older than the message TTL of chats
+	// in milliseconds
+	PurgeIntervalMs int `json:"purgeIntervalMs"`
+	// chain of filters new and edited messages go through in order
+	Filters []ContentFilter `json:"filters"`
+}
+
+// FileServer configures requests of the chat server to the file server.
+type FileServer struct {
+	// base URL of the file server
+	URL string `json:"url"`
+	// token of administrative requests, it must match the admin token
+	// of the file server
+	AdminToken string `json:"adminToken"`
+	// interval of checking results of file scans in milliseconds
+	ScanPollMs int `json:"scanPollMs"`
+}
+
+// ContentFilter is a filter of message content. Each type uses its own
+// options and has a default action.
+type ContentFilter struct {
+	// maxLength, blocklist, links or regex
+	Type string `json:"type"`
+	// reject, mask or flag, empty uses the default action of the type
+	Action string `json:"action,omitempty"`
+	// shown to moderators when the filter flags a message
+	Reason string `json:"reason,omitempty"`
+
+	// maximum number of characters of the message
+	MaxLength int `json:"maxLength,omitempty"`
+	// words matched case-insensitively
+	Words []string `json:"words,omitempty"`
+	// domains of links including their subdomains, links to other domains
+	// than allowed are denied when the list isn't empty
+	AllowedDomains []string `json:"allowedDomains,omitempty"`
+	DeniedDomains  []string `json:"deniedDomains,omitempty"`
+	// regular expression matched against the message
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Unfurl configures fetching of link previews for messages.
+type Unfurl struct {
+	// number of workers fetching previews, zero disables unfurling
+	Workers int `json:"workers"`
+	// timeout of a single page fetch in milliseconds
+	TimeoutMs int `json:"timeoutMs"`
+	// maximum number of bytes read from a page
+	MaxBytes int64 `json:"maxBytes"`
 }
 
 type Redis struct {
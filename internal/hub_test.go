@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// chatsStore returns the chats, methods which aren't used by the tests panic.
+type chatsStore struct {
+	Store
+	chats []*Chat
+}
+
+func (s *chatsStore) GetChats() ([]*Chat, error) {
+	return s.chats, nil
+}
+
+func TestHub_UpdatesChatWhileClientsRead(t *testing.T) {
+	cht := NewChat("general", nil)
+	cht.Id = "chatId"
+	cht.OwnerId = "carol"
+	hub := NewHub(&chatsStore{chats: []*Chat{cht}})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cht := hub.GetChat("chatId")
+			cht.GetName()
+			cht.GetDescription()
+			cht.IsArchived()
+			cht.Role("bob")
+			cht.Banned("bob")
+			cht.MutedUntil("bob")
+		}
+	}()
+
+	for i := range 100 {
+		details := map[string]any{
+			"Id":       "chatId",
+			"Name":     "general",
+			"Archived": i%2 == 0,
+			"Members":  map[string]Role{"bob": RoleReadOnly},
+			"Bans":     map[string]bool{"bob": i%2 == 1},
+		}
+		body, _ := json.Marshal(map[string]any{"type": Event_ArchiveChat, "chatId": "chatId", "userId": "carol", "details": details})
+		hub.processRabbitmqMessage(amqp.Delivery{Body: body})
+	}
+	close(done)
+	wg.Wait()
+
+	if !cht.Banned("bob") || cht.IsArchived() || cht.Role("bob") != RoleReadOnly {
+		t.Errorf("chat doesn't have the last update, banned %v archived %v role %q", cht.Banned("bob"), cht.IsArchived(), cht.Role("bob"))
+	}
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// MaxPollOptions limits the number of options of a single poll.
+const MaxPollOptions = 10
+
+var ErrPollClosed = errors.New("the poll is closed")
+var ErrInvalidVote = errors.New("invalid vote")
+
+// Poll is attached to messages of the poll type, the question is kept
+// in the message content.
+type Poll struct {
+	Options   []PollOption `bson:"options"            json:"options"`
+	Multiple  bool         `bson:"multiple"           json:"multiple"`
+	Anonymous bool         `bson:"anonymous"          json:"anonymous"`
+	ClosesAt  time.Time    `bson:"closesAt,omitempty" json:"closesAt,omitzero"` // zero while open until closed by the author
+}
+
+type PollOption struct {
+	Text   string      `bson:"text"   json:"text"`
+	Voters []PollVoter `bson:"voters" json:"voters"`
+}
+
+// PollVoter identifies a user who voted. Ids are kept also in anonymous
+// polls to allow a single vote per user, only names are left out.
+type PollVoter struct {
+	Id   string `bson:"id"             json:"id"`
+	Name string `bson:"name,omitempty" json:"name,omitempty"`
+}
+
+func NewPoll(options []string, multiple, anonymous bool, closesAt time.Time) *Poll {
+	p := &Poll{
+		Options:   make([]PollOption, 0, len(options)),
+		Multiple:  multiple,
+		Anonymous: anonymous,
+		ClosesAt:  closesAt,
+	}
+
+	for _, text := range options {
+		p.Options = append(p.Options, PollOption{Text: text, Voters: []PollVoter{}})
+	}
+
+	return p
+}
+
+func (p *Poll) Closed(now time.Time) bool {
+	return !p.ClosesAt.IsZero() && !now.Before(p.ClosesAt)
+}
+
+// Votes returns indexes of options the user voted for.
+func (p *Poll) Votes(userId string) []int {
+	var votes []int
+	for i, opt := range p.Options {
+		if slices.ContainsFunc(opt.Voters, func(v PollVoter) bool { return v.Id == userId }) {
+			votes = append(votes, i)
+		}
+	}
+	return votes
+}
+
+// VoterCount returns the number of users who voted for any option.
+func (p *Poll) VoterCount() int {
+	voters := make(map[string]bool)
+	for _, opt := range p.Options {
+		for _, v := range opt.Voters {
+			voters[v.Id] = true
+		}
+	}
+	return len(voters)
+}
+
+// CheckVote returns error if the options can't be voted for. No options
+// retract the vote.
+func (p *Poll) CheckVote(options []int, now time.Time) error {
+	if p.Closed(now) {
+		return ErrPollClosed
+	}
+
+	if len(options) > 1 && !p.Multiple {
+		return errors.Join(ErrInvalidVote, errors.New("single choice poll"))
+	}
+
+	for i, opt := range options {
+		if opt < 0 || opt >= len(p.Options) {
+			return errors.Join(ErrInvalidVote, errors.New("unknown option"))
+		}
+		if slices.Contains(options[:i], opt) {
+			return errors.Join(ErrInvalidVote, errors.New("duplicated option"))
+		}
+	}
+
+	return nil
+}
+
+// Vote replaces the previous vote of the user with the options.
+// Voters of the options are replaced, not modified in place.
+func (p *Poll) Vote(voter PollVoter, options []int, now time.Time) error {
+	if err := p.CheckVote(options, now); err != nil {
+		return err
+	}
+
+	if p.Anonymous {
+		voter.Name = ""
+	}
+
+	for i, opt := range p.Options {
+		voters := make([]PollVoter, 0, len(opt.Voters)+1)
+		for _, v := range opt.Voters {
+			if v.Id != voter.Id {
+				voters = append(voters, v)
+			}
+		}
+		if slices.Contains(options, i) {
+			voters = append(voters, voter)
+		}
+		p.Options[i].Voters = voters
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPoll_Vote(t *testing.T) {
+	now := time.Now()
+	p := NewPoll([]string{"a", "b", "c"}, false, false, time.Time{})
+	alice := PollVoter{Id: "1", Name: "alice"}
+
+	if err := p.Vote(alice, []int{0}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Vote(alice, []int{2}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if votes := p.Votes(alice.Id); !slices.Equal(votes, []int{2}) {
+		t.Errorf("user votes %v expected [2]", votes)
+	}
+	if len(p.Options[0].Voters) != 0 || p.Options[2].Voters[0] != alice {
+		t.Errorf("previous vote is not replaced: %+v", p.Options)
+	}
+
+	if err := p.Vote(alice, nil, now); err != nil {
+		t.Fatal(err)
+	}
+	if p.VoterCount() != 0 {
+		t.Errorf("vote is not retracted: %+v", p.Options)
+	}
+}
+
+func TestPoll_VoteMultiple(t *testing.T) {
+	now := time.Now()
+	p := NewPoll([]string{"a", "b", "c"}, true, true, time.Time{})
+
+	p.Vote(PollVoter{Id: "1", Name: "alice"}, []int{0, 1}, now)
+	p.Vote(PollVoter{Id: "2", Name: "bob"}, []int{1}, now)
+
+	if p.VoterCount() != 2 || len(p.Options[1].Voters) != 2 {
+		t.Errorf("unexpected votes %+v", p.Options)
+	}
+	if p.Options[0].Voters[0].Name != "" {
+		t.Error("voter name is kept in anonymous poll")
+	}
+}
+
+func TestPoll_CheckVote(t *testing.T) {
+	now := time.Now()
+	single := NewPoll([]string{"a", "b"}, false, false, time.Time{})
+	multiple := NewPoll([]string{"a", "b"}, true, false, time.Time{})
+	closed := NewPoll([]string{"a", "b"}, true, false, now.Add(-time.Minute))
+
+	tests := []struct {
+		name    string
+		poll    *Poll
+		options []int
+		err     error
+	}{
+		{"single", single, []int{1}, nil},
+		{"retract", single, nil, nil},
+		{"many in single choice", single, []int{0, 1}, ErrInvalidVote},
+		{"many", multiple, []int{0, 1}, nil},
+		{"unknown option", multiple, []int{2}, ErrInvalidVote},
+		{"negative option", multiple, []int{-1}, ErrInvalidVote},
+		{"duplicated option", multiple, []int{1, 1}, ErrInvalidVote},
+		{"closed", closed, []int{0}, ErrPollClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.poll.CheckVote(tt.options, now)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Errorf("got error %v expected %v", err, tt.err)
+			}
+		})
+	}
+}
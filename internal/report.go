@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type ReportStatus string
+
+const (
+	ReportOpen      ReportStatus = "open"
+	ReportDismissed ReportStatus = "dismissed"
+	ReportResolved  ReportStatus = "resolved"
+)
+
+// ModerationAction taken by a moderator on a report or on a member of
+// the chat.
+type ModerationAction string
+
+const (
+	ActionDismiss       ModerationAction = "dismiss"
+	ActionDeleteMessage ModerationAction = "delete"
+	ActionMuteAuthor    ModerationAction = "mute"
+	ActionBanAuthor     ModerationAction = "ban"
+	ActionUnmute        ModerationAction = "unmute"
+	ActionUnban         ModerationAction = "unban"
+	ActionSetRole       ModerationAction = "role"
+)
+
+// Report of a message filed by a user or the content filter for moderators
+// of the chat.
+type Report struct {
+	Id         bson.ObjectID `bson:"_id,omitempty"`
+	ChatId     string        `bson:"chatId"`
+	MessageId  string        `bson:"messageId"`
+	AuthorId   string        `bson:"authorId"`   // author of the reported message
+	ReporterId string        `bson:"reporterId"` // empty for messages flagged by the content filter
+	Reason     string        `bson:"reason"`
+	Status     ReportStatus  `bson:"status"`
+	CreatedAt  time.Time     `bson:"createdAt"`
+	// moderator who closed the report and the action taken
+	ModeratorId string           `bson:"moderatorId,omitempty"`
+	Action      ModerationAction `bson:"action,omitempty"`
+	ClosedAt    time.Time        `bson:"closedAt,omitzero"`
+}
+
+// AuditEntry records an action taken by a moderator.
+type AuditEntry struct {
+	Id          bson.ObjectID    `bson:"_id,omitempty"`
+	ChatId      string           `bson:"chatId"`
+	ModeratorId string           `bson:"moderatorId"`
+	Action      ModerationAction `bson:"action"`
+	ReportId    string           `bson:"reportId,omitempty"`
+	MessageId   string           `bson:"messageId,omitempty"`
+	MemberId    string           `bson:"memberId,omitempty"` // user the action is taken on
+	Role        Role             `bson:"role,omitempty"`     // role given to the member
+	CreatedAt   time.Time        `bson:"createdAt"`
+}
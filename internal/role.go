@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrForbidden = errors.New("not allowed in the chat")
+
+// Role of a user in a chat. Users without an assigned role are members.
+type Role string
+
+const (
+	RoleOwner     Role = "owner"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	// read-only members can't post, like in announcement channels
+	RoleReadOnly Role = "readOnly"
+)
+
+// AssignableRoles are the roles the owner can give to users.
+var AssignableRoles = []Role{RoleModerator, RoleMember, RoleReadOnly}
+
+func (r Role) CanPost() bool {
+	return r != RoleReadOnly
+}
+
+// CanModerate allows deleting and pinning messages of others and changing
+// settings of the chat.
+func (r Role) CanModerate() bool {
+	return r == RoleOwner || r == RoleModerator
+}
+
+// Role returns the role of the user in the chat.
+func (self *Chat) Role(userId string) Role {
+	if self.IsOwner(userId) {
+		return RoleOwner
+	}
+
+	self.settingsMutex.RLock()
+	defer self.settingsMutex.RUnlock()
+	if role, ok := self.Members[userId]; ok {
+		return role
+	}
+	return RoleMember
+}
+
+// CanDeleteMessage allows authors to delete their messages and moderators
+// to delete any message.
+func (self *Chat) CanDeleteMessage(msg *Message, userId string) bool {
+	return msg.AuthorId == userId || self.Role(userId).CanModerate()
+}
+
+// Muted reports whether the user is muted at the time.
+func (self *Chat) Muted(userId string, now time.Time) bool {
+	until := self.MutedUntil(userId)
+	return !until.IsZero() && now.Before(until)
+}
+
+// MutedUntil returns the end of the mute of the user, zero when the user
+// isn't muted.
+func (self *Chat) MutedUntil(userId string) time.Time {
+	self.settingsMutex.RLock()
+	defer self.settingsMutex.RUnlock()
+	return self.Mutes[userId]
+}
+
+func (self *Chat) Banned(userId string) bool {
+	self.settingsMutex.RLock()
+	defer self.settingsMutex.RUnlock()
+	return self.Bans[userId]
+}
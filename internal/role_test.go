@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChat_Role(t *testing.T) {
+	cht := NewChat("announcements", nil)
+	cht.OwnerId = "owner"
+	cht.Members = map[string]Role{"mod": RoleModerator, "reader": RoleReadOnly}
+
+	tests := []struct {
+		userId   string
+		role     Role
+		post     bool
+		moderate bool
+	}{
+		{"owner", RoleOwner, true, true},
+		{"mod", RoleModerator, true, true},
+		{"reader", RoleReadOnly, false, false},
+		{"someone", RoleMember, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.userId, func(t *testing.T) {
+			role := cht.Role(tt.userId)
+			if role != tt.role {
+				t.Fatalf("got role %q expected %q", role, tt.role)
+			}
+			if role.CanPost() != tt.post || role.CanModerate() != tt.moderate {
+				t.Errorf("role %q can post %v and moderate %v", role, role.CanPost(), role.CanModerate())
+			}
+		})
+	}
+
+	msg := New(cht.Id, "someone", "hello", TextMessage)
+	if !cht.CanDeleteMessage(msg, "someone") || !cht.CanDeleteMessage(msg, "mod") || cht.CanDeleteMessage(msg, "reader") {
+		t.Error("message can be deleted only by its author and moderators")
+	}
+}
+
+func TestChat_MutedAndBanned(t *testing.T) {
+	now := time.Now()
+	cht := NewChat("general", nil)
+	cht.Mutes = map[string]time.Time{"muted": now.Add(time.Hour), "expired": now.Add(-time.Minute)}
+	cht.Bans = map[string]bool{"banned": true}
+
+	if !cht.Muted("muted", now) || cht.Muted("expired", now) || cht.Muted("someone", now) {
+		t.Error("only users with mutes ending later are muted")
+	}
+	if !cht.Banned("banned") || cht.Banned("muted") {
+		t.Error("only banned users are banned")
+	}
+}
@@ -0,0 +1,79 @@
+// Package signedurl signs file names with expiry time, so links to files
+// can be handed out only to users allowed to see them.
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	ExpiresParam   = "exp"
+	SignatureParam = "sig"
+)
+
+var (
+	ErrMissing = errors.New("missing signature")
+	ErrExpired = errors.New("signature expired")
+	ErrInvalid = errors.New("invalid signature")
+)
+
+type Signer struct {
+	key []byte
+	ttl time.Duration
+	now func() time.Time
+}
+
+// New returns signer of URLs valid for at least the ttl duration.
+func New(key []byte, ttl time.Duration) *Signer {
+	return &Signer{key: key, ttl: ttl, now: time.Now}
+}
+
+// Query returns parameters to add to the URL of the file with the name.
+//
+// Expiry is rounded to the ttl, so the URL of a file stays the same for
+// a while and can be cached by browsers.
+func (self *Signer) Query(name string) url.Values {
+	expires := self.now().Truncate(self.ttl).Add(2 * self.ttl).Unix()
+
+	return url.Values{
+		ExpiresParam:   {strconv.FormatInt(expires, 10)},
+		SignatureParam: {sign(self.key, name, expires)},
+	}
+}
+
+// Verify checks that the query carries a valid unexpired signature of the name.
+func Verify(key []byte, name string, query url.Values, now time.Time) error {
+	exp, sig := query.Get(ExpiresParam), query.Get(SignatureParam)
+	if exp == "" || sig == "" {
+		return ErrMissing
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(sign(key, name, expires))) {
+		return ErrInvalid
+	}
+
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+func sign(key []byte, name string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,68 @@
+package signedurl
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	key := []byte("secret")
+	now := time.Date(2025, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	signer := New(key, time.Hour)
+	signer.now = func() time.Time { return now }
+	query := signer.Query("a.png")
+
+	tests := []struct {
+		name     string
+		key      []byte
+		fname    string
+		at       time.Time
+		expected error
+	}{
+		{"valid", key, "a.png", now, nil},
+		{"valid for at least ttl", key, "a.png", now.Add(time.Hour), nil},
+		{"expired", key, "a.png", now.Add(3 * time.Hour), ErrExpired},
+		{"other file", key, "b.png", now, ErrInvalid},
+		{"other key", []byte("other"), "a.png", now, ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.key, tt.fname, query, tt.at); !errors.Is(err, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestVerify_TamperedExpiry(t *testing.T) {
+	key := []byte("secret")
+	query := New(key, time.Hour).Query("a.png")
+	query.Set(ExpiresParam, "99999999999")
+
+	if err := Verify(key, "a.png", query, time.Now()); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected %v, got %v", ErrInvalid, err)
+	}
+}
+
+func TestVerify_Missing(t *testing.T) {
+	if err := Verify([]byte("secret"), "a.png", nil, time.Now()); !errors.Is(err, ErrMissing) {
+		t.Errorf("expected %v, got %v", ErrMissing, err)
+	}
+}
+
+func TestQuery_StableWithinTTL(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	signer := New([]byte("secret"), time.Hour)
+
+	signer.now = func() time.Time { return now.Add(5 * time.Minute) }
+	first := signer.Query("a.png").Encode()
+	signer.now = func() time.Time { return now.Add(55 * time.Minute) }
+	second := signer.Query("a.png").Encode()
+
+	if first != second {
+		t.Error("URL changed within the ttl window")
+	}
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Block of a user by another user, it applies to all chats.
+type Block struct {
+	BlockerId string `bson:"blockerId"`
+	BlockedId string `bson:"blockedId"`
+}
+
+func (ms *MongodbStore) getBlocksCollection() (*mongo.Collection, error) {
+	db, err := ms.getDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return db.Collection("blocks"), nil
+}
+
+func (ms *MongodbStore) BlockUser(blockerId string, blockedId string) error {
+	coll, err := ms.getBlocksCollection()
+	if err != nil {
+		return err
+	}
+
+	block := Block{BlockerId: blockerId, BlockedId: blockedId}
+	opts := options.Replace().SetUpsert(true)
+	if _, err := coll.ReplaceOne(context.TODO(), block, block, opts); err != nil {
+		return errors.Join(errors.New("failed to block user"), err)
+	}
+	return nil
+}
+
+func (ms *MongodbStore) UnblockUser(blockerId string, blockedId string) error {
+	coll, err := ms.getBlocksCollection()
+	if err != nil {
+		return err
+	}
+
+	if _, err := coll.DeleteOne(context.TODO(), Block{BlockerId: blockerId, BlockedId: blockedId}); err != nil {
+		return errors.Join(errors.New("failed to unblock user"), err)
+	}
+	return nil
+}
+
+// GetBlockedUsers returns ids of users blocked by the user.
+func (ms *MongodbStore) GetBlockedUsers(blockerId string) ([]string, error) {
+	coll, err := ms.getBlocksCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := coll.Find(context.TODO(), bson.M{"blockerId": blockerId})
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get blocked users"), err)
+	}
+
+	var blocks []Block
+	if err := cursor.All(context.TODO(), &blocks); err != nil {
+		return nil, errors.Join(errors.New("failed to decode blocked users"), err)
+	}
+
+	ids := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		ids = append(ids, b.BlockedId)
+	}
+	return ids, nil
+}
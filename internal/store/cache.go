@@ -91,6 +91,33 @@ func (rs *RedisStore) UpdateMessage(msg *internal.Message) {
 	rs.client.Del(context.Background(), k)
 }
 
+// DeleteMessages drops the cached messages of the chat.
+func (rs *RedisStore) DeleteMessages(chatId string) {
+	k := "chat:" + chatId + ":messages"
+	rs.client.Del(context.Background(), k)
+}
+
+// RemoveMessage removes the message from the cached list, unlike updates
+// it leaves the rest of the list cached.
+func (rs *RedisStore) RemoveMessage(msg *internal.Message) {
+	k := "chat:" + msg.ChatId.Hex() + ":messages"
+	items, err := rs.client.LRange(context.Background(), k, 0, -1).Result()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, item := range items {
+		var cached internal.Message
+		if err := cached.UnmarshalBinary([]byte(item)); err != nil || cached.Id != msg.Id {
+			continue
+		}
+		if err := rs.client.LRem(context.Background(), k, 1, item).Err(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 func (rs *RedisStore) GetMessages(chatId string) []*internal.Message {
 	k := "chat:" + chatId + ":messages"
 	msgs := make([]*internal.Message, 0, 100)
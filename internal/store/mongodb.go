@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"time"
 
 	"github.com/ellezio/Chat-app-with-Go/internal"
@@ -20,21 +21,56 @@ var ErrDecodeChat = errors.New("cannot decode chat")
 var ErrNoRecord = errors.New("record does't exist")
 
 type Chat struct {
-	Id   bson.ObjectID `bson:"_id,omitempty"`
-	Name string        `bson:"name"`
+	Id          bson.ObjectID            `bson:"_id,omitempty"`
+	Name        string                   `bson:"name"`
+	Description string                   `bson:"description,omitempty"`
+	OwnerId     string                   `bson:"ownerId,omitempty"`
+	Archived    bool                     `bson:"archived,omitempty"`
+	Members     map[string]internal.Role `bson:"members,omitempty"`
+	Mutes       map[string]time.Time     `bson:"mutes,omitempty"`
+	Bans        map[string]bool          `bson:"bans,omitempty"`
+	MessageTTL  time.Duration            `bson:"messageTTL,omitempty"`
+}
+
+func (c *Chat) fromInternal(cht *internal.Chat) {
+	c.Name = cht.Name
+	c.Description = cht.Description
+	c.OwnerId = cht.OwnerId
+	c.Archived = cht.Archived
+	c.Members = cht.Members
+	c.Mutes = cht.Mutes
+	c.Bans = cht.Bans
+	c.MessageTTL = cht.MessageTTL
+}
+
+func (c *Chat) toInternal(store internal.Store) *internal.Chat {
+	cht := internal.NewChat(c.Name, store)
+	cht.Id = c.Id.Hex()
+	cht.Description = c.Description
+	cht.OwnerId = c.OwnerId
+	cht.Archived = c.Archived
+	cht.Members = c.Members
+	cht.Mutes = c.Mutes
+	cht.Bans = c.Bans
+	cht.MessageTTL = c.MessageTTL
+	return cht
 }
 
 type Message struct {
-	Id         bson.ObjectID          `bson:"_id,omitempty"`
-	ChatId     bson.ObjectID          `bson:"chatId"`
-	AuthorId   bson.ObjectID          `bson:"authorId"`
-	Content    string                 `bson:"content"`
-	Type       internal.MessageType   `bson:"type"`
-	CreatedAt  time.Time              `bson:"createdAt"`
-	ModifiedAt time.Time              `bson:"modifiedAt"`
-	Status     internal.MessageStatus `bson:"status"`
-	HiddenFor  []string               `bson:"hiddenFor"`
-	Deleted    bool                   `bson:"deleted"`
+	Id          bson.ObjectID          `bson:"_id,omitempty"`
+	ChatId      bson.ObjectID          `bson:"chatId"`
+	AuthorId    bson.ObjectID          `bson:"authorId"`
+	Content     string                 `bson:"content"`
+	Type        internal.MessageType   `bson:"type"`
+	CreatedAt   time.Time              `bson:"createdAt"`
+	ModifiedAt  time.Time              `bson:"modifiedAt"`
+	Status      internal.MessageStatus `bson:"status"`
+	HiddenFor   []string               `bson:"hiddenFor"`
+	Deleted     bool                   `bson:"deleted"`
+	Previews    []internal.LinkPreview `bson:"previews,omitempty"`
+	File        *internal.FileInfo     `bson:"file,omitempty"`
+	Poll        *internal.Poll         `bson:"poll,omitempty"`
+	ScheduledAt time.Time              `bson:"scheduledAt,omitempty"`
 }
 
 func (m *Message) fromInternal(msg *internal.Message) {
@@ -52,6 +88,10 @@ func (m *Message) fromInternal(msg *internal.Message) {
 	m.Status = msg.Status
 	m.HiddenFor = msg.HiddenFor
 	m.Deleted = msg.Deleted
+	m.Previews = msg.Previews
+	m.File = msg.File
+	m.Poll = msg.Poll
+	m.ScheduledAt = msg.ScheduledAt
 }
 
 func (m *Message) toInternal(user internal.User) *internal.Message {
@@ -66,6 +106,11 @@ func (m *Message) toInternal(user internal.User) *internal.Message {
 		Status:     m.Status,
 		HiddenFor:  m.HiddenFor,
 		Deleted:    m.Deleted,
+		Previews:   m.Previews,
+		File:       m.File,
+		Poll:       m.Poll,
+
+		ScheduledAt: m.ScheduledAt,
 
 		Author: user,
 	}
@@ -403,14 +448,221 @@ func (ms *MongodbStore) UpdateMessageContent(id string, content string) (*intern
 	return rmsg, nil
 }
 
-// TODO: update on saving existing chat
+func (ms *MongodbStore) SetMessagePreviews(id string, previews []internal.LinkPreview) (*internal.Message, error) {
+	return ms.updateMessage(id, bson.M{"$set": bson.M{"previews": previews}})
+}
+
+func (ms *MongodbStore) SetMessageStatus(id string, status internal.MessageStatus) (*internal.Message, error) {
+	return ms.updateMessage(id, bson.M{"$set": bson.M{"status": status}})
+}
+
+// pollVoteRetries limits attempts to save a vote when other votes
+// are saved at the same time.
+const pollVoteRetries = 5
+
+// VotePoll replaces the vote of the user with the options. Voters are
+// updated only if no other vote was saved since they were read.
+func (ms *MongodbStore) VotePoll(id string, voter internal.PollVoter, votes []int) (*internal.Message, error) {
+	coll, err := ms.getMessagesCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	msgId, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	for range pollVoteRetries {
+		var msg Message
+		err := coll.FindOne(context.TODO(), bson.M{"_id": msgId, "type": internal.PollMessage}).Decode(&msg)
+		if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && msg.Poll == nil) {
+			return nil, ErrNoRecord
+		} else if err != nil {
+			return nil, errors.Join(ErrDecodeMessage, err)
+		}
+
+		prev := slices.Clone(msg.Poll.Options)
+		if err := msg.Poll.Vote(voter, votes, time.Now()); err != nil {
+			return nil, err
+		}
+
+		rmsg, err := ms.findAndUpdateMessage(
+			bson.M{"_id": msgId, "poll.options": prev},
+			bson.M{"$set": bson.M{"poll.options": msg.Poll.Options}},
+		)
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return rmsg, err
+		}
+	}
+
+	return nil, errors.New("failed to save vote, the poll is changing too often")
+}
+
+func (ms *MongodbStore) ClosePoll(id string, at time.Time) (*internal.Message, error) {
+	return ms.updateMessage(id, bson.M{"$set": bson.M{"poll.closesAt": at}})
+}
+
+// updateMessage applies the update to the message and returns
+// the updated message with its author.
+func (ms *MongodbStore) updateMessage(id string, update bson.M) (*internal.Message, error) {
+	msgId, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	return ms.findAndUpdateMessage(bson.M{"_id": msgId}, update)
+}
+
+// findAndUpdateMessage applies the update to the message matching the filter.
+func (ms *MongodbStore) findAndUpdateMessage(filter bson.M, update bson.M) (*internal.Message, error) {
+	coll, err := ms.getMessagesCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := coll.FindOneAndUpdate(
+		context.TODO(),
+		filter,
+		update,
+		opts,
+	)
+
+	var result Message
+	err = res.Decode(&result)
+	if err != nil {
+		return nil, errors.Join(ErrDecodeMessage, err)
+	}
+
+	user, err := ms.GetUserById(result.AuthorId.Hex())
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to attache author to message"), err)
+	}
+
+	rmsg := result.toInternal(*user)
+
+	ms.cache.UpdateMessage(rmsg)
+
+	return rmsg, nil
+}
+
+// GetMessagesWithStatus returns messages of all chats with the status,
+// without their authors.
+func (ms *MongodbStore) GetMessagesWithStatus(status internal.MessageStatus) ([]*internal.Message, error) {
+	coll, err := ms.getMessagesCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := coll.Find(context.TODO(), bson.M{"status": status, "deleted": bson.M{"$ne": true}})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to get messages with status %q", status), err)
+	}
+
+	var results []Message
+	if err := cursor.All(context.TODO(), &results); err != nil {
+		return nil, errors.Join(ErrDecodeMessage, err)
+	}
+
+	msgs := make([]*internal.Message, 0, len(results))
+	for _, m := range results {
+		msgs = append(msgs, m.toInternal(internal.User{Id: m.AuthorId}))
+	}
+	return msgs, nil
+}
+
+// GetReferencedFiles returns names of stored files referenced
+// by messages which are not deleted.
+func (ms *MongodbStore) GetReferencedFiles() (map[string]bool, error) {
+	coll, err := ms.getMessagesCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	res := coll.Distinct(
+		context.TODO(),
+		"content",
+		bson.M{
+			"type":    bson.M{"$in": internal.FileMessageTypes},
+			"deleted": bson.M{"$ne": true},
+		},
+	)
+
+	var names []string
+	if err := res.Decode(&names); err != nil {
+		return nil, errors.Join(errors.New("failed to get referenced files"), err)
+	}
+
+	referenced := make(map[string]bool, len(names))
+	for _, name := range names {
+		referenced[name] = true
+	}
+	return referenced, nil
+}
+
+// PurgeExpiredMessage deletes the oldest message of the chat created
+// before the time, it is deleted once even when purged concurrently.
+// ErrNoRecord is returned when no message is expired.
+func (ms *MongodbStore) PurgeExpiredMessage(chatId string, before time.Time) (*internal.Message, error) {
+	coll, err := ms.getMessagesCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	cId, err := bson.ObjectIDFromHex(chatId)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	opts := options.FindOneAndDelete().SetSort(bson.M{"createdAt": 1})
+	res := coll.FindOneAndDelete(
+		context.TODO(),
+		bson.M{"chatId": cId, "createdAt": bson.M{"$lt": before}},
+		opts,
+	)
+
+	var result Message
+	if err := res.Decode(&result); errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoRecord
+	} else if err != nil {
+		return nil, errors.Join(ErrDecodeMessage, err)
+	}
+
+	rmsg := result.toInternal(internal.User{Id: result.AuthorId})
+
+	ms.cache.RemoveMessage(rmsg)
+
+	return rmsg, nil
+}
+
+// SaveChat inserts the new chat or replaces the stored one.
 func (ms *MongodbStore) SaveChat(cht *internal.Chat) error {
 	coll, err := ms.getChatsCollection()
 	if err != nil {
 		return err
 	}
 
-	res, err := coll.InsertOne(context.TODO(), Chat{Name: cht.Name})
+	var c Chat
+	c.fromInternal(cht)
+
+	if cht.Id != "" && cht.Id != bson.NilObjectID.Hex() {
+		chatId, err := bson.ObjectIDFromHex(cht.Id)
+		if err != nil {
+			return errors.Join(ErrParseId, err)
+		}
+
+		res, err := coll.ReplaceOne(context.TODO(), bson.M{"_id": chatId}, c)
+		if err != nil {
+			return errors.Join(errors.New("Failed to save chat"), err)
+		}
+		if res.MatchedCount == 0 {
+			return ErrNoRecord
+		}
+		return nil
+	}
+
+	res, err := coll.InsertOne(context.TODO(), c)
 	if err != nil {
 		return errors.Join(errors.New("Failed to save chat"), err)
 	}
@@ -443,14 +695,70 @@ func (ms *MongodbStore) GetChats() ([]*internal.Chat, error) {
 
 	var results []*internal.Chat
 	for _, cht := range chts {
-		result := internal.NewChat(cht.Name, ms)
-		result.Id = cht.Id.Hex()
-		results = append(results, result)
+		results = append(results, cht.toInternal(ms))
 	}
 
 	return results, nil
 }
 
+func (ms *MongodbStore) GetChat(chatId string) (*internal.Chat, error) {
+	coll, err := ms.getChatsCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	cId, err := bson.ObjectIDFromHex(chatId)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	var cht Chat
+	if err := coll.FindOne(context.TODO(), bson.M{"_id": cId}).Decode(&cht); errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoRecord
+	} else if err != nil {
+		return nil, errors.Join(ErrDecodeChat, err)
+	}
+
+	return cht.toInternal(ms), nil
+}
+
+// DeleteChat deletes the chat with its messages, files of the messages
+// are left to the file garbage collector.
+func (ms *MongodbStore) DeleteChat(chatId string) error {
+	cId, err := bson.ObjectIDFromHex(chatId)
+	if err != nil {
+		return errors.Join(ErrParseId, err)
+	}
+
+	chats, err := ms.getChatsCollection()
+	if err != nil {
+		return err
+	}
+	if _, err := chats.DeleteOne(context.TODO(), bson.M{"_id": cId}); err != nil {
+		return errors.Join(errors.New("failed to delete chat"), err)
+	}
+
+	msgs, err := ms.getMessagesCollection()
+	if err != nil {
+		return err
+	}
+	if _, err := msgs.DeleteMany(context.TODO(), bson.M{"chatId": cId}); err != nil {
+		return errors.Join(errors.New("failed to delete messages of chat"), err)
+	}
+
+	scheduled, err := ms.getScheduledCollection()
+	if err != nil {
+		return err
+	}
+	if _, err := scheduled.DeleteMany(context.TODO(), bson.M{"chatId": cId}); err != nil {
+		return errors.Join(errors.New("failed to delete scheduled messages of chat"), err)
+	}
+
+	ms.cache.DeleteMessages(chatId)
+
+	return nil
+}
+
 func (ms *MongodbStore) CreateUser(user *internal.User) error {
 	coll, err := ms.getUsersCollection()
 	if err != nil {
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+
+Rate limits are token buckets kept in Redis hashes, so they are shared by all
+webapp replicas. A bucket holds up to its burst of tokens and is refilled at
+its rate, every request takes a token. Buckets of a request are checked in
+a single script and tokens are taken only when all of them have one, so
+requests rejected by one limit don't drain the others.
+
+Time is read from Redis, clocks of replicas don't matter. Full buckets expire.
+
+*/
+
+// takeTokensScript takes a token from each bucket in KEYS, ARGV holds
+// the rate in tokens per minute and the burst of each bucket. It returns
+// milliseconds to wait until all buckets have a token, zero when tokens
+// were taken.
+var takeTokensScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local tokens = {}
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2 - 1]) / 60000
+	local burst = tonumber(ARGV[i * 2])
+	local bucket = redis.call('HMGET', key, 'tokens', 'ts')
+	local t = tonumber(bucket[1]) or burst
+	local ts = tonumber(bucket[2]) or now
+	t = math.min(burst, t + math.max(0, now - ts) * rate)
+	if t < 1 then
+		wait = math.max(wait, math.ceil((1 - t) / rate))
+	end
+	tokens[i] = t
+end
+
+if wait > 0 then
+	return wait
+end
+
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2 - 1]) / 60000
+	local burst = tonumber(ARGV[i * 2])
+	redis.call('HSET', key, 'tokens', tostring(tokens[i] - 1), 'ts', now)
+	redis.call('PEXPIRE', key, math.ceil(burst / rate))
+end
+return 0
+`)
+
+// RateBucket is a token bucket refilled at PerMinute tokens a minute
+// up to Burst tokens.
+type RateBucket struct {
+	Key       string
+	PerMinute float64
+	Burst     int
+}
+
+// TakeTokens takes a token from each bucket when all of them have one,
+// otherwise it returns time to wait until they have.
+func (rs *RedisStore) TakeTokens(ctx context.Context, buckets ...RateBucket) (time.Duration, error) {
+	if len(buckets) == 0 {
+		return 0, nil
+	}
+
+	keys := make([]string, 0, len(buckets))
+	args := make([]any, 0, len(buckets)*2)
+	for _, b := range buckets {
+		keys = append(keys, "ratelimit:"+b.Key)
+		args = append(args, b.PerMinute, max(b.Burst, 1))
+	}
+
+	wait, err := takeTokensScript.Run(ctx, rs.client, keys, args...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("taking rate limit tokens: %w", err)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTakeTokens(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rs := &RedisStore{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	ctx := t.Context()
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	mr.SetTime(now)
+
+	user := RateBucket{Key: "msg:user:alice", PerMinute: 60, Burst: 3}
+	chat := RateBucket{Key: "msg:chat:general", PerMinute: 60, Burst: 4}
+
+	take := func(buckets ...RateBucket) time.Duration {
+		t.Helper()
+		wait, err := rs.TakeTokens(ctx, buckets...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wait
+	}
+
+	for i := range 3 {
+		if wait := take(user, chat); wait != 0 {
+			t.Fatalf("request %d: expected to be allowed, wait %v", i, wait)
+		}
+	}
+
+	if wait := take(user, chat); wait != time.Second {
+		t.Errorf("expected to wait 1s for the user bucket, got %v", wait)
+	}
+
+	// the rejected request took no token from the chat
+	if wait := take(chat); wait != 0 {
+		t.Errorf("expected the chat bucket to have a token, wait %v", wait)
+	}
+	if wait := take(RateBucket{Key: "msg:user:bob", PerMinute: 60, Burst: 3}); wait != 0 {
+		t.Errorf("expected other users not to be limited, wait %v", wait)
+	}
+
+	mr.SetTime(now.Add(1500 * time.Millisecond))
+	if wait := take(user); wait != 0 {
+		t.Errorf("expected a refilled token, wait %v", wait)
+	}
+	if wait := take(user); wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %v", wait)
+	}
+
+	// buckets never hold more than their burst
+	mr.SetTime(now.Add(time.Hour))
+	for range 3 {
+		take(user)
+	}
+	if wait := take(user); wait == 0 {
+		t.Error("expected the burst to limit requests")
+	}
+}
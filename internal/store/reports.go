@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func (ms *MongodbStore) getReportsCollection() (*mongo.Collection, error) {
+	db, err := ms.getDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return db.Collection("reports"), nil
+}
+
+func (ms *MongodbStore) getAuditLogCollection() (*mongo.Collection, error) {
+	db, err := ms.getDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return db.Collection("auditLog"), nil
+}
+
+// ErrDuplicateReport is returned when the user has reported the message before.
+var ErrDuplicateReport = errors.New("the message is already reported by the user")
+
+// SaveReport saves a new report. Users report a message once, reports of
+// the content filter aren't deduplicated.
+func (ms *MongodbStore) SaveReport(report *internal.Report) error {
+	coll, err := ms.getReportsCollection()
+	if err != nil {
+		return err
+	}
+
+	var insertedId any
+	if report.ReporterId == "" {
+		res, err := coll.InsertOne(context.TODO(), report)
+		if err != nil {
+			return errors.Join(errors.New("failed to save report"), err)
+		}
+		insertedId = res.InsertedID
+	} else {
+		filter := bson.M{"messageId": report.MessageId, "reporterId": report.ReporterId}
+		opts := options.UpdateOne().SetUpsert(true)
+		res, err := coll.UpdateOne(context.TODO(), filter, bson.M{"$setOnInsert": report}, opts)
+		if err != nil {
+			return errors.Join(errors.New("failed to save report"), err)
+		}
+		if res.UpsertedCount == 0 {
+			return ErrDuplicateReport
+		}
+		insertedId = res.UpsertedID
+	}
+
+	if id, ok := insertedId.(bson.ObjectID); ok {
+		report.Id = id
+	} else {
+		return errors.New("failed to read inserted report id")
+	}
+
+	return nil
+}
+
+func (ms *MongodbStore) GetReport(id string) (*internal.Report, error) {
+	coll, err := ms.getReportsCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	rId, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	var report internal.Report
+	if err := coll.FindOne(context.TODO(), bson.M{"_id": rId}).Decode(&report); errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoRecord
+	} else if err != nil {
+		return nil, errors.Join(errors.New("failed to decode report"), err)
+	}
+
+	return &report, nil
+}
+
+// GetOpenReports returns reports of the chats waiting for moderators,
+// the oldest first.
+func (ms *MongodbStore) GetOpenReports(chatIds []string) ([]*internal.Report, error) {
+	coll, err := ms.getReportsCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"chatId": bson.M{"$in": chatIds}, "status": internal.ReportOpen}
+	opts := options.Find().SetSort(bson.M{"createdAt": 1})
+	cursor, err := coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get reports"), err)
+	}
+
+	var reports []*internal.Report
+	if err := cursor.All(context.TODO(), &reports); err != nil {
+		return nil, errors.Join(errors.New("failed to decode reports"), err)
+	}
+
+	return reports, nil
+}
+
+// CloseReport closes the open report with the action of the moderator.
+// Reports closed already by another moderator aren't found.
+func (ms *MongodbStore) CloseReport(id string, action internal.ModerationAction, moderatorId string) (*internal.Report, error) {
+	coll, err := ms.getReportsCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	rId, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	status := internal.ReportResolved
+	if action == internal.ActionDismiss {
+		status = internal.ReportDismissed
+	}
+
+	filter := bson.M{"_id": rId, "status": internal.ReportOpen}
+	update := bson.M{"$set": bson.M{
+		"status":      status,
+		"action":      action,
+		"moderatorId": moderatorId,
+		"closedAt":    time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var report internal.Report
+	if err := coll.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&report); errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoRecord
+	} else if err != nil {
+		return nil, errors.Join(errors.New("failed to close report"), err)
+	}
+
+	return &report, nil
+}
+
+func (ms *MongodbStore) SaveAuditEntry(entry *internal.AuditEntry) error {
+	coll, err := ms.getAuditLogCollection()
+	if err != nil {
+		return err
+	}
+
+	if _, err := coll.InsertOne(context.TODO(), entry); err != nil {
+		return errors.Join(errors.New("failed to save audit entry"), err)
+	}
+
+	return nil
+}
+
+// GetAuditLog returns the latest actions taken in the chats, the newest first.
+func (ms *MongodbStore) GetAuditLog(chatIds []string, limit int64) ([]*internal.AuditEntry, error) {
+	coll, err := ms.getAuditLogCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(limit)
+	cursor, err := coll.Find(context.TODO(), bson.M{"chatId": bson.M{"$in": chatIds}}, opts)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get audit log"), err)
+	}
+
+	var entries []*internal.AuditEntry
+	if err := cursor.All(context.TODO(), &entries); err != nil {
+		return nil, errors.Join(errors.New("failed to decode audit log"), err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+/*
+
+Scheduled messages are kept in their own collection, so they don't show up
+in the chat until they are posted. The scheduler of the chat server claims
+a due message by setting its claim time, publishes it as a new message and
+deletes it. Claims of schedulers stopped before deleting the message expire,
+so the message is posted at least once.
+
+Claimed messages can't be edited or cancelled by their authors anymore.
+
+*/
+
+func (ms *MongodbStore) getScheduledCollection() (*mongo.Collection, error) {
+	db, err := ms.getDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return db.Collection("scheduledMessages"), nil
+}
+
+// ScheduleMessage saves the message to be posted at its scheduled time.
+func (ms *MongodbStore) ScheduleMessage(m *internal.Message) error {
+	coll, err := ms.getScheduledCollection()
+	if err != nil {
+		return err
+	}
+
+	msg := Message{}
+	msg.fromInternal(m)
+	msg.Status = internal.Scheduled
+
+	res, err := coll.InsertOne(context.TODO(), msg)
+	if err != nil {
+		return errors.Join(errors.New("failed to schedule message"), err)
+	}
+
+	if id, ok := res.InsertedID.(bson.ObjectID); ok {
+		m.Id = id
+		m.Status = internal.Scheduled
+	} else {
+		return errors.New("failed to read inserted message id")
+	}
+
+	return nil
+}
+
+// GetScheduledMessages returns messages of the author waiting to be posted
+// in the chat, the earliest first.
+func (ms *MongodbStore) GetScheduledMessages(chatId string, authorId string) ([]*internal.Message, error) {
+	coll, err := ms.getScheduledCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	cId, err := bson.ObjectIDFromHex(chatId)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	user, err := ms.GetUserById(authorId)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get author of messages"), err)
+	}
+
+	opts := options.Find().SetSort(bson.M{"scheduledAt": 1})
+	cursor, err := coll.Find(context.TODO(), bson.M{"chatId": cId, "authorId": user.Id}, opts)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get scheduled messages"), err)
+	}
+
+	var results []Message
+	if err := cursor.All(context.TODO(), &results); err != nil {
+		return nil, errors.Join(ErrDecodeMessage, err)
+	}
+
+	msgs := make([]*internal.Message, 0, len(results))
+	for _, m := range results {
+		msgs = append(msgs, m.toInternal(*user))
+	}
+	return msgs, nil
+}
+
+// pendingFilter matches the unclaimed message of the author.
+func pendingFilter(id string, authorId string) (bson.M, error) {
+	msgId, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	aId, err := bson.ObjectIDFromHex(authorId)
+	if err != nil {
+		return nil, errors.Join(ErrParseId, err)
+	}
+
+	return bson.M{"_id": msgId, "authorId": aId, "claimedAt": bson.M{"$exists": false}}, nil
+}
+
+// UpdateScheduledMessage changes the content and time of the pending
+// message, ErrNoRecord is returned for messages already being posted.
+func (ms *MongodbStore) UpdateScheduledMessage(id string, authorId string, content string, at time.Time) (*internal.Message, error) {
+	coll, err := ms.getScheduledCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := pendingFilter(id, authorId)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := coll.FindOneAndUpdate(
+		context.TODO(),
+		filter,
+		bson.M{"$set": bson.M{"content": content, "scheduledAt": at, "modifiedAt": time.Now()}},
+		opts,
+	)
+
+	var result Message
+	if err := res.Decode(&result); errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoRecord
+	} else if err != nil {
+		return nil, errors.Join(ErrDecodeMessage, err)
+	}
+
+	user, err := ms.GetUserById(authorId)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to attache author to message"), err)
+	}
+
+	return result.toInternal(*user), nil
+}
+
+// CancelScheduledMessage deletes the pending message, ErrNoRecord is
+// returned for messages already being posted.
+func (ms *MongodbStore) CancelScheduledMessage(id string, authorId string) error {
+	coll, err := ms.getScheduledCollection()
+	if err != nil {
+		return err
+	}
+
+	filter, err := pendingFilter(id, authorId)
+	if err != nil {
+		return err
+	}
+
+	res, err := coll.DeleteOne(context.TODO(), filter)
+	if err != nil {
+		return errors.Join(errors.New("failed to cancel scheduled message"), err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// ClaimDueScheduledMessage claims the earliest message due at the time,
+// claims made before staleBefore are taken over. ErrNoRecord is returned
+// when no message is due.
+func (ms *MongodbStore) ClaimDueScheduledMessage(now time.Time, staleBefore time.Time) (*internal.Message, error) {
+	coll, err := ms.getScheduledCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"scheduledAt": 1}).
+		SetReturnDocument(options.After)
+	res := coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{
+			"scheduledAt": bson.M{"$lte": now},
+			"$or": bson.A{
+				bson.M{"claimedAt": bson.M{"$exists": false}},
+				bson.M{"claimedAt": bson.M{"$lt": staleBefore}},
+			},
+		},
+		bson.M{"$set": bson.M{"claimedAt": now}},
+		opts,
+	)
+
+	var result Message
+	if err := res.Decode(&result); errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoRecord
+	} else if err != nil {
+		return nil, errors.Join(ErrDecodeMessage, err)
+	}
+
+	return result.toInternal(internal.User{Id: result.AuthorId}), nil
+}
+
+// DeleteScheduledMessage deletes the posted message.
+func (ms *MongodbStore) DeleteScheduledMessage(id string) error {
+	coll, err := ms.getScheduledCollection()
+	if err != nil {
+		return err
+	}
+
+	msgId, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return errors.Join(ErrParseId, err)
+	}
+
+	if _, err := coll.DeleteOne(context.TODO(), bson.M{"_id": msgId}); err != nil {
+		return errors.Join(errors.New("failed to delete scheduled message"), err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+
+Storage usage is counted in bytes of stored files, per user in a hash and
+globally in a separate key. A file is charged to the user who uploaded its
+content first, the user and the size are kept in a hash keyed by the stored
+file name. Uploads of content already stored aren't charged, the usage is
+freed when the file is deleted with its last reference. Admins can reset
+usage of users, files charged to them aren't freed again then.
+
+NOTE: quota is checked before the upload and usage is added after it,
+so concurrent uploads of the same user may exceed the quota by their size.
+
+*/
+
+const (
+	usersUsageKey  = "storage:usage:users"
+	globalUsageKey = "storage:usage:global"
+	filesUsageKey  = "storage:usage:files"
+)
+
+var (
+	ErrUserQuotaExceeded   = errors.New("your storage quota is exceeded")
+	ErrGlobalQuotaExceeded = errors.New("storage of the server is full")
+)
+
+// CheckStorageQuota returns an error if storing size bytes more would exceed
+// the user or global limit. Zero limit is unlimited.
+func (rs *RedisStore) CheckStorageQuota(ctx context.Context, userId string, size, userLimit, globalLimit int64) error {
+	user, global, err := rs.GetStorageUsage(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	if userLimit > 0 && user+size > userLimit {
+		return ErrUserQuotaExceeded
+	}
+	if globalLimit > 0 && global+size > globalLimit {
+		return ErrGlobalQuotaExceeded
+	}
+	return nil
+}
+
+// GetStorageUsage returns number of bytes stored by the user and by all users.
+func (rs *RedisStore) GetStorageUsage(ctx context.Context, userId string) (user, global int64, err error) {
+	pipe := rs.client.Pipeline()
+	userCmd := pipe.HGet(ctx, usersUsageKey, userId)
+	globalCmd := pipe.Get(ctx, globalUsageKey)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return 0, 0, fmt.Errorf("getting storage usage: %w", err)
+	}
+
+	user, _ = userCmd.Int64()
+	global, _ = globalCmd.Int64()
+	return user, global, nil
+}
+
+// addFileUsage charges the user for the file unless it's charged already.
+var addFileUsage = redis.NewScript(`
+if redis.call("HSETNX", KEYS[1], ARGV[1], ARGV[2] .. " " .. ARGV[3]) == 0 then
+	return 0
+end
+redis.call("HINCRBY", KEYS[2], ARGV[2], ARGV[3])
+redis.call("INCRBY", KEYS[3], ARGV[3])
+return 1
+`)
+
+// AddFileUsage counts the stored file in usage of the user. A file already
+// charged to anyone, like an upload of stored content, isn't counted again.
+//
+// Returns whether the user was charged.
+func (rs *RedisStore) AddFileUsage(ctx context.Context, userId string, fname string, size int64) (bool, error) {
+	added, err := addFileUsage.Run(ctx, rs.client, []string{filesUsageKey, usersUsageKey, globalUsageKey}, fname, userId, size).Int()
+	if err != nil {
+		return false, fmt.Errorf("adding storage usage: %w", err)
+	}
+	return added == 1, nil
+}
+
+// releaseFileUsage removes the file from usage of the user it's charged to.
+var releaseFileUsage = redis.NewScript(`
+local charged = redis.call("HGET", KEYS[1], ARGV[1])
+if not charged then
+	return 0
+end
+local user, size = string.match(charged, "^(.+) (%d+)$")
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("HINCRBY", KEYS[2], user, -size)
+redis.call("DECRBY", KEYS[3], size)
+return tonumber(size)
+`)
+
+// ReleaseFileUsage frees usage of the deleted file, files which aren't
+// charged to anyone are ignored.
+func (rs *RedisStore) ReleaseFileUsage(ctx context.Context, fname string) error {
+	if err := releaseFileUsage.Run(ctx, rs.client, []string{filesUsageKey, usersUsageKey, globalUsageKey}, fname).Err(); err != nil {
+		return fmt.Errorf("releasing storage usage: %w", err)
+	}
+	return nil
+}
+
+// GetUsersStorageUsage returns number of bytes stored by each user with
+// any usage and by all users.
+func (rs *RedisStore) GetUsersStorageUsage(ctx context.Context) (map[string]int64, int64, error) {
+	pipe := rs.client.Pipeline()
+	usersCmd := pipe.HGetAll(ctx, usersUsageKey)
+	globalCmd := pipe.Get(ctx, globalUsageKey)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, 0, fmt.Errorf("getting storage usage: %w", err)
+	}
+
+	users := make(map[string]int64)
+	for id, v := range usersCmd.Val() {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			users[id] = n
+		}
+	}
+
+	global, _ := globalCmd.Int64()
+	return users, global, nil
+}
+
+// resetUserUsage removes usage of the user from both counters and forgets
+// files charged to the user atomically.
+var resetUserUsage = redis.NewScript(`
+local usage = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+redis.call("HDEL", KEYS[1], ARGV[1])
+if usage ~= 0 then
+	redis.call("DECRBY", KEYS[2], usage)
+end
+local files = redis.call("HGETALL", KEYS[3])
+for i = 1, #files, 2 do
+	if string.match(files[i + 1], "^(.+) ") == ARGV[1] then
+		redis.call("HDEL", KEYS[3], files[i])
+	end
+end
+return usage
+`)
+
+// ResetStorageUsage clears usage of the user, the global usage is lowered
+// by the cleared amount.
+func (rs *RedisStore) ResetStorageUsage(ctx context.Context, userId string) error {
+	if err := resetUserUsage.Run(ctx, rs.client, []string{usersUsageKey, globalUsageKey, filesUsageKey}, userId).Err(); err != nil {
+		return fmt.Errorf("resetting storage usage: %w", err)
+	}
+	return nil
+}
+
+// ResetAllStorageUsage clears usage of all users and the global usage.
+func (rs *RedisStore) ResetAllStorageUsage(ctx context.Context) error {
+	if err := rs.client.Del(ctx, usersUsageKey, globalUsageKey, filesUsageKey).Err(); err != nil {
+		return fmt.Errorf("resetting storage usage: %w", err)
+	}
+	return nil
+}
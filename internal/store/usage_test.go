@@ -0,0 +1,121 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisStore(t *testing.T) *RedisStore {
+	mr := miniredis.RunT(t)
+	return &RedisStore{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+}
+
+func TestCheckStorageQuota(t *testing.T) {
+	rs := newTestRedisStore(t)
+	ctx := t.Context()
+
+	if _, err := rs.AddFileUsage(ctx, "alice", "a.txt", 80); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.AddFileUsage(ctx, "bob", "b.txt", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		size     int64
+		expected error
+	}{
+		{"within quota", "alice", 20, nil},
+		{"user quota exceeded", "alice", 21, ErrUserQuotaExceeded},
+		{"global quota exceeded", "carol", 21, ErrGlobalQuotaExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rs.CheckStorageQuota(ctx, tt.user, tt.size, 100, 200)
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+
+	if err := rs.CheckStorageQuota(ctx, "alice", 1000, 0, 0); err != nil {
+		t.Errorf("zero limits should be unlimited, got %v", err)
+	}
+}
+
+func TestResetStorageUsage(t *testing.T) {
+	rs := newTestRedisStore(t)
+	ctx := t.Context()
+
+	rs.AddFileUsage(ctx, "alice", "a.txt", 80)
+	rs.AddFileUsage(ctx, "bob", "b.txt", 100)
+
+	if err := rs.ResetStorageUsage(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	users, global, err := rs.GetUsersStorageUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := users["alice"]; ok || users["bob"] != 100 || global != 100 {
+		t.Errorf("after reset got users %v and global %d", users, global)
+	}
+
+	// the file of alice was already cleared by the reset
+	if err := rs.ReleaseFileUsage(ctx, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if user, global, _ := rs.GetStorageUsage(ctx, "alice"); user != 0 || global != 100 {
+		t.Errorf("release after reset got user %d and global %d", user, global)
+	}
+
+	if err := rs.ResetAllStorageUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if user, global, _ := rs.GetStorageUsage(ctx, "bob"); user != 0 || global != 0 {
+		t.Errorf("after reset of all got user %d and global %d", user, global)
+	}
+}
+
+func TestFileUsage(t *testing.T) {
+	rs := newTestRedisStore(t)
+	ctx := t.Context()
+
+	if added, err := rs.AddFileUsage(ctx, "alice", "abc.txt", 80); err != nil || !added {
+		t.Fatalf("first upload added %v with error %v", added, err)
+	}
+	// the same content uploaded again is stored once
+	if added, err := rs.AddFileUsage(ctx, "bob", "abc.txt", 80); err != nil || added {
+		t.Fatalf("upload of stored content added %v with error %v", added, err)
+	}
+	if _, err := rs.AddFileUsage(ctx, "bob", "def.txt", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	users, global, err := rs.GetUsersStorageUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users["alice"] != 80 || users["bob"] != 100 || global != 180 {
+		t.Errorf("got users %v and global %d", users, global)
+	}
+
+	if err := rs.ReleaseFileUsage(ctx, "abc.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// the file is freed once, unknown files are ignored
+	rs.ReleaseFileUsage(ctx, "abc.txt")
+	rs.ReleaseFileUsage(ctx, "unknown.txt")
+
+	users, global, _ = rs.GetUsersStorageUsage(ctx)
+	if users["alice"] != 0 || users["bob"] != 100 || global != 100 {
+		t.Errorf("after release got users %v and global %d", users, global)
+	}
+}
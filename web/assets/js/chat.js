@@ -75,3 +75,295 @@ window.addEventListener("resize", () => {
 
   handleSetPosition(ctxMenu, invokedFrom, ctxMenu);
 });
+
+function copyCode(btn) {
+  const code = btn.closest(".code-block").querySelector("pre");
+  navigator.clipboard.writeText(code.innerText).then(() => {
+    btn.innerText = "Copied";
+    setTimeout(() => (btn.innerText = "Copy"), 1500);
+  });
+}
+
+function expandCode(btn) {
+  const body = btn.closest(".code-block").querySelector(".code-body");
+  body.classList.remove("max-h-60", "overflow-y-hidden");
+  btn.remove();
+}
+
+const UPLOAD_CHUNK_SIZE = 4 * 1024 * 1024;
+const UPLOAD_MAX_RETRIES = 5;
+
+// uploadFile sends the selected file in chunks using the resumable upload
+// endpoints. Location of the upload is kept in localStorage, so selecting
+// the same file again after a failure or reload continues where it stopped.
+async function uploadFile(input) {
+  const file = input.files[0];
+  input.value = "";
+  if (!file) return;
+
+  const progress = document.getElementById("upload-progress");
+  const setProgress = (sent, text) => {
+    progress.querySelector(".upload-bar").style.width =
+      (file.size ? (sent / file.size) * 100 : 100) + "%";
+    progress.querySelector(".upload-status").innerText =
+      text ?? Math.floor((sent / file.size) * 100) + "%";
+  };
+
+  progress.classList.remove("hidden");
+  progress.querySelector(".upload-name").innerText = file.name;
+  progress.querySelector(".upload-status").classList.remove("text-red-400");
+  setProgress(0);
+
+  const key = `upload:${input.dataset.uploadUrl}:${file.name}:${file.size}:${file.lastModified}`;
+
+  try {
+    let location = localStorage.getItem(key);
+    let offset = location ? await uploadOffset(location) : null;
+    if (offset === null) {
+      location = await createUpload(input.dataset.uploadUrl, file);
+      localStorage.setItem(key, location);
+      offset = 0;
+    }
+
+    let retries = 0;
+    while (offset < file.size) {
+      const chunk = file.slice(offset, offset + UPLOAD_CHUNK_SIZE);
+      try {
+        offset = await sendChunk(location, offset, chunk, (loaded) =>
+          setProgress(offset + loaded),
+        );
+        retries = 0;
+      } catch (err) {
+        if (err.status && err.status < 500 && err.status !== 409 && err.status !== 460) {
+          throw err;
+        }
+        if (++retries > UPLOAD_MAX_RETRIES) throw err;
+
+        setProgress(offset, "Retrying...");
+        await new Promise((resolve) => setTimeout(resolve, 1000 * 2 ** retries));
+        const current = await uploadOffset(location);
+        if (current === null) throw err;
+        offset = current;
+      }
+      setProgress(offset);
+    }
+
+    localStorage.removeItem(key);
+    progress.classList.add("hidden");
+  } catch (err) {
+    if (err.status && err.status !== 423) localStorage.removeItem(key);
+    progress.querySelector(".upload-status").classList.add("text-red-400");
+    setProgress(0, err.message || "Upload failed");
+  }
+}
+
+async function createUpload(url, file) {
+  const res = await fetch(url, {
+    method: "POST",
+    headers: {
+      "Upload-Length": file.size,
+      "Upload-Filename": encodeURIComponent(file.name),
+      // rejections like exceeded quota are rendered as an error popup
+      "HX-Request": "true",
+    },
+  });
+  if (!res.ok) throw await uploadError(res);
+  return res.headers.get("Location");
+}
+
+// uploadOffset returns where the next chunk of the upload should start,
+// or null if the upload doesn't exist anymore.
+async function uploadOffset(location) {
+  const res = await fetch(location, { method: "HEAD", cache: "no-store" });
+  if (!res.ok) return null;
+  return Number(res.headers.get("Upload-Offset"));
+}
+
+async function uploadError(res) {
+  let msg = await res.text();
+  // the popup is already shown to the user
+  const shown = res.headers.get("Content-Type")?.startsWith("text/html");
+  if (shown) {
+    document.body.insertAdjacentHTML("beforeend", msg);
+    msg = "Upload rejected";
+  }
+
+  const err = new Error(msg || res.statusText);
+  err.status = res.status;
+  err.shown = shown;
+  return err;
+}
+
+async function chunkChecksum(chunk) {
+  // SubtleCrypto is available only in secure contexts
+  if (!window.crypto?.subtle) return null;
+
+  const digest = await crypto.subtle.digest("SHA-256", await chunk.arrayBuffer());
+  return "sha256 " + btoa(String.fromCharCode(...new Uint8Array(digest)));
+}
+
+// sendChunk resolves with the offset after the chunk, XMLHttpRequest is used
+// as fetch doesn't report upload progress.
+async function sendChunk(location, offset, chunk, onProgress) {
+  const checksum = await chunkChecksum(chunk);
+
+  return new Promise((resolve, reject) => {
+    const xhr = new XMLHttpRequest();
+    xhr.open("PATCH", location);
+    xhr.setRequestHeader("Content-Type", "application/offset+octet-stream");
+    xhr.setRequestHeader("Upload-Offset", offset);
+    if (checksum) xhr.setRequestHeader("Upload-Checksum", checksum);
+
+    xhr.upload.onprogress = (evt) => onProgress(evt.loaded);
+    xhr.onload = () => {
+      if (xhr.status >= 200 && xhr.status < 300) {
+        resolve(Number(xhr.getResponseHeader("Upload-Offset")));
+      } else {
+        const err = new Error(xhr.responseText.trim() || xhr.statusText);
+        err.status = xhr.status;
+        reject(err);
+      }
+    };
+    xhr.onerror = () => reject(new Error("Connection lost"));
+    xhr.send(chunk);
+  });
+}
+
+const VOICE_MAX_DURATION = 5 * 60 * 1000;
+const VOICE_MIME_TYPES = ["audio/webm;codecs=opus", "audio/ogg;codecs=opus", "audio/mp4"];
+
+let voiceRecorder = null;
+
+// toggleVoiceRecording starts recording from the microphone or stops
+// the recording and sends it as a voice message.
+async function toggleVoiceRecording(button) {
+  if (voiceRecorder) {
+    voiceRecorder.stop();
+    return;
+  }
+
+  let stream;
+  try {
+    stream = await navigator.mediaDevices.getUserMedia({ audio: true });
+  } catch {
+    alert("Microphone access is needed to record voice messages.");
+    return;
+  }
+
+  const mimeType = VOICE_MIME_TYPES.find((type) => MediaRecorder.isTypeSupported(type));
+  const recorder = new MediaRecorder(stream, mimeType ? { mimeType } : {});
+  const chunks = [];
+  const setRecording = (recording) => {
+    button.querySelector(".voice-idle").classList.toggle("hidden", recording);
+    button.querySelector(".voice-recording").classList.toggle("hidden", !recording);
+  };
+
+  // recordings are cut at the length accepted by the server
+  const timeout = setTimeout(() => recorder.stop(), VOICE_MAX_DURATION);
+
+  recorder.ondataavailable = (evt) => chunks.push(evt.data);
+  recorder.onstop = () => {
+    clearTimeout(timeout);
+    stream.getTracks().forEach((track) => track.stop());
+    voiceRecorder = null;
+    setRecording(false);
+
+    const type = recorder.mimeType.split(";")[0];
+    const ext = { "audio/webm": "webm", "audio/ogg": "ogg", "audio/mp4": "m4a" }[type] ?? "webm";
+    sendVoiceMessage(button.dataset.voiceUrl, new File(chunks, "voice-message." + ext, { type }));
+  };
+
+  voiceRecorder = recorder;
+  recorder.start();
+  setRecording(true);
+}
+
+async function sendVoiceMessage(url, file) {
+  const form = new FormData();
+  form.append("type", "voice");
+  form.append("file", file);
+
+  try {
+    const res = await fetch(url, {
+      method: "POST",
+      body: form,
+      // rejections like exceeded quota are rendered as an error popup
+      headers: { "HX-Request": "true" },
+    });
+    if (!res.ok) throw await uploadError(res);
+  } catch (err) {
+    if (!err.shown) alert(err.message || "Failed to send the voice message.");
+  }
+}
+
+// toggleVoice plays or pauses the voice message, the duration comes from
+// the server as recordings often don't declare it.
+function toggleVoice(button) {
+  const player = button.closest(".voice-player");
+  const audio = player.querySelector("audio");
+
+  if (!audio.paused) {
+    audio.pause();
+    return;
+  }
+
+  document.querySelectorAll(".voice-player audio").forEach((other) => {
+    if (other !== audio) other.pause();
+  });
+
+  if (!audio.dataset.bound) {
+    audio.dataset.bound = "true";
+    const duration = Number(player.dataset.duration);
+    const bar = player.querySelector(".voice-bar");
+    const time = player.querySelector(".voice-time");
+    const formatTime = (seconds) => {
+      const s = Math.round(seconds);
+      return Math.floor(s / 60) + ":" + String(s % 60).padStart(2, "0");
+    };
+    const setPlaying = (playing) => {
+      button.querySelector(".voice-play").classList.toggle("hidden", playing);
+      button.querySelector(".voice-pause").classList.toggle("hidden", !playing);
+    };
+
+    audio.addEventListener("play", () => setPlaying(true));
+    audio.addEventListener("pause", () => setPlaying(false));
+    audio.addEventListener("timeupdate", () => {
+      bar.style.width = (duration ? Math.min(audio.currentTime / duration, 1) * 100 : 0) + "%";
+      time.innerText = formatTime(duration - audio.currentTime > 0 ? duration - audio.currentTime : 0);
+    });
+    audio.addEventListener("ended", () => {
+      bar.style.width = "0%";
+      time.innerText = formatTime(duration);
+    });
+  }
+
+  audio.play();
+}
+
+// addPollOption appends an input of the next option to the poll form.
+function addPollOption(button) {
+  const options = button.closest("form").querySelector(".poll-options");
+  const count = options.children.length;
+  if (count >= Number(button.dataset.maxOptions)) return;
+
+  const input = options.lastElementChild.cloneNode();
+  input.value = "";
+  input.required = false;
+  input.placeholder = `Option ${count + 1}`;
+  options.append(input);
+
+  if (count + 1 >= Number(button.dataset.maxOptions)) button.classList.add("hidden");
+}
+
+// scheduledTime converts the local time of the datetime-local input to UTC.
+function scheduledTime(id) {
+  const value = document.getElementById(id).value;
+  return value ? new Date(value).toISOString() : "";
+}
+
+// setLocalTime fills the datetime-local input with the time in the local zone.
+function setLocalTime(id, iso) {
+  const date = new Date(iso);
+  const local = new Date(date.getTime() - date.getTimezoneOffset() * 60000);
+  document.getElementById(id).value = local.toISOString().slice(0, 16);
+}
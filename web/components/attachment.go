@@ -0,0 +1,75 @@
+package components
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"net/url"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+	"github.com/ellezio/Chat-app-with-Go/internal/signedurl"
+)
+
+// maxImageHeight is the height in pixels to which images in messages are limited.
+const maxImageHeight = 320
+
+// FileURLSigner signs addresses of files, they are served unsigned when nil.
+var FileURLSigner *signedurl.Signer
+
+// fileURL returns the address under which the stored file is served.
+func fileURL(name string) string {
+	return fileURLWithQuery(name, url.Values{})
+}
+
+// variantURL returns the address of the resized image, size is one of
+// the variants generated by the file server.
+func variantURL(name, size string) string {
+	return fileURLWithQuery(name, url.Values{"size": {size}})
+}
+
+func fileURLWithQuery(name string, query url.Values) string {
+	if FileURLSigner != nil {
+		maps.Copy(query, FileURLSigner.Query(name))
+	}
+
+	if len(query) == 0 {
+		return "/files/" + name
+	}
+	return "/files/" + name + "?" + query.Encode()
+}
+
+// imageDisplaySize returns dimensions in which the image is displayed, so the
+// space can be reserved before it loads. Zeros are returned for unknown size.
+func imageDisplaySize(file *internal.FileInfo) (width, height int) {
+	if file == nil || file.Width <= 0 || file.Height <= 0 {
+		return 0, 0
+	}
+
+	if file.Height <= maxImageHeight {
+		return file.Width, file.Height
+	}
+
+	return max(1, file.Width*maxImageHeight/file.Height), maxImageHeight
+}
+
+// FormatSize formats the number of bytes in a human readable form.
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// FormatDuration formats the number of seconds as minutes and seconds.
+func FormatDuration(seconds float64) string {
+	s := int(math.Round(seconds))
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
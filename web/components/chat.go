@@ -0,0 +1,44 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+)
+
+// messageTTLLabel shortens the message TTL of chats to days or hours.
+func messageTTLLabel(ttl time.Duration) string {
+	if ttl >= 24*time.Hour && ttl%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", ttl/(24*time.Hour))
+	}
+	return fmt.Sprintf("%dh", int(ttl.Hours()))
+}
+
+func roleLabel(role internal.Role) string {
+	switch role {
+	case internal.RoleOwner:
+		return "Owner"
+	case internal.RoleModerator:
+		return "Moderator"
+	case internal.RoleReadOnly:
+		return "Read-only"
+	default:
+		return "Member"
+	}
+}
+
+type blockedUsersKey struct{}
+
+// WithBlockedUsers passes users blocked by the viewer to rendered messages,
+// their messages are collapsed.
+func WithBlockedUsers(ctx context.Context, userIds []string) context.Context {
+	return context.WithValue(ctx, blockedUsersKey{}, userIds)
+}
+
+func isBlocked(ctx context.Context, userId string) bool {
+	userIds, _ := ctx.Value(blockedUsersKey{}).([]string)
+	return slices.Contains(userIds, userId)
+}
@@ -0,0 +1,105 @@
+package components
+
+import (
+	"html"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// CodeBlockCollapseLines is the number of lines after which a code block
+// is rendered collapsed. Zero or less disables collapsing.
+var CodeBlockCollapseLines = 15
+
+const codeFence = "```"
+
+var codeFormatter = chromahtml.New(chromahtml.WithClasses(false), chromahtml.TabWidth(4))
+var codeStyle = styles.Get("monokai")
+
+type contentSegment struct {
+	Text string
+	Lang string
+	Code bool
+}
+
+// splitContent splits message content into plain text and fenced code blocks.
+// A fence which is never closed is left as plain text. Windows line endings
+// are replaced with new lines.
+func splitContent(content string) []contentSegment {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	var segments []contentSegment
+	var text, code strings.Builder
+	var lang string
+	inCode := false
+
+	flushText := func() {
+		if s := strings.Trim(text.String(), "\n"); s != "" {
+			segments = append(segments, contentSegment{Text: s})
+		}
+		text.Reset()
+	}
+
+	for line := range strings.Lines(content) {
+		trimmed := strings.TrimSpace(line)
+
+		if !inCode && strings.HasPrefix(trimmed, codeFence) {
+			inCode = true
+			lang = strings.TrimSpace(strings.TrimPrefix(trimmed, codeFence))
+			code.Reset()
+			code.WriteString(line)
+			continue
+		}
+
+		if inCode && trimmed == codeFence {
+			inCode = false
+			flushText()
+			body := strings.TrimSuffix(code.String(), "\n")
+			_, body, _ = strings.Cut(body, "\n")
+			segments = append(segments, contentSegment{Text: body, Lang: lang, Code: true})
+			continue
+		}
+
+		if inCode {
+			code.WriteString(line)
+		} else {
+			text.WriteString(line)
+		}
+	}
+
+	if inCode {
+		text.WriteString(code.String())
+	}
+	flushText()
+
+	return segments
+}
+
+func lineCount(code string) int {
+	return strings.Count(code, "\n") + 1
+}
+
+// highlightCode renders code as HTML with inline styles. Unknown languages
+// are rendered without highlighting.
+func highlightCode(lang, code string) string {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	var sb strings.Builder
+	iterator, err := lexer.Tokenise(nil, code)
+	if err == nil {
+		err = codeFormatter.Format(&sb, codeStyle, iterator)
+	}
+
+	if err != nil {
+		return "<pre><code>" + html.EscapeString(code) + "</code></pre>"
+	}
+
+	return sb.String()
+}
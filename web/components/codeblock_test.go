@@ -0,0 +1,118 @@
+package components
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []contentSegment
+	}{
+		{
+			"plain text",
+			"hello\nworld",
+			[]contentSegment{{Text: "hello\nworld"}},
+		},
+		{
+			"fence with language",
+			"```go\nfmt.Println(1)\n```",
+			[]contentSegment{{Text: "fmt.Println(1)", Lang: "go", Code: true}},
+		},
+		{
+			"fence without language",
+			"```\nls -la\n```",
+			[]contentSegment{{Text: "ls -la", Code: true}},
+		},
+		{
+			"text before and after fence",
+			"look:\n```py\nprint(1)\nprint(2)\n```\nnice?",
+			[]contentSegment{
+				{Text: "look:"},
+				{Text: "print(1)\nprint(2)", Lang: "py", Code: true},
+				{Text: "nice?"},
+			},
+		},
+		{
+			"unclosed fence",
+			"look:\n```go\nfmt.Println(1)",
+			[]contentSegment{{Text: "look:\n```go\nfmt.Println(1)"}},
+		},
+		{
+			"closed and unclosed fences",
+			"```\na\n```\n```\nb",
+			[]contentSegment{
+				{Text: "a", Code: true},
+				{Text: "```\nb"},
+			},
+		},
+		{
+			"CRLF",
+			"look:\r\n```go\r\na := 1\r\nb := 2\r\n```\r\nnice?\r\n",
+			[]contentSegment{
+				{Text: "look:"},
+				{Text: "a := 1\nb := 2", Lang: "go", Code: true},
+				{Text: "nice?"},
+			},
+		},
+		{
+			"indented fence",
+			"  ```sh  \necho hi\n  ```",
+			[]contentSegment{{Text: "echo hi", Lang: "sh", Code: true}},
+		},
+		{
+			"empty block",
+			"```go\n```",
+			[]contentSegment{{Text: "", Lang: "go", Code: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitContent(tt.content); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %+v expected %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHighlightCode(t *testing.T) {
+	tests := []struct {
+		name        string
+		lang        string
+		code        string
+		highlighted bool
+	}{
+		{"known language", "go", "func main() {}", true},
+		{"alias of language", "py", "def main(): pass", true},
+		{"unknown language", "nosuchlang", "func main() {}", false},
+		{"no language", "", "func main() {}", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := highlightCode(tt.lang, tt.code)
+			if !strings.HasPrefix(out, "<pre") {
+				t.Errorf("code isn't rendered in pre: %s", out)
+			}
+			// keywords get their own span with the color of the style
+			keyword := strings.Fields(tt.code)[0]
+			highlighted := strings.Contains(out, ">"+keyword+"</span>")
+			if highlighted != tt.highlighted {
+				t.Errorf("highlighted %v expected %v: %s", highlighted, tt.highlighted, out)
+			}
+		})
+	}
+}
+
+func TestHighlightCode_EscapesHTML(t *testing.T) {
+	for _, lang := range []string{"html", "nosuchlang"} {
+		out := highlightCode(lang, `<script>alert("x")</script>`)
+		if strings.Contains(out, "<script>") {
+			t.Errorf("%s code isn't escaped: %s", lang, out)
+		}
+	}
+}
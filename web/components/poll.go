@@ -0,0 +1,52 @@
+package components
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ellezio/Chat-app-with-Go/internal"
+)
+
+// pollPercent returns the share of voters who voted for the option.
+func pollPercent(votes, voters int) int {
+	if voters == 0 {
+		return 0
+	}
+	return votes * 100 / voters
+}
+
+func voterNames(voters []internal.PollVoter) string {
+	names := make([]string, 0, len(voters))
+	for _, v := range voters {
+		names = append(names, v.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// pollSummary describes the kind of the poll and when it closes.
+func pollSummary(poll *internal.Poll, now time.Time) string {
+	parts := []string{"Single choice"}
+	if poll.Multiple {
+		parts[0] = "Multiple choice"
+	}
+	if poll.Anonymous {
+		parts = append(parts, "anonymous")
+	}
+
+	switch {
+	case poll.Closed(now):
+		parts = append(parts, "closed")
+	case !poll.ClosesAt.IsZero():
+		parts = append(parts, "closes "+poll.ClosesAt.Format(time.DateTime))
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+func voteCount(voters int) string {
+	if voters == 1 {
+		return "1 vote"
+	}
+	return fmt.Sprintf("%d votes", voters)
+}